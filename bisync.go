@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/brettweavnet/gosync/gosync"
+
+	log "github.com/cihub/seelog"
+	"github.com/codegangsta/cli"
+)
+
+var bisyncCommand = cli.Command{
+	Name:  "bisync",
+	Usage: "sync a local directory and S3 in both directions",
+	Description: "gosync [global options] bisync [--conflict POLICY] DIR s3://bucket/prefix\n\n" +
+		"   Changes on either side since the last bisync are applied to the other.",
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "conflict", Value: "newer", Usage: "keep the newer file, the source's or both when changed on both sides (newer|source|both)"},
+		cli.StringFlag{Name: "conflict-suffix", Value: ".conflict", Usage: "suffix of the copy kept with --conflict both"},
+		cli.StringFlag{Name: "state", Value: "", Usage: "state file (default .gosync-bisync.json in DIR)"},
+	},
+	Action: bisync,
+}
+
+func bisync(c *cli.Context) {
+	defer log.Flush()
+
+	jsonStdout := c.GlobalString("output") == "json" && c.GlobalString("output-file") == ""
+	setLogLevel(c.GlobalString("log-level"), jsonStdout)
+
+	if len(c.Args()) != 2 {
+		exitOnError(fmt.Errorf("Directory and S3 location required."))
+	}
+
+	syncPair := newSyncPair(c, c.Args()[0], c.Args()[1])
+	syncPair.Conflict = gosync.ConflictPolicy(c.String("conflict"))
+	syncPair.ConflictSuffix = c.String("conflict-suffix")
+	syncPair.StatePath = c.String("state")
+	log.Infof("Resolving conflicts with policy '%s'.", syncPair.Conflict)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(syncPair.Stop, cancel)
+
+	err := syncPair.Bisync(ctx)
+	exitOnError(err)
+
+	log.Infof("Syncing completed successfully.")
+}
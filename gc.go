@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/codegangsta/cli"
+)
+
+var gcCommand = cli.Command{
+	Name:  "gc",
+	Usage: "delete the objects of a deduplicated store which no manifest refers to",
+	Description: "gosync [global options] gc [--min-age DURATION] s3://bucket/prefix\n\n" +
+		"   Objects newer than the minimum age are kept, as a sync in progress may not yet have written its manifest.",
+	Flags: []cli.Flag{
+		cli.DurationFlag{Name: "min-age", Value: time.Hour, Usage: "only delete unreferenced objects at least this old"},
+	},
+	Action: gc,
+}
+
+func gc(c *cli.Context) {
+	defer log.Flush()
+
+	jsonStdout := c.GlobalString("output") == "json" && c.GlobalString("output-file") == ""
+	setLogLevel(c.GlobalString("log-level"), jsonStdout)
+
+	if len(c.Args()) != 1 {
+		exitOnError(fmt.Errorf("S3 location required."))
+	}
+
+	syncPair := newSyncPair(c, c.Args()[0], "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(syncPair.Stop, cancel)
+
+	err := syncPair.CollectGarbage(ctx, c.Duration("min-age"))
+	exitOnError(err)
+
+	log.Infof("Garbage collection completed successfully.")
+}
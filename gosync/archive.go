@@ -0,0 +1,428 @@
+package gosync
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// With Unpack set the Source is a tar archive, optionally gzipped, whose
+// entries are synced to the Target as if they were a directory: they are
+// unpacked to a temporary directory which is then synced, so that each
+// entry is compared with the target as a file would be. With Pack set the
+// Source is written to the Target as a tar archive, gzipped unless the
+// Target ends in ".tar", streamed to S3 or to a local file.
+
+// syncArchive unpacks the Source archive to the Target, or packs the
+// Source into the Target archive.
+func (s *SyncPair) syncArchive(ctx context.Context) error {
+	switch {
+	case s.Unpack && s.Pack:
+		return errors.New("Archives can not be both unpacked and packed.")
+	case s.Dedup || s.multipleSources() || s.streams():
+		return errors.New("Archives require a single source and target.")
+	case s.Source == s.Target || !validTarget(s.Source):
+		return errors.New("Invalid sync pair.")
+	}
+	if err := s.validFilters(); err != nil {
+		return err
+	}
+	if err := s.discardJournal(); err != nil {
+		return err
+	}
+
+	if s.Pack {
+		return s.packArchive(ctx)
+	}
+	return s.unpackArchive(ctx)
+}
+
+// unpackArchive unpacks the Source archive to a temporary directory and
+// syncs its contents to the Target.
+func (s *SyncPair) unpackArchive(ctx context.Context) error {
+	if !validTarget(s.Target) {
+		return errors.New("Invalid sync pair.")
+	}
+
+	r, err := s.openArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dir, err := ioutil.TempDir("", "gosync-unpack-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	log.Infof("Unpacking '%s'.", s.Source)
+	if err := unpackTar(r, dir); err != nil {
+		return err
+	}
+
+	// Symlinks unpacked are synced as symlinks rather than read through.
+	source, follow, copyLinks := s.Source, s.FollowSymlinks, s.CopySymlinksAsObjects
+	defer func() {
+		s.Source, s.FollowSymlinks, s.CopySymlinksAsObjects = source, follow, copyLinks
+	}()
+	s.Source = dir + string(os.PathSeparator)
+	s.FollowSymlinks, s.CopySymlinksAsObjects = false, true
+	return s.syncSource(ctx)
+}
+
+// openArchive opens the Source archive, a local file or an S3 object.
+func (s *SyncPair) openArchive() (io.ReadCloser, error) {
+	if !validS3Url(s.Source) {
+		return os.Open(s.Source)
+	}
+	s3url := newS3Url(s.Source)
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.GetReader(strings.TrimLeft(s3url.Key(), "/"))
+}
+
+// unpackTar writes the directories, regular files and symlinks of the tar
+// archive read from r, gzipped or not, below dir. Entries which would be
+// written outside dir, symlinks to paths outside it, and other types of
+// entry are skipped.
+func unpackTar(r io.Reader, dir string) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return removeEscapingLinks(dir)
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "/"))
+		if name == "." {
+			continue
+		}
+		if name == ".." || strings.HasPrefix(name, "../") || throughSymlink(dir, name) {
+			log.Warnf("Skipping archive entry '%s' outside the archive.", header.Name)
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+			os.Remove(target)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg, tar.TypeRegA:
+			err = unpackFile(tr, header, target)
+		case tar.TypeSymlink:
+			if !linkInside(name, header.Linkname) {
+				log.Warnf("Skipping archive symlink '%s' to '%s' outside the archive.", header.Name, header.Linkname)
+				continue
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+				err = os.Symlink(header.Linkname, target)
+			}
+		default:
+			log.Warnf("Skipping archive entry '%s' which is not a file, directory or symlink.", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// linkInside reports whether link, the target of the symlink name, is a
+// relative path within the archive.
+func linkInside(name, link string) bool {
+	if link == "" || path.IsAbs(link) || filepath.IsAbs(link) {
+		return false
+	}
+	resolved := path.Clean(path.Join(path.Dir(name), filepath.ToSlash(link)))
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// removeEscapingLinks removes the symlinks below dir which are broken or
+// resolve to outside it, such as those passing through other symlinks
+// with "..".
+func removeEscapingLinks(dir string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return err
+		}
+		real, err := filepath.EvalSymlinks(filePath)
+		if err == nil && (real == root || strings.HasPrefix(real, root+string(os.PathSeparator))) {
+			return nil
+		}
+		log.Warnf("Skipping archive symlink '%s' which is broken or resolves outside the archive.", relativePath(dir, filePath))
+		return os.Remove(filePath)
+	})
+}
+
+// throughSymlink reports whether any of the parents of name, a path
+// relative to dir, is a symlink, which an entry could be written through
+// to outside dir.
+func throughSymlink(dir, name string) bool {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		info, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(strings.Join(parts[:i], "/"))))
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// unpackFile writes the content of an archive entry to target, with the
+// permissions and modification time of the entry.
+func unpackFile(r io.Reader, header *tar.Header, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(target, header.ModTime, header.ModTime)
+}
+
+// packArchive writes the Source to the Target archive. The archive is
+// always written again, as its entries can not be compared.
+func (s *SyncPair) packArchive(ctx context.Context) error {
+	item := &syncItem{
+		Key:        baseName(s.Target),
+		Source:     s.Source,
+		Target:     s.Target,
+		SourcePath: s.Source,
+		TargetPath: s.Target,
+	}
+
+	if !validS3Url(s.Target) {
+		if !pathExists(filepath.Dir(s.Target)) {
+			return errors.New("Invalid sync pair.")
+		}
+		return s.transfer(ctx, []*syncItem{item}, s.writeArchiveToPath)
+	}
+
+	s3url := newS3Url(s.Target)
+	if strings.HasSuffix(s.Target, "/") || s3url.Prefix() == "" {
+		return errors.New("Packing an archive requires an S3 key to write.")
+	}
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+	item.TargetPath = strings.TrimLeft(s3url.Key(), "/")
+	return s.transfer(ctx, []*syncItem{item}, func(ctx context.Context, item *syncItem) (int64, error) {
+		pr, pw := io.Pipe()
+		go func() {
+			pw.CloseWithError(s.packTar(pw))
+		}()
+		defer pr.Close()
+		return s.writeStreamToS3(ctx, bucket, item, pr)
+	})
+}
+
+// writeArchiveToPath writes the archive to a temporary file renamed into
+// place once complete.
+func (s *SyncPair) writeArchiveToPath(ctx context.Context, item *syncItem) (int64, error) {
+	f, err := ioutil.TempFile(filepath.Dir(item.TargetPath), ".gosync-")
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.packTar(&contextWriter{w: f, ctx: ctx})
+	var n int64
+	if err == nil {
+		n, err = f.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), item.TargetPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	s.addProgress(item, n)
+	return n, nil
+}
+
+// packTar writes the Source as a tar archive to w, gzipped unless the
+// Target ends in ".tar". Entries are named as the files of the Source
+// would be in a directory Target.
+func (s *SyncPair) packTar(w io.Writer) error {
+	var gz *gzip.Writer
+	if !strings.HasSuffix(strings.ToLower(s.Target), ".tar") {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+
+	prefix := ""
+	if !syncContents(s.Source) {
+		prefix = baseName(s.Source) + "/"
+	}
+	var err error
+	if validS3Url(s.Source) {
+		err = s.packS3(tw, prefix)
+	} else {
+		err = s.packLocal(tw, prefix)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	return err
+}
+
+func (s *SyncPair) packLocal(tw *tar.Writer, prefix string) error {
+	root := filepath.Clean(s.Source)
+	return walkLocal(root, s.walkOptions(), func(filePath string, info os.FileInfo) error {
+		file := relativePath(filepath.ToSlash(root), filepath.ToSlash(filePath))
+		if s.excluded(file) {
+			return nil
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = prefix + file
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+func (s *SyncPair) packS3(tw *tar.Writer, prefix string) error {
+	s3url := newS3Url(s.Source)
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+	keys, err := loadS3Keys(bucket, s3url.Prefix(), make(map[string]s3.Key), "")
+	if err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, key := range names {
+		file, ok := relativeKey(s3url.Prefix(), key)
+		if !ok || s.excluded(file) {
+			continue
+		}
+		modified, _ := time.Parse(time.RFC3339, keys[key].LastModified)
+		header := &tar.Header{
+			Name:     prefix + file,
+			Mode:     0644,
+			Size:     keys[key].Size,
+			ModTime:  modified,
+			Typeflag: tar.TypeReg,
+		}
+		if strings.HasSuffix(file, "/") {
+			header.Mode, header.Size, header.Typeflag = 0755, 0, tar.TypeDir
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		body, err := bucket.GetReader(key)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A contextWriter fails with the error of its context once it is done.
+type contextWriter struct {
+	w   io.Writer
+	ctx context.Context
+}
+
+func (cw *contextWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
@@ -0,0 +1,68 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestSyncArchives(t *testing.T) {
+	var archiveTests = []string{
+		"s3://bucket/release.tar.gz",
+		"s3://bucket/release.tar",
+		"$tmp/release.tgz",
+		"$tmp/release.tar",
+	}
+
+	for _, archive := range archiveTests {
+		func() {
+			m, _, stop := testS3(t, "bucket")
+			defer stop()
+
+			source := testSource(t, map[string]string{"a": "abc", "d/b": "0123456789"})
+			defer os.RemoveAll(source)
+			tmp, _ := ioutil.TempDir("", "gosync")
+			defer os.RemoveAll(tmp)
+			target, _ := ioutil.TempDir("", "gosync")
+			defer os.RemoveAll(target)
+			archive = strings.Replace(archive, "$tmp", tmp, 1)
+
+			pack := NewSyncPair(aws.Auth{}, source+"/", archive, faultyRegion)
+			pack.Pack = true
+			if err := pack.Sync(); err != nil {
+				t.Fatalf("Error packing '%s': %s", archive, err)
+			}
+
+			unpack := NewSyncPair(aws.Auth{}, archive, target, faultyRegion)
+			unpack.Unpack = true
+			if err := unpack.Sync(); err != nil {
+				t.Fatalf("Error unpacking '%s': %s", archive, err)
+			}
+			checkLocalFiles(t, target, map[string]string{"a": "abc", "d/b": "0123456789"})
+
+			// Entries are compared with the target, only those changed
+			// are synced again.
+			finished := syncFinished(unpack)
+			if err := unpack.Sync(); err != nil || finished.Files != 0 {
+				t.Errorf("Expected '%s' to sync nothing again, got '%+v' '%v'.", archive, finished, err)
+			}
+			ioutil.WriteFile(filepath.Join(target, "a"), []byte("changed"), 0644)
+			if err := unpack.Sync(); err != nil || finished.Files != 1 {
+				t.Errorf("Expected '%s' to sync one file, got '%+v' '%v'.", archive, finished, err)
+			}
+			checkLocalFiles(t, target, map[string]string{"a": "abc", "d/b": "0123456789"})
+
+			unpack.Target = "s3://bucket/out"
+			if err := unpack.Sync(); err != nil {
+				t.Fatalf("Error unpacking '%s' to S3: %s", archive, err)
+			}
+			if data, _ := m.get("bucket", "out/d/b"); data != "0123456789" {
+				t.Errorf("Expected '%s' unpacked to S3, got '%v'.", archive, m.keys("bucket"))
+			}
+		}()
+	}
+}
@@ -0,0 +1,535 @@
+package gosync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// A ConflictPolicy decides which side of a two way sync is kept when a
+// file changed on both.
+type ConflictPolicy string
+
+const (
+	// ConflictNewer keeps the side modified most recently, and a file
+	// changed on one side over its deletion on the other.
+	ConflictNewer ConflictPolicy = "newer"
+	// ConflictSource keeps the source, including its deletions.
+	ConflictSource ConflictPolicy = "source"
+	// ConflictKeepBoth keeps both, the target's copy renamed with
+	// ConflictSuffix. A deletion loses to a change as with ConflictNewer.
+	ConflictKeepBoth ConflictPolicy = "both"
+)
+
+const (
+	defaultConflictSuffix = ".conflict"
+	defaultStateFile      = ".gosync-bisync.json"
+	bisyncStateVersion    = 1
+)
+
+// Bisync syncs a local source directory and an S3 target in both
+// directions. Files created, changed or deleted on one side since the last
+// Bisync are created, changed or deleted on the other, while those changed
+// on both sides are conflicts resolved by the Conflict policy. The state of
+// each file after a sync is recorded at StatePath. Without a state, as on
+// the first sync, files only on one side are copied to the other and those
+// differing are conflicts.
+func (s *SyncPair) Bisync(ctx context.Context) error {
+	atomic.StoreInt32(&s.stop, 0)
+	return s.run(ctx, s.bisync)
+}
+
+// bisyncState is the checksum of each file on both sides after the last
+// sync.
+type bisyncState struct {
+	Version int                   `json:"version"`
+	Source  string                `json:"source"`
+	Target  string                `json:"target"`
+	Files   map[string]bisyncFile `json:"files"`
+}
+
+type bisyncFile struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// A bisyncSide is a file as listed on one side of the sync.
+type bisyncSide struct {
+	exists   bool
+	checksum string
+	size     int64
+	modTime  time.Time
+}
+
+type bisyncAction int
+
+const (
+	bisyncNone bisyncAction = iota
+	bisyncSettle
+	bisyncUpload
+	bisyncDownload
+	bisyncDeleteRemote
+	bisyncDeleteLocal
+	bisyncKeepBoth
+)
+
+// bisyncDecide decides the action bringing the local and remote copies of
+// a file into agreement given its state after the last sync, and whether
+// they are in conflict. same reports whether both exist with the same
+// content.
+func bisyncDecide(local, remote bisyncSide, old *bisyncFile, same bool, policy ConflictPolicy) (bisyncAction, bool) {
+	localChanged := local.exists != (old != nil) || (old != nil && local.checksum != old.Local)
+	remoteChanged := remote.exists != (old != nil) || (old != nil && remote.checksum != old.Remote)
+
+	switch {
+	case !localChanged && !remoteChanged:
+		return bisyncNone, false
+	case same || (!local.exists && !remote.exists):
+		return bisyncSettle, false
+	case !remoteChanged && local.exists:
+		return bisyncUpload, false
+	case !remoteChanged:
+		return bisyncDeleteRemote, false
+	case !localChanged && remote.exists:
+		return bisyncDownload, false
+	case !localChanged:
+		return bisyncDeleteLocal, false
+	}
+
+	switch {
+	case policy == ConflictSource && local.exists:
+		return bisyncUpload, true
+	case policy == ConflictSource:
+		return bisyncDeleteRemote, true
+	case !local.exists:
+		return bisyncDownload, true
+	case !remote.exists:
+		return bisyncUpload, true
+	case policy == ConflictKeepBoth:
+		return bisyncKeepBoth, true
+	case remote.modTime.After(local.modTime):
+		return bisyncDownload, true
+	}
+	return bisyncUpload, true
+}
+
+// A bisyncChange is the items bringing a file into agreement, after which
+// its state is updated.
+type bisyncChange struct {
+	file     string
+	items    []*syncItem
+	download bool
+}
+
+type bisyncPlan struct {
+	changes       []*bisyncChange
+	downloads     []*syncItem
+	uploads       []*syncItem
+	remoteDeletes []*syncItem
+	localDeletes  []*syncItem
+}
+
+func (s *SyncPair) bisync(ctx context.Context) error {
+	if !s.validPair() || s.multipleSources() || validS3Url(s.Source) || !validS3Url(s.Target) {
+		return errors.New("Two way sync requires a local source directory and S3 target.")
+	}
+	if err := s.validFilters(); err != nil {
+		return err
+	}
+	switch s.Conflict {
+	case ConflictNewer, ConflictSource, ConflictKeepBoth:
+	default:
+		return fmt.Errorf("Unknown conflict policy '%s'.", s.Conflict)
+	}
+
+	s3url := newS3Url(s.Target)
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+
+	statePath := s.StatePath
+	if statePath == "" {
+		statePath = filepath.Join(s.Source, defaultStateFile)
+	}
+	state, err := loadBisyncState(statePath, s.Source, s.Target)
+	if err != nil {
+		return err
+	}
+
+	local, remote, err := s.listBisync(s3url, bucket, statePath)
+	if err != nil {
+		return err
+	}
+
+	plan, err := s.planBisync(s3url, bucket, state, local, remote)
+	if err != nil {
+		return err
+	}
+
+	// Conflict copies are downloaded before they are uploaded.
+	var mu sync.Mutex
+	done := map[*syncItem]bool{}
+	complete := func(items ...*syncItem) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, item := range items {
+			done[item] = true
+		}
+	}
+
+	err = s.transfer(ctx, plan.downloads, func(ctx context.Context, item *syncItem) (int64, error) {
+		n, err := s.writeS3FileToPath(ctx, bucket, item)
+		if err == nil {
+			complete(item)
+		}
+		return n, err
+	})
+	if err == nil {
+		err = s.transfer(ctx, plan.uploads, func(ctx context.Context, item *syncItem) (int64, error) {
+			n, err := s.writeLocalFileToS3(ctx, bucket, item)
+			if err == nil {
+				complete(item)
+			}
+			return n, err
+		})
+	}
+	if err == nil {
+		err = s.delete(ctx, plan.remoteDeletes, func(items []*syncItem) error {
+			err := deleteS3Keys(bucket, items)
+			if err == nil {
+				complete(items...)
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = s.delete(ctx, plan.localDeletes, func(items []*syncItem) error {
+			err := deleteLocalFiles(items)
+			if err == nil {
+				complete(items...)
+			}
+			return err
+		})
+	}
+
+	// Record the files brought into agreement even when the sync failed,
+	// the others keep their previous state so they are synced again.
+	if serr := s.settleBisync(s3url, bucket, state, plan, done, local, remote); serr != nil && err == nil {
+		err = serr
+	}
+	if serr := state.save(statePath); serr != nil && err == nil {
+		err = serr
+	}
+	return err
+}
+
+// listBisync lists both sides of the sync, by their path relative to the
+// source directory and target prefix.
+func (s *SyncPair) listBisync(s3url s3Url, bucket *s3.Bucket, statePath string) (map[string]string, map[string]s3.Key, error) {
+	stateFile := relativePath(filepath.ToSlash(s.Source), filepath.ToSlash(statePath))
+
+	s.emit(Event{Type: ListStarted, Source: s.Source})
+	local, err := loadLocalFiles(s.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	for file, _ := range local {
+		if file == stateFile || s.excluded(file) {
+			delete(local, file)
+		}
+	}
+	s.emit(Event{Type: ListFinished, Source: s.Source, Files: len(local)})
+
+	s.emit(Event{Type: ListStarted, Source: s.Target})
+	keys, err := loadS3Keys(bucket, s3url.Prefix(), make(map[string]s3.Key), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	remote := map[string]s3.Key{}
+	for name, key := range keys {
+		file, ok := relativeKey(s3url.Prefix(), name)
+		if ok && file != stateFile && !s.excluded(file) {
+			remote[file] = key
+		}
+	}
+	s.emit(Event{Type: ListFinished, Source: s.Target, Files: len(remote)})
+
+	return local, remote, nil
+}
+
+func (s *SyncPair) planBisync(s3url s3Url, bucket *s3.Bucket, state *bisyncState, local map[string]string, remote map[string]s3.Key) (*bisyncPlan, error) {
+	files := map[string]bool{}
+	for file, _ := range local {
+		files[file] = true
+	}
+	for file, _ := range remote {
+		files[file] = true
+	}
+	for file, _ := range state.Files {
+		files[file] = true
+	}
+
+	plan := &bisyncPlan{}
+	for file, _ := range files {
+		localPath := strings.Join([]string{s.Source, file}, "/")
+
+		l := bisyncSide{checksum: local[file]}
+		_, l.exists = local[file]
+		if l.exists {
+			info, err := os.Stat(localPath)
+			if err != nil {
+				return nil, err
+			}
+			l.size = info.Size()
+			l.modTime = info.ModTime()
+		}
+
+		key, ok := remote[file]
+		r := bisyncSide{exists: ok, checksum: s3Checksum(key)}
+		if ok {
+			r.modTime, _ = time.Parse(time.RFC3339, key.LastModified)
+		}
+
+		var old *bisyncFile
+		if f, ok := state.Files[file]; ok {
+			old = &f
+		}
+
+		same := l.exists && r.exists && matchesETag(localPath, l.checksum, r.checksum, s.PartSize)
+		action, conflict := bisyncDecide(l, r, old, same, s.Conflict)
+		if action == bisyncNone {
+			continue
+		}
+
+		change := &bisyncChange{file: file}
+		plan.changes = append(plan.changes, change)
+
+		switch action {
+		case bisyncUpload:
+			change.items = append(change.items, s.bisyncUploadItem(s3url, bucket, file, l.size, l.checksum))
+		case bisyncDownload:
+			change.items = append(change.items, s.bisyncDownloadItem(bucket, file, key))
+			change.download = true
+		case bisyncDeleteRemote:
+			change.items = append(change.items, deletionItem(file, s3Location(bucket, key.Key), key.Key))
+		case bisyncDeleteLocal:
+			change.items = append(change.items, deletionItem(file, localPath, localPath))
+		case bisyncKeepBoth:
+			// The remote copy is downloaded beside the local one, then
+			// both are uploaded.
+			copyName := s.conflictName(file, local, remote)
+			copyChange := &bisyncChange{file: copyName, download: true}
+			copyChange.items = append(copyChange.items,
+				s.bisyncDownloadItem(bucket, copyName, key),
+				s.bisyncUploadItem(s3url, bucket, copyName, key.Size, r.checksum))
+			plan.changes = append(plan.changes, copyChange)
+			change.items = append(change.items, s.bisyncUploadItem(s3url, bucket, file, l.size, l.checksum))
+		}
+
+		if conflict {
+			s.reportConflict(change, action, localPath, bucket, s3url)
+		}
+	}
+
+	for _, change := range plan.changes {
+		for _, item := range change.items {
+			switch {
+			case item.Delete && validS3Url(item.Target):
+				plan.remoteDeletes = append(plan.remoteDeletes, item)
+			case item.Delete:
+				plan.localDeletes = append(plan.localDeletes, item)
+			case validS3Url(item.Source):
+				plan.downloads = append(plan.downloads, item)
+			default:
+				plan.uploads = append(plan.uploads, item)
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+func (s *SyncPair) reportConflict(change *bisyncChange, action bisyncAction, localPath string, bucket *s3.Bucket, s3url s3Url) {
+	resolution := "source"
+	switch action {
+	case bisyncDownload, bisyncDeleteLocal:
+		resolution = "target"
+	case bisyncKeepBoth:
+		resolution = "both"
+	}
+
+	target := s3Location(bucket, s3Key(s3url.Prefix(), change.file))
+	log.Warnf("Conflict, '%s' changed in '%s' and '%s', keeping %s.", change.file, s.Source, s.Target, resolution)
+	s.stats.mu.Lock()
+	s.stats.conflicts++
+	s.stats.mu.Unlock()
+	s.emit(Event{Type: Conflict, Key: change.file, Source: localPath, Target: target, Resolution: resolution})
+}
+
+func (s *SyncPair) bisyncUploadItem(s3url s3Url, bucket *s3.Bucket, file string, size int64, checksum string) *syncItem {
+	localPath := strings.Join([]string{s.Source, file}, "/")
+	keyPath := s3Key(s3url.Prefix(), file)
+	return &syncItem{
+		Key:        file,
+		Source:     localPath,
+		Target:     s3Location(bucket, keyPath),
+		SourcePath: localPath,
+		TargetPath: keyPath,
+		Size:       size,
+		Checksum:   checksum,
+	}
+}
+
+func (s *SyncPair) bisyncDownloadItem(bucket *s3.Bucket, file string, k s3.Key) *syncItem {
+	localPath := strings.Join([]string{s.Source, file}, "/")
+	return &syncItem{
+		Key:        file,
+		Source:     s3Location(bucket, k.Key),
+		Target:     localPath,
+		SourcePath: k.Key,
+		TargetPath: localPath,
+		Size:       k.Size,
+		Checksum:   s3Checksum(k),
+	}
+}
+
+// conflictName returns an unused name for the conflict copy of file, with
+// ConflictSuffix inserted before its extension.
+func (s *SyncPair) conflictName(file string, local map[string]string, remote map[string]s3.Key) string {
+	ext := path.Ext(file)
+	base := strings.TrimSuffix(file, ext)
+	for i := 1; ; i++ {
+		name := base + s.ConflictSuffix + ext
+		if i > 1 {
+			name = fmt.Sprintf("%s%s-%d%s", base, s.ConflictSuffix, i, ext)
+		}
+		_, inLocal := local[name]
+		_, inRemote := remote[name]
+		if !inLocal && !inRemote && !pathExists(strings.Join([]string{s.Source, name}, "/")) {
+			return name
+		}
+	}
+}
+
+// settleBisync records the state of each file whose items all completed.
+func (s *SyncPair) settleBisync(s3url s3Url, bucket *s3.Bucket, state *bisyncState, plan *bisyncPlan, done map[*syncItem]bool, local map[string]string, remote map[string]s3.Key) error {
+	// Uploads and deletions change the objects, so list them again.
+	if len(plan.uploads) > 0 || len(plan.remoteDeletes) > 0 {
+		keys, err := loadS3Keys(bucket, s3url.Prefix(), make(map[string]s3.Key), "")
+		if err != nil {
+			return err
+		}
+		remote = map[string]s3.Key{}
+		for name, key := range keys {
+			if file, ok := relativeKey(s3url.Prefix(), name); ok {
+				remote[file] = key
+			}
+		}
+	}
+
+	for _, change := range plan.changes {
+		settled := true
+		for _, item := range change.items {
+			settled = settled && done[item]
+		}
+		if !settled {
+			continue
+		}
+
+		localPath := strings.Join([]string{s.Source, change.file}, "/")
+		checksum, ok := local[change.file]
+		if change.download {
+			f, err := os.Open(localPath)
+			if err != nil {
+				return err
+			}
+			checksum, err = md5Sum(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			ok = true
+		} else if !pathExists(localPath) {
+			ok = false
+		}
+
+		key, inRemote := remote[change.file]
+		if !ok && !inRemote {
+			delete(state.Files, change.file)
+			continue
+		}
+		state.Files[change.file] = bisyncFile{Local: checksum, Remote: s3Checksum(key)}
+	}
+	return nil
+}
+
+// loadBisyncState loads the state of the last sync from source to target,
+// or returns an empty state if there is none.
+func loadBisyncState(path, source, target string) (*bisyncState, error) {
+	state := &bisyncState{
+		Version: bisyncStateVersion,
+		Source:  source,
+		Target:  target,
+		Files:   map[string]bisyncFile{},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Infof("No state at '%s', treating differing files as conflicts.", path)
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded bisyncState
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return nil, fmt.Errorf("Invalid state file '%s'.", path)
+	}
+	if loaded.Source != source || loaded.Target != target {
+		log.Warnf("State '%s' is for '%s' <-> '%s', ignoring it.", path, loaded.Source, loaded.Target)
+		return state, nil
+	}
+	if loaded.Files != nil {
+		state.Files = loaded.Files
+	}
+	return state, nil
+}
+
+// save writes the state to a temporary file renamed into place, so an
+// interruption never leaves a partial state.
+func (st *bisyncState) save(path string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".gosync-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
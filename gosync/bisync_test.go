@@ -0,0 +1,89 @@
+package gosync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestBisyncDecide(t *testing.T) {
+	older := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	newer := older.Add(time.Hour)
+	state := &bisyncFile{Local: "a", Remote: "a"}
+
+	side := func(checksum string, modTime time.Time) bisyncSide {
+		return bisyncSide{exists: true, checksum: checksum, modTime: modTime}
+	}
+	missing := bisyncSide{}
+
+	var bisyncDecideTests = []struct {
+		name     string
+		local    bisyncSide
+		remote   bisyncSide
+		old      *bisyncFile
+		same     bool
+		policy   ConflictPolicy
+		action   bisyncAction
+		conflict bool
+	}{
+		{"unchanged", side("a", older), side("a", older), state, true, ConflictNewer, bisyncNone, false},
+		{"created locally", side("b", older), missing, nil, false, ConflictNewer, bisyncUpload, false},
+		{"created remotely", missing, side("b", older), nil, false, ConflictNewer, bisyncDownload, false},
+		{"changed locally", side("b", older), side("a", older), state, false, ConflictNewer, bisyncUpload, false},
+		{"changed remotely", side("a", older), side("b", older), state, false, ConflictNewer, bisyncDownload, false},
+		{"deleted locally", missing, side("a", older), state, false, ConflictNewer, bisyncDeleteRemote, false},
+		{"deleted remotely", side("a", older), missing, state, false, ConflictNewer, bisyncDeleteLocal, false},
+		{"deleted on both", missing, missing, state, false, ConflictNewer, bisyncSettle, false},
+		{"changed the same", side("b", older), side("b", older), state, true, ConflictNewer, bisyncSettle, false},
+		{"first sync differing", side("b", older), side("c", newer), nil, false, ConflictNewer, bisyncDownload, true},
+		{"local newer", side("b", newer), side("c", older), state, false, ConflictNewer, bisyncUpload, true},
+		{"remote newer", side("b", older), side("c", newer), state, false, ConflictNewer, bisyncDownload, true},
+		{"source wins", side("b", older), side("c", newer), state, false, ConflictSource, bisyncUpload, true},
+		{"source deletion wins", missing, side("c", newer), state, false, ConflictSource, bisyncDeleteRemote, true},
+		{"change beats deletion", missing, side("c", older), &bisyncFile{Local: "a", Remote: "b"}, false, ConflictNewer, bisyncDownload, true},
+		{"keep both", side("b", older), side("c", newer), state, false, ConflictKeepBoth, bisyncKeepBoth, true},
+		{"keep both deletion", side("b", older), missing, &bisyncFile{Local: "a", Remote: "b"}, false, ConflictKeepBoth, bisyncUpload, true},
+	}
+
+	for _, tc := range bisyncDecideTests {
+		action, conflict := bisyncDecide(tc.local, tc.remote, tc.old, tc.same, tc.policy)
+		if action != tc.action || conflict != tc.conflict {
+			t.Errorf("%s: expected action '%d' conflict '%t', got '%d' '%t'.", tc.name, tc.action, tc.conflict, action, conflict)
+		}
+	}
+}
+
+func TestBisyncTrailingSlash(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+	m.put("bucket", "pre/b", "b")
+
+	source := testSource(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(source)
+	state := source + ".state"
+	defer os.Remove(state)
+
+	// Running again finds both files on both sides, rather than deleting
+	// the local one uploaded to the wrong key.
+	sp := NewSyncPair(aws.Auth{}, source, "s3://bucket/pre/", faultyRegion)
+	sp.StatePath = state
+	for run := 1; run <= 2; run++ {
+		if err := sp.Bisync(context.Background()); err != nil {
+			t.Fatalf("Error in run '%d': %s", run, err)
+		}
+		if keys := m.keys("bucket"); !reflect.DeepEqual(keys, []string{"pre/a", "pre/b"}) {
+			t.Fatalf("Unexpected keys '%v' after run '%d'.", keys, run)
+		}
+		for _, file := range []string{"a", "b"} {
+			if data, err := ioutil.ReadFile(filepath.Join(source, file)); err != nil || string(data) != file {
+				t.Fatalf("Expected '%s' after run '%d', got '%s' '%v'.", file, run, data, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package gosync
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Largest read passed through the limiter at once, so a single large
+// read cannot consume the whole bucket and starve the other workers.
+const bandwidthChunkSize = 32 * 1024
+
+// BandwidthLimiter is a token bucket shared by every transfer routine of a
+// sync, so the configured rate applies to the aggregate of all workers.
+type BandwidthLimiter struct {
+	mu      sync.Mutex
+	windows []bandwidthWindow
+	rate    int64
+	tokens  float64
+	last    time.Time
+	now     func() time.Time
+}
+
+// A bandwidthWindow applies rate from start (minutes after midnight,
+// local time) until the start of the next window. A rate of 0 is unlimited.
+type bandwidthWindow struct {
+	start int
+	rate  int64
+}
+
+// NewBandwidthLimiter parses a limit in bytes per second such as "512K",
+// or a timetable of "HH:MM,RATE" entries such as "08:00,512K 19:00,off".
+// An empty spec returns a nil limiter, which does not limit.
+func NewBandwidthLimiter(spec string) (*BandwidthLimiter, error) {
+	windows, err := parseBandwidthSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if windows == nil {
+		return nil, nil
+	}
+
+	return &BandwidthLimiter{
+		windows: windows,
+		rate:    -1,
+		now:     time.Now,
+	}, nil
+}
+
+// Reader wraps r so reads from it are subject to the limit.
+func (l *BandwidthLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &limitedReader{r: r, limiter: l}
+}
+
+func (l *BandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	now := l.now()
+	rate := l.rateAt(now)
+	if rate != l.rate {
+		l.rate = rate
+		l.tokens = float64(rate)
+		l.last = now
+	}
+	if rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+	l.last = now
+
+	// Take the tokens up front and sleep off any debt, later callers
+	// queue up behind it as the debt is shared.
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+func (l *BandwidthLimiter) rateAt(t time.Time) int64 {
+	minutes := t.Hour()*60 + t.Minute()
+
+	// Before the first window of the day the last window of the
+	// previous day is still in effect.
+	current := l.windows[len(l.windows)-1]
+	for _, w := range l.windows {
+		if w.start > minutes {
+			break
+		}
+		current = w
+	}
+	return current.rate
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *BandwidthLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthChunkSize {
+		p = p[:bandwidthChunkSize]
+	}
+	n, err := lr.r.Read(p)
+	if n > 0 {
+		lr.limiter.wait(n)
+	}
+	return n, err
+}
+
+func parseBandwidthSpec(spec string) ([]bandwidthWindow, error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	if len(fields) == 1 && !strings.Contains(fields[0], ",") {
+		rate, err := parseBandwidthRate(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if rate == 0 {
+			return nil, nil
+		}
+		return []bandwidthWindow{{start: 0, rate: rate}}, nil
+	}
+
+	windows := []bandwidthWindow{}
+	for _, field := range fields {
+		parts := strings.SplitN(field, ",", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid bandwidth timetable entry '%s'.", field)
+		}
+
+		start, err := parseTimeOfDay(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		rate, err := parseBandwidthRate(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		windows = append(windows, bandwidthWindow{start: start, rate: rate})
+	}
+
+	sort.Sort(bandwidthWindows(windows))
+	return windows, nil
+}
+
+func parseBandwidthRate(s string) (int64, error) {
+	if strings.ToLower(s) == "off" {
+		return 0, nil
+	}
+	return ParseByteSize(s)
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time of day '%s'.", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// ParseByteSize parses a number of bytes with an optional K, M or G
+// (1024 based) suffix, such as "512K" or "10M".
+func ParseByteSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	str = strings.TrimSuffix(str, "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(str, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(str, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(str, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		str = str[:len(str)-1]
+	}
+
+	// NaN, infinite and sizes too large for an int64 have no integer
+	// value and are rejected along with negative ones.
+	n, err := strconv.ParseFloat(str, 64)
+	size := n * float64(multiplier)
+	if err != nil || math.IsNaN(n) || n < 0 || size >= math.MaxInt64 {
+		return 0, fmt.Errorf("Invalid size '%s'.", s)
+	}
+	return int64(size), nil
+}
+
+// MinPartSize is the smallest part S3 accepts in a multipart upload, other
+// than the last.
+const MinPartSize = 5 * 1024 * 1024
+
+// ParsePartSize parses the size of the parts of multipart uploads as
+// ParseByteSize does, which must be at least MinPartSize.
+func ParsePartSize(s string) (int64, error) {
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return 0, err
+	}
+	if size < MinPartSize {
+		return 0, fmt.Errorf("Part size must be at least 5M.")
+	}
+	return size, nil
+}
+
+type bandwidthWindows []bandwidthWindow
+
+func (w bandwidthWindows) Len() int           { return len(w) }
+func (w bandwidthWindows) Less(i, j int) bool { return w[i].start < w[j].start }
+func (w bandwidthWindows) Swap(i, j int)      { w[i], w[j] = w[j], w[i] }
@@ -0,0 +1,94 @@
+package gosync
+
+import (
+	"testing"
+	"time"
+)
+
+var parseByteSizeTests = []struct {
+	size   string
+	result int64
+	valid  bool
+}{
+	{"100", 100, true},
+	{"512K", 512 * 1024, true},
+	{"512k", 512 * 1024, true},
+	{"10M", 10 * 1024 * 1024, true},
+	{"1.5M", 1572864, true},
+	{"2G", 2 * 1024 * 1024 * 1024, true},
+	{"2GB", 2 * 1024 * 1024 * 1024, true},
+	{"", 0, false},
+	{"abc", 0, false},
+	{"-1K", 0, false},
+	{"inf", 0, false},
+	{"-Inf", 0, false},
+	{"NaN", 0, false},
+	{"1e30", 0, false},
+	{"9000000000G", 0, false},
+}
+
+func TestParseByteSize(t *testing.T) {
+	for _, tc := range parseByteSizeTests {
+		n, err := ParseByteSize(tc.size)
+		if (err == nil) != tc.valid {
+			t.Fatalf("Unexpected validity parsing size '%s'.", tc.size)
+		}
+		if n != tc.result {
+			t.Fatalf("Parsed '%s' as %d, expected %d.", tc.size, n, tc.result)
+		}
+	}
+}
+
+func TestParsePartSize(t *testing.T) {
+	for _, size := range []string{"0", "4M", "5119K", "abc"} {
+		if _, err := ParsePartSize(size); err == nil {
+			t.Fatalf("Expected error for part size '%s'.", size)
+		}
+	}
+	if n, err := ParsePartSize("5M"); err != nil || n != MinPartSize {
+		t.Fatalf("Expected part size 5M, got %d '%v'.", n, err)
+	}
+}
+
+func TestNewBandwidthLimiter(t *testing.T) {
+	for _, spec := range []string{"", "off", "0"} {
+		l, err := NewBandwidthLimiter(spec)
+		if err != nil || l != nil {
+			t.Fatalf("Expected no limiter for '%s'.", spec)
+		}
+	}
+
+	for _, spec := range []string{"fast", "08:00", "25:00,1M", "08:00,1M 19:00,slow"} {
+		if _, err := NewBandwidthLimiter(spec); err == nil {
+			t.Fatalf("Expected error for '%s'.", spec)
+		}
+	}
+}
+
+func TestBandwidthTimetable(t *testing.T) {
+	l, err := NewBandwidthLimiter("19:00,off 08:00,512K 12:30,1M")
+	if err != nil {
+		t.Fatalf("Error parsing timetable: %s", err)
+	}
+
+	var rateTests = []struct {
+		hour   int
+		minute int
+		rate   int64
+	}{
+		{0, 0, 0},
+		{7, 59, 0},
+		{8, 0, 512 * 1024},
+		{12, 29, 512 * 1024},
+		{12, 30, 1024 * 1024},
+		{19, 0, 0},
+		{23, 59, 0},
+	}
+
+	for _, tc := range rateTests {
+		at := time.Date(2014, 1, 1, tc.hour, tc.minute, 0, 0, time.Local)
+		if rate := l.rateAt(at); rate != tc.rate {
+			t.Fatalf("Rate at %02d:%02d was %d, expected %d.", tc.hour, tc.minute, rate, tc.rate)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package gosync
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// A DifferenceType describes how a file differs between source and target.
+type DifferenceType string
+
+const (
+	// FileMissing is a file in the source which is not in the target.
+	FileMissing DifferenceType = "missing"
+	// FileExtra is a file in the target which is not in the source.
+	FileExtra DifferenceType = "extra"
+	// FileDiffers is a file whose content differs.
+	FileDiffers DifferenceType = "differs"
+	// FileUnverified is a file whose content could not be compared
+	// without downloading it.
+	FileUnverified DifferenceType = "unverified"
+)
+
+// A Difference is a file which does not match between source and target.
+type Difference struct {
+	Key  string
+	Type DifferenceType
+}
+
+// A Comparison is the result of comparing the source and target of a pair.
+type Comparison struct {
+	Matched     int
+	Differences []Difference
+}
+
+// Match reports whether the source and target match.
+func (c *Comparison) Match() bool {
+	return len(c.Differences) == 0
+}
+
+// compareEntry is a file listed on one side of a comparison, either a
+// local file at path or an object in bucket.
+type compareEntry struct {
+	checksum string
+	size     int64
+	path     string
+	bucket   *s3.Bucket
+	key      s3.Key
+}
+
+// Compare lists the source and target of the pair, as a sync would, and
+// reports the files missing from the target, extra in it or differing,
+// without transferring anything. Objects uploaded in parts whose ETag can
+// not be compared are reported unverified, unless deep is set in which
+// case they are downloaded and hashed.
+func (s *SyncPair) Compare(ctx context.Context, deep bool) (*Comparison, error) {
+	if !s.validPair() {
+		return nil, errors.New("Invalid sync pair.")
+	}
+	if s.multipleSources() {
+		return nil, errors.New("Comparing requires a single source.")
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	atomic.StoreInt32(&s.stop, 0)
+
+	sources, err := s.compareEntries(s.Source)
+	if err != nil {
+		return nil, err
+	}
+	targets, err := s.compareEntries(s.target())
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for file := range sources {
+		files = append(files, file)
+	}
+	for file := range targets {
+		if _, ok := sources[file]; !ok {
+			files = append(files, file)
+		}
+	}
+	sort.Strings(files)
+
+	c := &Comparison{}
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if s.stopped() {
+			return nil, ErrStopped
+		}
+
+		source, inSource := sources[file]
+		target, inTarget := targets[file]
+		var difference DifferenceType
+		switch {
+		case !inTarget:
+			difference = FileMissing
+		case !inSource:
+			difference = FileExtra
+		default:
+			same, known, err := s.sameContent(source, target, deep)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case !known:
+				difference = FileUnverified
+			case !same:
+				difference = FileDiffers
+			default:
+				c.Matched++
+				continue
+			}
+		}
+
+		c.Differences = append(c.Differences, Difference{Key: file, Type: difference})
+		s.emit(Event{
+			Type:       FileMismatch,
+			Key:        file,
+			Source:     compareLocation(s.Source, file),
+			Target:     compareLocation(s.target(), file),
+			Difference: difference,
+		})
+	}
+
+	log.Infof("Compared '%d' files, '%d' matched and '%d' differ.", len(files), c.Matched, len(c.Differences))
+	return c, nil
+}
+
+// compareEntries lists the files at location which are not excluded, by
+// their path within the location.
+func (s *SyncPair) compareEntries(location string) (map[string]*compareEntry, error) {
+	entries := map[string]*compareEntry{}
+
+	if !validS3Url(location) {
+		files, err := loadLocalChecksums(location, s.checksum(), s.walkOptions())
+		if err != nil {
+			return nil, err
+		}
+		for file, sum := range files {
+			if s.excluded(file) {
+				continue
+			}
+			path := strings.Join([]string{location, file}, "/")
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			entries[file] = &compareEntry{checksum: sum, size: info.Size(), path: path}
+		}
+		return entries, nil
+	}
+
+	s3url := newS3Url(location)
+	bucket, err := s.bucket(s3url.Bucket())
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadS3Keys(bucket, s3url.Prefix(), make(map[string]s3.Key), "")
+	if err != nil {
+		return nil, err
+	}
+	for name, key := range keys {
+		file, ok := relativeKey(s3url.Prefix(), name)
+		if !ok || s.excluded(file) {
+			continue
+		}
+		entries[file] = &compareEntry{checksum: s3Checksum(key), size: key.Size, bucket: bucket, key: key}
+	}
+	return entries, nil
+}
+
+// compareLocation returns the location of file below root, a directory
+// or S3 prefix.
+func compareLocation(root, file string) string {
+	if !validS3Url(root) {
+		return filepath.Join(root, file)
+	}
+	s3url := newS3Url(root)
+	return fmt.Sprintf("s3://%s/%s", s3url.Bucket(), s3Key(s3url.Prefix(), file))
+}
+
+// sameContent reports whether source and target have the same content,
+// and whether that could be determined. Local files carry their checksum
+// by the ChecksumAlgorithm and objects their ETag.
+func (s *SyncPair) sameContent(source, target *compareEntry, deep bool) (same, known bool, err error) {
+	if source.size != target.size {
+		return false, true, nil
+	}
+
+	switch {
+	case source.path != "" && target.path != "":
+		return source.checksum == target.checksum, true, nil
+	case source.path == "" && target.path == "":
+		if source.checksum == target.checksum || sameS3Object(target.bucket, source.key, target.key) {
+			return true, true, nil
+		}
+		if plainMD5(source.checksum) && plainMD5(target.checksum) {
+			return false, true, nil
+		}
+	default:
+		local, object := source, target
+		if local.path == "" {
+			local, object = target, source
+		}
+		if same, known := s.sameObject(local, object); known {
+			return same, true, nil
+		}
+	}
+
+	if !deep {
+		return false, false, nil
+	}
+	sourceSum, err := s.deepMD5(source)
+	if err != nil {
+		return false, false, err
+	}
+	targetSum, err := s.deepMD5(target)
+	if err != nil {
+		return false, false, err
+	}
+	return sourceSum == targetSum, true, nil
+}
+
+// sameObject reports whether the local file has the content of object, and
+// whether that could be determined without downloading it. MD5 is
+// compared with the ETag, which a local file can also be compared with
+// when the object was uploaded in parts of a known size, and other
+// checksums with the one stored in the object's metadata.
+func (s *SyncPair) sameObject(local, object *compareEntry) (same, known bool) {
+	algorithm := s.checksum()
+	if algorithm != md5Checksum {
+		stored, err := objectChecksum(object.bucket, object.key.Key, algorithm)
+		if err != nil || stored == "" {
+			return false, false
+		}
+		return stored == local.checksum, true
+	}
+
+	if matchesETag(local.path, local.checksum, object.checksum, s.PartSize) {
+		return true, true
+	}
+	if plainMD5(object.checksum) {
+		return false, true
+	}
+	if sizes, err := etagPartSizes(local.path, object.checksum, s.PartSize); err == nil && len(sizes) > 0 {
+		return false, true
+	}
+	return false, false
+}
+
+// deepMD5 returns the MD5 of the content of entry, hashing local files
+// listed by another checksum and downloading objects whose ETag is not
+// their MD5.
+func (s *SyncPair) deepMD5(entry *compareEntry) (string, error) {
+	if entry.path != "" {
+		if s.checksum() == md5Checksum {
+			return entry.checksum, nil
+		}
+		return md5Checksum.fileSum(entry.path)
+	}
+	if plainMD5(entry.checksum) {
+		return entry.checksum, nil
+	}
+
+	log.Debugf("Downloading '%s' to verify it.", s3Location(entry.bucket, entry.key.Key))
+	body, err := entry.bucket.GetReader(entry.key.Key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// plainMD5 reports whether an ETag is the MD5 of the object, rather than
+// of its parts.
+func plainMD5(etag string) bool {
+	return len(etag) == md5.Size*2 && !strings.Contains(etag, "-")
+}
@@ -0,0 +1,124 @@
+package gosync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestCompare(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testSource(t, map[string]string{"a": "a", "dir/b": "b", "c": "c", "big": "0123456789abcdefghij"})
+	defer os.RemoveAll(source)
+
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/backup", faultyRegion)
+	up.MultipartThreshold = 16
+	up.PartSize = 8
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	comparison, err := up.Compare(context.Background(), false)
+	if err != nil || !comparison.Match() || comparison.Matched != 4 {
+		t.Fatalf("Expected 4 files to match, got '%+v' '%v'.", comparison, err)
+	}
+
+	ioutil.WriteFile(filepath.Join(source, "a"), []byte("changed"), 0644)
+	ioutil.WriteFile(filepath.Join(source, "new"), []byte("new"), 0644)
+	m.put("bucket", "backup/extra", "extra")
+	m.put("bucket", "backup/c", "C")
+
+	// Without its part size, the object uploaded in parts is unverified
+	// unless downloaded.
+	sp := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/backup", faultyRegion)
+	sp.Exclude = []string{"dir"}
+
+	var compareTests = []struct {
+		deep        bool
+		differences []Difference
+	}{
+		{false, []Difference{
+			{"a", FileDiffers}, {"big", FileUnverified}, {"c", FileDiffers},
+			{"extra", FileExtra}, {"new", FileMissing},
+		}},
+		{true, []Difference{
+			{"a", FileDiffers}, {"c", FileDiffers},
+			{"extra", FileExtra}, {"new", FileMissing},
+		}},
+	}
+
+	for _, ct := range compareTests {
+		comparison, err := sp.Compare(context.Background(), ct.deep)
+		if err != nil {
+			t.Fatalf("Error comparing: %s", err)
+		}
+		if !reflect.DeepEqual(comparison.Differences, ct.differences) {
+			t.Errorf("Expected deep '%t' differences '%v', got '%v'.", ct.deep, ct.differences, comparison.Differences)
+		}
+	}
+}
+
+func TestCompareChecksumAlgorithm(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testSource(t, map[string]string{"a": "a", "dir/b": "b"})
+	defer os.RemoveAll(source)
+	linked := testSource(t, map[string]string{"c": "c"})
+	defer os.RemoveAll(linked)
+	if err := os.Symlink(linked, filepath.Join(source, "link")); err != nil {
+		t.Fatalf("Error creating symlink: %s", err)
+	}
+
+	sp := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/backup/", faultyRegion)
+	sp.ChecksumAlgorithm = "sha256"
+	sp.FollowSymlinks = true
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	comparison, err := sp.Compare(context.Background(), false)
+	if err != nil || !comparison.Match() || comparison.Matched != 3 {
+		t.Fatalf("Expected 3 files to match, got '%+v' '%v'.", comparison, err)
+	}
+
+	// The object was not uploaded with a sha256 checksum, so it is only
+	// found to differ when downloaded.
+	m.del("bucket", "backup/a")
+	m.put("bucket", "backup/a", "b")
+	events := []Event{}
+	sp.EventHandlers = []EventHandler{EventHandlerFunc(func(e Event) {
+		if e.Type == FileMismatch {
+			events = append(events, e)
+		}
+	})}
+
+	var compareTests = []struct {
+		deep       bool
+		difference DifferenceType
+	}{
+		{false, FileUnverified},
+		{true, FileDiffers},
+	}
+
+	for _, ct := range compareTests {
+		events = events[:0]
+		comparison, err := sp.Compare(context.Background(), ct.deep)
+		if err != nil {
+			t.Fatalf("Error comparing: %s", err)
+		}
+		expected := []Difference{{"a", ct.difference}}
+		if !reflect.DeepEqual(comparison.Differences, expected) {
+			t.Errorf("Expected deep '%t' differences '%v', got '%v'.", ct.deep, expected, comparison.Differences)
+		}
+		if len(events) != 1 || events[0].Key != "a" || events[0].Difference != ct.difference ||
+			events[0].Source != filepath.Join(source, "a") || events[0].Target != "s3://bucket/backup/a" {
+			t.Errorf("Expected deep '%t' mismatch event for 'a', got '%+v'.", ct.deep, events)
+		}
+	}
+}
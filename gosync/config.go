@@ -0,0 +1,195 @@
+package gosync
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/vaughan0/go-ini"
+)
+
+// The defaults of jobs match those of the command line.
+var jobDefaults = map[string]string{
+	"concurrent":     "20",
+	"min-concurrent": "2",
+}
+
+var envVarRegex = regexp.MustCompile(`\$(\w+)|\$\{(\w+)\}`)
+
+// LoadJobs reads the jobs defined in the INI file at path, returning them
+// sorted by name. Each section defines a job, named after the section,
+// with keys named after the command line options:
+//
+//	source, target           required, or sources in place of source
+//	sources                  several sources or globs, separated by spaces
+//	concurrent, adaptive, min-concurrent
+//	aws-access-key-id, aws-secret-access-key, aws-security-token, aws-region
+//	bwlimit, multipart-threshold, part-size, delta, verify, delete, hard-link, preserve
+//	checksum-algorithm       md5, sha256 or crc32c
+//	follow-symlinks, copy-symlinks-as-objects, dir-markers
+//	unpack, pack
+//	dedup, manifest, publish-manifest
+//	sign-key, verify-key     paths of PEM encoded ed25519 keys
+//	include, exclude         glob patterns separated by spaces
+//	header.NAME              header set on objects uploaded
+//
+// Keys before the first section are defaults for every job. Values may
+// refer to environment variables as $NAME or ${NAME}, which must be set.
+func LoadJobs(path string) ([]*SyncPair, error) {
+	file, err := ini.LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defaults := file[""]
+	jobs := []*SyncPair{}
+	for name, section := range file {
+		if name == "" {
+			continue
+		}
+
+		options := map[string]string{}
+		for _, values := range []map[string]string{jobDefaults, defaults, section} {
+			for key, value := range values {
+				options[key] = value
+			}
+		}
+
+		job, err := newJob(name, options)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("No jobs defined in '%s'.", path)
+	}
+	sort.Sort(jobsByName(jobs))
+	return jobs, nil
+}
+
+func newJob(name string, options map[string]string) (*SyncPair, error) {
+	for key, value := range options {
+		expanded, err := expandEnv(value)
+		if err != nil {
+			return nil, fmt.Errorf("Job '%s': %s", name, err.Error())
+		}
+		options[key] = expanded
+	}
+
+	s := NewSyncPair(aws.Auth{}, options["source"], options["target"], options["aws-region"])
+	s.Name = name
+	if sources := strings.Fields(options["sources"]); len(sources) > 0 {
+		s.Source, s.Sources = sources[0], sources
+	}
+	if s.Source == "" || s.Target == "" {
+		return nil, fmt.Errorf("Job '%s' requires a source and target.", name)
+	}
+
+	for key, value := range options {
+		var err error
+		switch key {
+		case "source", "sources", "target", "aws-region", "aws-access-key-id", "aws-secret-access-key", "aws-security-token":
+		case "concurrent":
+			s.Concurrent, err = strconv.Atoi(value)
+		case "min-concurrent":
+			s.MinConcurrent, err = strconv.Atoi(value)
+		case "adaptive":
+			s.Adaptive, err = strconv.ParseBool(value)
+		case "delta":
+			s.Delta, err = strconv.ParseBool(value)
+		case "verify":
+			s.Verify, err = strconv.ParseBool(value)
+		case "checksum-algorithm":
+			s.ChecksumAlgorithm = value
+			_, err = lookupChecksumAlgorithm(value)
+		case "follow-symlinks":
+			s.FollowSymlinks, err = strconv.ParseBool(value)
+		case "copy-symlinks-as-objects":
+			s.CopySymlinksAsObjects, err = strconv.ParseBool(value)
+		case "dir-markers":
+			s.DirMarkers, err = strconv.ParseBool(value)
+		case "unpack":
+			s.Unpack, err = strconv.ParseBool(value)
+		case "pack":
+			s.Pack, err = strconv.ParseBool(value)
+		case "delete":
+			s.Delete, err = strconv.ParseBool(value)
+		case "hard-link":
+			s.HardLink, err = strconv.ParseBool(value)
+		case "preserve":
+			s.PreserveMetadata, err = strconv.ParseBool(value)
+		case "dedup":
+			s.Dedup, err = strconv.ParseBool(value)
+		case "manifest":
+			s.Manifest = value
+		case "publish-manifest":
+			s.PublishManifest, err = strconv.ParseBool(value)
+		case "sign-key":
+			s.SigningKey, err = loadKey(value, ParsePrivateKey)
+		case "verify-key":
+			s.PublicKey, err = loadKey(value, ParsePublicKey)
+		case "bwlimit":
+			s.BandwidthLimiter, err = NewBandwidthLimiter(value)
+		case "multipart-threshold":
+			s.MultipartThreshold, err = ParseByteSize(value)
+		case "part-size":
+			s.PartSize, err = ParsePartSize(value)
+		case "include":
+			s.Include = strings.Fields(value)
+		case "exclude":
+			s.Exclude = strings.Fields(value)
+		default:
+			if !strings.HasPrefix(key, "header.") {
+				return nil, fmt.Errorf("Job '%s' has unknown option '%s'.", name, key)
+			}
+			if s.Headers == nil {
+				s.Headers = map[string][]string{}
+			}
+			s.Headers[strings.TrimPrefix(key, "header.")] = []string{value}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Job '%s' has invalid %s '%s'.", name, key, value)
+		}
+	}
+
+	if err := s.validFilters(); err != nil {
+		return nil, fmt.Errorf("Job '%s': %s", name, err.Error())
+	}
+
+	auth, err := aws.GetAuth(options["aws-access-key-id"], options["aws-secret-access-key"])
+	if err != nil {
+		return nil, fmt.Errorf("Job '%s': %s", name, err.Error())
+	}
+	if token := options["aws-security-token"]; token != "" {
+		auth.Token = token
+	}
+	s.Auth = auth
+
+	return s, nil
+}
+
+// expandEnv replaces references to environment variables in value.
+func expandEnv(value string) (string, error) {
+	var err error
+	expanded := envVarRegex.ReplaceAllStringFunc(value, func(ref string) string {
+		name := strings.Trim(ref, "${}")
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("Environment variable '%s' is not set.", name)
+		}
+		return v
+	})
+	return expanded, err
+}
+
+type jobsByName []*SyncPair
+
+func (j jobsByName) Len() int           { return len(j) }
+func (j jobsByName) Less(a, b int) bool { return j[a].Name < j[b].Name }
+func (j jobsByName) Swap(a, b int)      { j[a], j[b] = j[b], j[a] }
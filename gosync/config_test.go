@@ -0,0 +1,95 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, config string) string {
+	f, err := ioutil.TempFile("", "gosync.ini")
+	if err != nil {
+		t.Fatalf("Error creating temp file.")
+	}
+	defer f.Close()
+	f.WriteString(config)
+	return f.Name()
+}
+
+func TestLoadJobs(t *testing.T) {
+	os.Setenv("GOSYNC_TEST_SECRET", "secret")
+	defer os.Unsetenv("GOSYNC_TEST_SECRET")
+
+	path := writeConfig(t, `
+; defaults for every job
+aws-access-key-id = key
+aws-secret-access-key = ${GOSYNC_TEST_SECRET}
+exclude = *.tmp
+
+[photos]
+source = /photos
+target = s3://bucket/photos
+concurrent = 5
+delete = true
+include = *.jpg *.png
+header.Cache-Control = public, max-age=86400
+
+[logs]
+sources = s3://bucket/logs/*.gz s3://bucket/old/*.gz
+target = /logs-$GOSYNC_TEST_SECRET
+`)
+	defer os.Remove(path)
+
+	jobs, err := LoadJobs(path)
+	if err != nil {
+		t.Fatalf("Error loading jobs: %s", err)
+	}
+	if len(jobs) != 2 || jobs[0].Name != "logs" || jobs[1].Name != "photos" {
+		t.Fatalf("Expected jobs logs and photos, got '%v'.", jobs)
+	}
+
+	logs, photos := jobs[0], jobs[1]
+	if logs.Target != "/logs-secret" || logs.Concurrent != 20 || logs.Delete {
+		t.Errorf("Unexpected logs job '%+v'.", logs)
+	}
+	if logs.Source != "s3://bucket/logs/*.gz" || !reflect.DeepEqual(logs.Sources, []string{"s3://bucket/logs/*.gz", "s3://bucket/old/*.gz"}) {
+		t.Errorf("Unexpected logs sources '%s' '%v'.", logs.Source, logs.Sources)
+	}
+	if photos.Auth.AccessKey != "key" || photos.Auth.SecretKey != "secret" {
+		t.Errorf("Unexpected photos credentials '%+v'.", photos.Auth)
+	}
+	if photos.Concurrent != 5 || !photos.Delete {
+		t.Errorf("Unexpected photos job '%+v'.", photos)
+	}
+	if !reflect.DeepEqual(photos.Include, []string{"*.jpg", "*.png"}) || !reflect.DeepEqual(photos.Exclude, []string{"*.tmp"}) {
+		t.Errorf("Unexpected photos filters '%v' '%v'.", photos.Include, photos.Exclude)
+	}
+	if photos.Headers["Cache-Control"][0] != "public, max-age=86400" {
+		t.Errorf("Unexpected photos headers '%v'.", photos.Headers)
+	}
+}
+
+func TestLoadJobsErrors(t *testing.T) {
+	var loadJobsErrorTests = []struct {
+		config string
+		err    string
+	}{
+		{"[a]\nsource = /a\n", "requires a source and target"},
+		{"[a]\nsource = /a\ntarget = s3://b\nconcurent = 2\n", "unknown option 'concurent'"},
+		{"[a]\nsource = /a\ntarget = s3://b\nconcurrent = many\n", "invalid concurrent 'many'"},
+		{"[a]\nsource = /a\ntarget = s3://b\npart-size = 0\n", "invalid part-size '0'"},
+		{"[a]\nsource = $GOSYNC_TEST_UNSET\ntarget = s3://b\n", "'GOSYNC_TEST_UNSET' is not set"},
+		{"source = /a\n", "No jobs defined"},
+	}
+
+	for _, tc := range loadJobsErrorTests {
+		path := writeConfig(t, tc.config)
+		_, err := LoadJobs(path)
+		os.Remove(path)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Expected error containing '%s', got '%v'.", tc.err, err)
+		}
+	}
+}
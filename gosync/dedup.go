@@ -0,0 +1,340 @@
+package gosync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+const dedupManifestVersion = 1
+
+// dedupManifest maps the paths of a deduplicated tree to the SHA-256 of
+// their content, which is stored once in the object store.
+type dedupManifest struct {
+	Version int         `json:"version"`
+	Name    string      `json:"name"`
+	Source  string      `json:"source"`
+	Time    time.Time   `json:"time"`
+	Files   []dedupFile `json:"files"`
+}
+
+type dedupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// syncDedup syncs with a deduplicated store at the S3 location. Each file
+// content is stored once below objects/, keyed by its SHA-256, and the
+// tree synced is recorded in the manifest manifests/Manifest.json.
+func (s *SyncPair) syncDedup(ctx context.Context) error {
+	if s.Manifest == "" {
+		return errors.New("Deduplicated syncs require a manifest name.")
+	}
+	if strings.Contains(s.Manifest, "/") {
+		return fmt.Errorf("Invalid manifest name '%s'.", s.Manifest)
+	}
+	if s.CopySymlinksAsObjects {
+		return errors.New("Symlinks can not be copied as objects to a deduplicated store.")
+	}
+
+	switch {
+	case validS3Url(s.Target) && !validS3Url(s.Source):
+		return s.syncDirToDedup(ctx)
+	case validS3Url(s.Source) && !validS3Url(s.Target):
+		return s.syncDedupToDir(ctx)
+	}
+	return errors.New("Deduplicated syncs require a local directory and an S3 location.")
+}
+
+func (s *SyncPair) syncDirToDedup(ctx context.Context) error {
+	log.Infof("Syncing to deduplicated store.")
+
+	s3url := newS3Url(s.Target)
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+	base := s3url.Key()
+
+	s.emit(Event{Type: ListStarted, Source: s.Source})
+	files, err := s.loadDedupFiles(s.Source)
+	if err != nil {
+		return err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.Source, Files: len(files)})
+
+	items, err := s.plan(func() ([]*syncItem, error) {
+		s.emit(Event{Type: ListStarted, Source: s.Target})
+		objects, err := loadS3Keys(bucket, dedupKey(base, "objects", ""), make(map[string]s3.Key), "")
+		if err != nil {
+			return nil, err
+		}
+		s.emit(Event{Type: ListFinished, Source: s.Target, Files: len(objects)})
+
+		// Content already stored, or shared by files earlier in the
+		// listing, is only uploaded once.
+		items := []*syncItem{}
+		for _, f := range files {
+			key := dedupObjectKey(base, f.SHA256)
+			if _, ok := objects[key]; ok {
+				continue
+			}
+			objects[key] = s3.Key{}
+
+			filePath := strings.Join([]string{s.Source, f.Path}, "/")
+			items = append(items, &syncItem{
+				Key:        f.Path,
+				Source:     filePath,
+				Target:     s3Location(bucket, key),
+				SourcePath: filePath,
+				TargetPath: key,
+				Size:       f.Size,
+				Checksum:   f.SHA256,
+			})
+		}
+		return items, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.transfer(ctx, items, func(ctx context.Context, item *syncItem) (int64, error) {
+		return s.writeLocalFileToS3(ctx, bucket, item)
+	})
+	if err != nil {
+		return err
+	}
+
+	manifest := &dedupManifest{
+		Version: dedupManifestVersion,
+		Name:    s.Manifest,
+		Source:  s.Source,
+		Time:    time.Now().UTC(),
+		Files:   files,
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	headers := map[string][]string{"Content-Type": {"application/json"}}
+	if err := bucket.PutHeader(dedupManifestKey(base, s.Manifest), data, headers, s3.Private); err != nil {
+		return err
+	}
+	log.Infof("Wrote manifest '%s' of '%d' files.", s.Manifest, len(files))
+	return nil
+}
+
+func (s *SyncPair) syncDedupToDir(ctx context.Context) error {
+	log.Infof("Syncing from deduplicated store.")
+
+	s3url := newS3Url(s.Source)
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+	base := s3url.Key()
+
+	items, err := s.plan(func() ([]*syncItem, error) {
+		manifest, err := loadDedupManifest(bucket, base, s.Manifest)
+		if err != nil {
+			return nil, err
+		}
+
+		s.emit(Event{Type: ListStarted, Source: s.Target})
+		local := []dedupFile{}
+		if pathExists(s.Target) {
+			if local, err = s.loadDedupFiles(s.Target); err != nil {
+				return nil, err
+			}
+		}
+		s.emit(Event{Type: ListFinished, Source: s.Target, Files: len(local)})
+
+		existing := map[string]string{}
+		for _, f := range local {
+			existing[f.Path] = f.SHA256
+		}
+
+		items := []*syncItem{}
+		inManifest := map[string]bool{}
+		for _, f := range manifest.Files {
+			inManifest[f.Path] = true
+			if s.excluded(f.Path) || existing[f.Path] == f.SHA256 {
+				continue
+			}
+			key := dedupObjectKey(base, f.SHA256)
+			filePath := strings.Join([]string{s.Target, f.Path}, "/")
+			items = append(items, &syncItem{
+				Key:        f.Path,
+				Source:     s3Location(bucket, key),
+				Target:     filePath,
+				SourcePath: key,
+				TargetPath: filePath,
+				Size:       f.Size,
+				Checksum:   f.SHA256,
+			})
+		}
+		if s.Delete {
+			for file := range existing {
+				if !inManifest[file] {
+					items = append(items, localDeletionItem(s.Target, file))
+				}
+			}
+		}
+		return items, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.transferToDir(ctx, bucket, items)
+}
+
+// CollectGarbage deletes the objects of the deduplicated store at the S3
+// location of the pair which no manifest refers to. Objects modified
+// within minAge are kept, as they may belong to a sync which has not yet
+// written its manifest.
+func (s *SyncPair) CollectGarbage(ctx context.Context, minAge time.Duration) error {
+	location := s.Target
+	if validS3Url(s.Source) {
+		location = s.Source
+	}
+	if !validS3Url(location) {
+		return errors.New("Collecting garbage requires an S3 location.")
+	}
+	atomic.StoreInt32(&s.stop, 0)
+
+	return s.run(ctx, func(ctx context.Context) error {
+		s3url := newS3Url(location)
+		bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+		if err != nil {
+			return err
+		}
+		base := s3url.Key()
+
+		manifests, err := loadS3Keys(bucket, dedupKey(base, "manifests", ""), make(map[string]s3.Key), "")
+		if err != nil {
+			return err
+		}
+		referenced := map[string]bool{}
+		for key := range manifests {
+			name := strings.TrimSuffix(strings.TrimPrefix(key, dedupKey(base, "manifests", "")), ".json")
+			manifest, err := loadDedupManifest(bucket, base, name)
+			if err != nil {
+				return err
+			}
+			for _, f := range manifest.Files {
+				referenced[dedupObjectKey(base, f.SHA256)] = true
+			}
+		}
+		log.Infof("Loaded '%d' manifests referring to '%d' objects.", len(manifests), len(referenced))
+
+		objects, err := loadS3Keys(bucket, dedupKey(base, "objects", ""), make(map[string]s3.Key), "")
+		if err != nil {
+			return err
+		}
+		items := []*syncItem{}
+		for key, obj := range objects {
+			if referenced[key] {
+				continue
+			}
+			modified, err := time.Parse(time.RFC3339, obj.LastModified)
+			if err != nil || time.Since(modified) < minAge {
+				continue
+			}
+			items = append(items, deletionItem(key, s3Location(bucket, key), key))
+		}
+		sort.Sort(itemsByKey(items))
+
+		return s.delete(ctx, items, func(items []*syncItem) error {
+			return deleteS3Keys(bucket, items)
+		})
+	})
+}
+
+// loadDedupFiles returns the files below dir which are not excluded, as
+// listed by a sync, with the SHA-256 of their content sorted by path. The
+// store is keyed by SHA-256 whatever the ChecksumAlgorithm.
+func (s *SyncPair) loadDedupFiles(dir string) ([]dedupFile, error) {
+	files := []dedupFile{}
+	root := filepath.ToSlash(dir)
+	err := walkLocal(dir, s.walkOptions(), func(path string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file := relativePath(root, filepath.ToSlash(path))
+		if s.excluded(file) {
+			return nil
+		}
+
+		sum, err := sha256Checksum.fileSum(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, dedupFile{Path: file, Size: info.Size(), SHA256: sum})
+		return nil
+	})
+	sort.Sort(dedupFiles(files))
+	return files, err
+}
+
+func loadDedupManifest(bucket *s3.Bucket, base, name string) (*dedupManifest, error) {
+	data, err := bucket.Get(dedupManifestKey(base, name))
+	if err != nil {
+		if e, ok := err.(*s3.Error); ok && e.StatusCode == 404 {
+			return nil, fmt.Errorf("Manifest '%s' not found.", name)
+		}
+		return nil, err
+	}
+
+	manifest := &dedupManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest '%s': %s", name, err.Error())
+	}
+	if manifest.Version != dedupManifestVersion {
+		return nil, fmt.Errorf("Unsupported version '%d' of manifest '%s'.", manifest.Version, name)
+	}
+	return manifest, nil
+}
+
+// dedupKey returns the key of name in the dir of the store below base, or
+// the prefix of the dir without a name.
+func dedupKey(base, dir, name string) string {
+	prefix := strings.Trim(base, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix + dir + "/" + name
+}
+
+// dedupObjectKey returns the key of the content with the given SHA-256,
+// objects/ab/cdef... below base.
+func dedupObjectKey(base, sum string) string {
+	return dedupKey(base, "objects", sum[:2]+"/"+sum[2:])
+}
+
+func dedupManifestKey(base, name string) string {
+	return dedupKey(base, "manifests", name+".json")
+}
+
+type dedupFiles []dedupFile
+
+func (f dedupFiles) Len() int           { return len(f) }
+func (f dedupFiles) Less(a, b int) bool { return f[a].Path < f[b].Path }
+func (f dedupFiles) Swap(a, b int)      { f[a], f[b] = f[b], f[a] }
+
+type itemsByKey []*syncItem
+
+func (i itemsByKey) Len() int           { return len(i) }
+func (i itemsByKey) Less(a, b int) bool { return i[a].Key < i[b].Key }
+func (i itemsByKey) Swap(a, b int)      { i[a], i[b] = i[b], i[a] }
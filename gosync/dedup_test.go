@@ -0,0 +1,194 @@
+package gosync
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestDedupKeys(t *testing.T) {
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte("a")))
+
+	var keyTests = []struct {
+		base     string
+		key      string
+		manifest string
+	}{
+		{"", "objects/ca/" + sum[2:], "manifests/daily.json"},
+		{"store", "store/objects/ca/" + sum[2:], "store/manifests/daily.json"},
+		{"/store/", "store/objects/ca/" + sum[2:], "store/manifests/daily.json"},
+	}
+
+	for _, kt := range keyTests {
+		if key := dedupObjectKey(kt.base, sum); key != kt.key {
+			t.Errorf("Expected object key '%s' for base '%s', got '%s'.", kt.key, kt.base, key)
+		}
+		if key := dedupManifestKey(kt.base, "daily"); key != kt.manifest {
+			t.Errorf("Expected manifest key '%s' for base '%s', got '%s'.", kt.manifest, kt.base, key)
+		}
+	}
+}
+
+func TestSyncDedup(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+
+	files := map[string]string{"a": "same", "dir/b": "same", "c": "other"}
+	source := testSource(t, files)
+	defer os.RemoveAll(source)
+
+	up := NewSyncPair(aws.Auth{}, source, "s3://bucket/store", faultyRegion)
+	up.Dedup = true
+	up.Manifest = "first"
+	finished := syncFinished(up)
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing to store: %s", err)
+	}
+
+	// Content shared by two files is stored once, plus the manifest.
+	if finished.Files != 2 || f.count("Put") != 3 {
+		t.Fatalf("Expected 2 objects and a manifest put, got '%+v' '%v'.", finished, f.calls)
+	}
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte("same")))
+	if data, ok := m.get("bucket", dedupObjectKey("store", sum)); !ok || data != "same" {
+		t.Fatalf("Expected object for '%s', got '%s'.", sum, data)
+	}
+
+	// A second manifest of the same content uploads nothing new.
+	up.Manifest = "second"
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing to store: %s", err)
+	}
+	if finished.Files != 0 {
+		t.Fatalf("Expected no objects uploaded, got '%+v'.", finished)
+	}
+
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+	ioutil.WriteFile(target+"/stale", []byte("stale"), 0644)
+
+	down := NewSyncPair(aws.Auth{}, "s3://bucket/store", target, faultyRegion)
+	down.Dedup = true
+	down.Manifest = "first"
+	down.Delete = true
+	finished = syncFinished(down)
+	if err := down.Sync(); err != nil {
+		t.Fatalf("Error syncing from store: %s", err)
+	}
+	checkLocalFiles(t, target, files)
+	if finished.Files != 3 || finished.Deleted != 1 {
+		t.Fatalf("Expected 3 files restored and 1 deleted, got '%+v'.", finished)
+	}
+
+	if err := down.Sync(); err != nil {
+		t.Fatalf("Error syncing from store: %s", err)
+	}
+	if finished.Files != 0 {
+		t.Fatalf("Expected nothing restored again, got '%+v'.", finished)
+	}
+
+	down.Manifest = "missing"
+	if err := down.Sync(); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("Expected missing manifest error, got '%v'.", err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testSource(t, map[string]string{"a": "kept", "b": "dropped"})
+	defer os.RemoveAll(source)
+
+	sp := NewSyncPair(aws.Auth{}, source, "s3://bucket", faultyRegion)
+	sp.Dedup = true
+	sp.Manifest = "daily"
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing to store: %s", err)
+	}
+
+	os.Remove(source + "/b")
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing to store: %s", err)
+	}
+
+	kept := dedupObjectKey("", fmt.Sprintf("%x", sha256.Sum256([]byte("kept"))))
+	dropped := dedupObjectKey("", fmt.Sprintf("%x", sha256.Sum256([]byte("dropped"))))
+
+	// Recent objects are left for syncs which may still be in progress.
+	if err := sp.CollectGarbage(context.Background(), time.Hour); err != nil {
+		t.Fatalf("Error collecting garbage: %s", err)
+	}
+	if _, ok := m.get("bucket", dropped); !ok {
+		t.Fatalf("Expected recent object to be kept.")
+	}
+
+	finished := syncFinished(sp)
+	if err := sp.CollectGarbage(context.Background(), 0); err != nil {
+		t.Fatalf("Error collecting garbage: %s", err)
+	}
+	if finished.Deleted != 1 {
+		t.Fatalf("Expected 1 object deleted, got '%+v'.", finished)
+	}
+	if _, ok := m.get("bucket", dropped); ok {
+		t.Fatalf("Expected unreferenced object to be deleted.")
+	}
+	if _, ok := m.get("bucket", kept); !ok {
+		t.Fatalf("Expected referenced object to be kept.")
+	}
+}
+
+func TestSyncDedupSymlinks(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testSource(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(source)
+	linked := testSource(t, map[string]string{"b": "b"})
+	defer os.RemoveAll(linked)
+	if err := os.Symlink(linked, filepath.Join(source, "link")); err != nil {
+		t.Fatalf("Error creating symlink: %s", err)
+	}
+
+	// Symlinked directories are skipped unless followed, as in a sync.
+	var symlinkTests = []struct {
+		follow bool
+		files  int
+	}{
+		{false, 1},
+		{true, 2},
+	}
+
+	for _, st := range symlinkTests {
+		up := NewSyncPair(aws.Auth{}, source, "s3://bucket/store", faultyRegion)
+		up.Dedup = true
+		up.Manifest = "links"
+		up.FollowSymlinks = st.follow
+		if err := up.Sync(); err != nil {
+			t.Fatalf("Error syncing to store: %s", err)
+		}
+		data, _ := m.get("bucket", dedupManifestKey("store", "links"))
+		manifest := &dedupManifest{}
+		json.Unmarshal([]byte(data), manifest)
+		if len(manifest.Files) != st.files {
+			t.Errorf("Expected follow '%t' to store '%d' files, got '%+v'.", st.follow, st.files, manifest.Files)
+		}
+	}
+
+	up := NewSyncPair(aws.Auth{}, source, "s3://bucket/store", faultyRegion)
+	up.Dedup = true
+	up.Manifest = "links"
+	up.CopySymlinksAsObjects = true
+	if err := up.Sync(); err == nil {
+		t.Fatalf("Expected error copying symlinks as objects to the store.")
+	}
+}
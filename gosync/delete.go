@@ -0,0 +1,82 @@
+package gosync
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// S3 deletes at most this many keys per request.
+const maxDeleteKeys = 1000
+
+// A deleter deletes a batch of items from the target.
+type deleter func(items []*syncItem) error
+
+// delete deletes items in batches of up to maxDeleteKeys, stopping when
+// ctx is done or the sync is stopped.
+func (s *SyncPair) delete(ctx context.Context, items []*syncItem, del deleter) error {
+	for start := 0; start < len(items); start += maxDeleteKeys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if s.stopped() {
+			return ErrStopped
+		}
+
+		end := start + maxDeleteKeys
+		if end > len(items) {
+			end = len(items)
+		}
+		batch := items[start:end]
+
+		if err := del(batch); err != nil {
+			return err
+		}
+
+		for _, item := range batch {
+			log.Infof("Deleted %s.", item.Target)
+			s.stats.mu.Lock()
+			s.stats.deleted++
+			s.stats.mu.Unlock()
+			if err := s.journal.complete(item); err != nil {
+				log.Warnf("Error recording '%s' in journal: %s", item.Key, err.Error())
+			}
+			s.emit(Event{Type: FileDeleted, Key: item.Key, Target: item.Target})
+		}
+	}
+	return nil
+}
+
+func deleteS3Keys(bucket *s3.Bucket, items []*syncItem) error {
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, item.TargetPath)
+	}
+	return bucket.MultiDel(keys)
+}
+
+func deleteLocalFiles(items []*syncItem) error {
+	for _, item := range items {
+		if err := os.Remove(item.TargetPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deletionItem plans the deletion of key, at targetPath, from target.
+func deletionItem(key, target, targetPath string) *syncItem {
+	return &syncItem{
+		Key:        key,
+		Target:     target,
+		TargetPath: targetPath,
+		Delete:     true,
+	}
+}
+
+func s3Location(bucket *s3.Bucket, key string) string {
+	return fmt.Sprintf("s3://%s/%s", bucket.Name, key)
+}
@@ -0,0 +1,101 @@
+package gosync
+
+import (
+	"encoding/json"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// Part manifests are kept below this prefix of the bucket, outside the
+// keys synced, and are left out of listings by internalKey.
+const partManifestPrefix = ".gosync-parts/"
+
+const partManifestVersion = 1
+
+// partManifest records the MD5 of each part of an object uploaded in parts,
+// so that a delta upload can copy the parts which are unchanged.
+type partManifest struct {
+	Version  int      `json:"version"`
+	Size     int64    `json:"size"`
+	PartSize int64    `json:"part_size"`
+	ETag     string   `json:"etag"`
+	Parts    []string `json:"parts"`
+}
+
+func partManifestKey(key string) string {
+	return partManifestPrefix + strings.TrimLeft(key, "/") + ".json"
+}
+
+// loadPartManifest returns the part manifest of the object at item's
+// target, or nil when it has none or the object has changed since it was
+// recorded.
+func (s *SyncPair) loadPartManifest(bucket *s3.Bucket, item *syncItem) *partManifest {
+	data, err := bucket.Get(partManifestKey(item.TargetPath))
+	if err != nil {
+		log.Debugf("No part manifest for '%s': %s", item.Target, err.Error())
+		return nil
+	}
+	manifest := &partManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil || manifest.Version != partManifestVersion {
+		log.Warnf("Ignoring invalid part manifest for '%s'.", item.Target)
+		return nil
+	}
+	if manifest.PartSize != s.PartSize {
+		log.Infof("Part size of '%s' has changed, uploading every part.", item.Target)
+		return nil
+	}
+
+	resp, err := bucket.Head(item.TargetPath)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	if strings.Trim(resp.Header.Get("ETag"), "\"") != manifest.ETag {
+		log.Infof("Part manifest of '%s' is out of date, uploading every part.", item.Target)
+		return nil
+	}
+	return manifest
+}
+
+// unchangedPart reports whether part n, of length bytes, has the same
+// content sum as in the object the manifest records.
+func (m *partManifest) unchangedPart(n int, length int64, sum string) bool {
+	if m == nil || length == 0 || n > len(m.Parts) || m.Parts[n-1] != sum {
+		return false
+	}
+	recorded := m.Size - int64(n-1)*m.PartSize
+	if recorded > m.PartSize {
+		recorded = m.PartSize
+	}
+	return length == recorded
+}
+
+// writePartManifest records the parts of the object uploaded for item.
+func (s *SyncPair) writePartManifest(bucket *s3.Bucket, item *syncItem, size int64, parts []s3.Part) error {
+	etag, err := partsETag(parts)
+	if err != nil {
+		return err
+	}
+	manifest := &partManifest{Version: partManifestVersion, Size: size, PartSize: s.PartSize, ETag: etag}
+	for _, part := range parts {
+		manifest.Parts = append(manifest.Parts, strings.Trim(part.ETag, "\""))
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	headers := map[string][]string{"Content-Type": {"application/json"}}
+	return bucket.PutHeader(partManifestKey(item.TargetPath), data, headers, s3.Private)
+}
+
+// deletePartManifests deletes the part manifests of the items deleted.
+func deletePartManifests(bucket *s3.Bucket, items []*syncItem) error {
+	keys := []string{}
+	for _, item := range items {
+		keys = append(keys, partManifestKey(item.TargetPath))
+	}
+	return bucket.MultiDel(keys)
+}
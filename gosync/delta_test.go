@@ -0,0 +1,97 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestPartManifestUnchangedPart(t *testing.T) {
+	manifest := &partManifest{Size: 20, PartSize: 8, Parts: []string{"a", "b", "c"}}
+
+	var partTests = []struct {
+		n       int
+		length  int64
+		sum     string
+		matches bool
+	}{
+		{1, 8, "a", true},
+		{1, 8, "b", false},
+		{2, 8, "b", true},
+		{3, 4, "c", true},
+		{3, 8, "c", false},
+		{4, 8, "d", false},
+		{1, 0, "a", false},
+	}
+
+	for _, pt := range partTests {
+		if matches := manifest.unchangedPart(pt.n, pt.length, pt.sum); matches != pt.matches {
+			t.Errorf("Expected part '%d' of '%d' bytes with sum '%s' unchanged '%t', got '%t'.", pt.n, pt.length, pt.sum, pt.matches, matches)
+		}
+	}
+}
+
+func TestSyncDelta(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testSource(t, map[string]string{"disk.img": "aaaaaaaabbbbbbbbccccccccdddd"})
+	defer os.RemoveAll(source)
+
+	sp := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/images", faultyRegion)
+	sp.MultipartThreshold = 16
+	sp.PartSize = 8
+	sp.Delta = true
+	sp.Delete = true
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if f.count("PutPart") != 4 || f.count("PutPartCopy") != 0 {
+		t.Fatalf("Expected 4 parts put, got '%v'.", f.calls)
+	}
+	if _, ok := m.get("bucket", partManifestKey("images/disk.img")); !ok {
+		t.Fatalf("Expected part manifest to be written.")
+	}
+
+	// Only the changed part, and the last which grew, are sent.
+	changed := "aaaaaaaaBBBBBBBBccccccccdddddd"
+	ioutil.WriteFile(filepath.Join(source, "disk.img"), []byte(changed), 0644)
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if f.count("PutPart") != 6 || f.count("PutPartCopy") != 2 {
+		t.Fatalf("Expected 2 parts put and 2 copied, got '%v'.", f.calls)
+	}
+	if data, _ := m.get("bucket", "images/disk.img"); data != changed {
+		t.Fatalf("Expected '%s', got '%s'.", changed, data)
+	}
+
+	// The part manifest is neither synced nor deleted as an extra key.
+	finished := syncFinished(sp)
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if finished.Files != 0 || finished.Deleted != 0 {
+		t.Fatalf("Expected nothing synced, got '%+v'.", finished)
+	}
+
+	// An object changed by another tool is uploaded in full.
+	m.put("bucket", "images/disk.img", "other")
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if f.count("PutPart") != 10 || f.count("PutPartCopy") != 2 {
+		t.Fatalf("Expected every part put, got '%v'.", f.calls)
+	}
+
+	os.Remove(filepath.Join(source, "disk.img"))
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if keys := m.keys("bucket"); len(keys) != 0 {
+		t.Fatalf("Expected object and part manifest deleted, got '%v'.", keys)
+	}
+}
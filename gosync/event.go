@@ -0,0 +1,101 @@
+package gosync
+
+import "time"
+
+// EventType identifies what an Event reports.
+type EventType string
+
+const (
+	ListStarted      EventType = "list_started"
+	ListFinished     EventType = "list_finished"
+	TransferPlanned  EventType = "transfer_planned"
+	TransferStarted  EventType = "transfer_started"
+	TransferProgress EventType = "transfer_progress"
+	TransferFinished EventType = "transfer_finished"
+	TransferFailed   EventType = "transfer_failed"
+	FileDeleted      EventType = "file_deleted"
+	Conflict         EventType = "conflict"
+	VerifyFailed     EventType = "verify_failed"
+	SyncFinished     EventType = "sync_finished"
+	PollFinished     EventType = "poll_finished"
+	FileMismatch     EventType = "file_mismatch"
+)
+
+// An Event reports the progress of a sync. Job is the Name of the sync and
+// which other fields are set depends on the Type:
+//
+// ListStarted and ListFinished set Source to the location being listed,
+// and ListFinished sets Files to the number of files found.
+//
+// Transfer events set Key, Source, Target, Size and Checksum of the file.
+// TransferProgress sets Bytes to the bytes transferred since the previous
+// progress event, which is negative when a failed attempt is discarded.
+// TransferFinished and TransferFailed set Duration, and TransferFailed
+// sets Err.
+//
+// FileDeleted sets Key and Target to the file deleted from the target.
+//
+// VerifyFailed reports a transfer whose content did not match its source
+// checksum, which is retried. It sets the fields of a transfer event and
+// Err.
+//
+// Conflict reports a file changed on both sides of a two way sync. It sets
+// Key, Source and Target to the file and Resolution to the side kept,
+// "source", "target" or "both".
+//
+// SyncFinished sets Files, Bytes, Failed, Deleted, Conflicts and
+// VerifyFailures to the totals transferred, failed, deleted, in conflict
+// and failing verification, Duration to the time the sync took and Err to
+// its result.
+//
+// PollFinished ends each cycle polling an S3 source for changes, whether
+// or not any were found. It sets Source to the location polled and the
+// other fields as SyncFinished does for the changes synced.
+//
+// FileMismatch reports a file which does not match when comparing source
+// and target. It sets Key, Source and Target to the file and Difference
+// to how it differs.
+type Event struct {
+	Type           EventType
+	Time           time.Time
+	Job            string
+	Key            string
+	Source         string
+	Target         string
+	Size           int64
+	Checksum       string
+	Bytes          int64
+	Files          int
+	Failed         int
+	Deleted        int
+	Conflicts      int
+	VerifyFailures int
+	Resolution     string
+	Difference     DifferenceType
+	Duration       time.Duration
+	Err            error
+}
+
+// An EventHandler receives the events of a sync. Events are delivered
+// from the transfer routines, so handlers must be safe for concurrent use
+// and should return quickly.
+type EventHandler interface {
+	HandleEvent(e Event)
+}
+
+// EventHandlerFunc adapts a function to an EventHandler.
+type EventHandlerFunc func(e Event)
+
+func (f EventHandlerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+func (s *SyncPair) emit(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Job = s.Name
+	for _, h := range s.EventHandlers {
+		h.HandleEvent(e)
+	}
+}
@@ -0,0 +1,543 @@
+package gosync
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// The region tests reach the s3test server through the fault injector.
+const faultyRegion = "faulty"
+
+// A fault is injected into the calls of an S3 operation, as named by
+// s3Operation. It delays the call by latency, then either fails it with
+// status and code or, when truncate is positive, closes the connection
+// after that many bytes of the response body. When corrupt is set a byte
+// of the request body, or of the response body and ETag, is changed.
+type fault struct {
+	op       string
+	call     int // the call to fault counting from 1, or 0 for every call
+	latency  time.Duration
+	status   int
+	code     string
+	truncate int
+	corrupt  bool
+}
+
+// corruptOn corrupts the nth call of op.
+func corruptOn(op string, n int) *fault {
+	return &fault{op: op, call: n, corrupt: true}
+}
+
+// failOn fails the nth call of op, or every call when n is 0.
+func failOn(op string, n int, status int, code string) *fault {
+	return &fault{op: op, call: n, status: status, code: code}
+}
+
+// throttleOn throttles the nth call of op as S3 does when asked to slow
+// down.
+func throttleOn(op string, n int) *fault {
+	return failOn(op, n, 503, "SlowDown")
+}
+
+// testS3 starts an s3test server with the given buckets, served behind a
+// fault injector as the faulty region. The returned function stops it.
+func testS3(t *testing.T, buckets ...string) (*testBuckets, *faultyS3, func()) {
+	stopS3Test := startS3Test(t, buckets...)
+	region := aws.Regions[s3testRegion]
+	endpoint, _ := url.Parse(region.S3Endpoint)
+
+	f := newFaultyS3(httputil.NewSingleHostReverseProxy(endpoint))
+	srv := httptest.NewServer(f)
+	restoreRegion := setRegion(aws.Region{Name: faultyRegion, S3Endpoint: srv.URL})
+	return &testBuckets{s3: s3.New(aws.Auth{}, region)}, f, func() {
+		srv.Close()
+		restoreRegion()
+		stopS3Test()
+	}
+}
+
+// testBuckets sets up and inspects the buckets of the s3test server
+// directly, without faults or counting calls.
+type testBuckets struct {
+	s3 *s3.S3
+}
+
+// put stores an object.
+func (b *testBuckets) put(bucket, key, data string) {
+	b.s3.Bucket(bucket).Put(key, []byte(data), "binary/octet-stream", s3.Private)
+}
+
+// get returns the data of an object, reporting whether it exists.
+func (b *testBuckets) get(bucket, key string) (string, bool) {
+	data, err := b.s3.Bucket(bucket).Get(key)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// header returns the headers of an object, or nil when it does not exist.
+func (b *testBuckets) header(bucket, key string) http.Header {
+	resp, err := b.s3.Bucket(bucket).Head(key)
+	if err != nil {
+		return nil
+	}
+	resp.Body.Close()
+	return resp.Header
+}
+
+// del deletes an object.
+func (b *testBuckets) del(bucket, key string) {
+	b.s3.Bucket(bucket).Del(key)
+}
+
+// keys returns the sorted keys of a bucket.
+func (b *testBuckets) keys(bucket string) []string {
+	contents, err := b.s3.Bucket(bucket).GetBucketContents()
+	keys := []string{}
+	if err != nil {
+		return keys
+	}
+	for key := range *contents {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: code})
+}
+
+// s3Operation names the operation a request to S3 performs.
+func s3Operation(r *http.Request) string {
+	q := r.URL.Query()
+	_, uploads := q["uploads"]
+	_, del := q["delete"]
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := len(path) > 1 && path[1] != ""
+
+	switch {
+	case r.Method == "GET" && !key:
+		return "List"
+	case r.Method == "POST" && del:
+		return "MultiDel"
+	case r.Method == "POST" && uploads:
+		return "InitMulti"
+	case r.Method == "PUT" && q.Get("partNumber") != "" && r.Header.Get("x-amz-copy-source") != "":
+		return "PutPartCopy"
+	case r.Method == "PUT" && q.Get("partNumber") != "":
+		return "PutPart"
+	case r.Method == "GET" && q.Get("uploadId") != "":
+		return "ListParts"
+	case r.Method == "POST" && q.Get("uploadId") != "":
+		return "CompleteMulti"
+	case r.Method == "DELETE" && q.Get("uploadId") != "":
+		return "AbortMulti"
+	case r.Method == "PUT" && r.Header.Get("x-amz-copy-source") != "":
+		return "Copy"
+	case r.Method == "PUT" && key:
+		return "Put"
+	case r.Method == "GET":
+		return "Get"
+	case r.Method == "HEAD":
+		return "Head"
+	case r.Method == "DELETE":
+		return "Delete"
+	}
+	return r.Method
+}
+
+// faultyS3 wraps an S3 handler, injecting faults into the calls it
+// serves and counting them.
+type faultyS3 struct {
+	next http.Handler
+
+	mu          sync.Mutex
+	faults      []*fault
+	calls       map[string]int
+	inFlight    int
+	maxInFlight int
+}
+
+func newFaultyS3(next http.Handler) *faultyS3 {
+	return &faultyS3{next: next, calls: map[string]int{}}
+}
+
+// inject adds faults to the calls served from now on.
+func (f *faultyS3) inject(faults ...*fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, faults...)
+}
+
+// count returns the number of calls of op served.
+func (f *faultyS3) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+func (f *faultyS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op := s3Operation(r)
+
+	f.mu.Lock()
+	f.calls[op]++
+	n := f.calls[op]
+	faults := []*fault{}
+	for _, ft := range f.faults {
+		if ft.op == op && (ft.call == 0 || ft.call == n) {
+			faults = append(faults, ft)
+		}
+	}
+	f.inFlight++
+	if f.inFlight > f.maxInFlight {
+		f.maxInFlight = f.inFlight
+	}
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+
+	for _, ft := range faults {
+		time.Sleep(ft.latency)
+		if ft.status != 0 {
+			ioutil.ReadAll(r.Body)
+			writeS3Error(w, ft.status, ft.code)
+			return
+		}
+		if ft.truncate > 0 {
+			w = &truncatedWriter{ResponseWriter: w, remaining: ft.truncate}
+		}
+		if ft.corrupt && r.ContentLength > 0 {
+			body, _ := ioutil.ReadAll(r.Body)
+			body[0] ^= 0xff
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		} else if ft.corrupt {
+			w = &corruptWriter{ResponseWriter: w}
+		}
+	}
+	f.next.ServeHTTP(w, r)
+}
+
+// A corruptWriter changes the ETag and first byte of the response.
+type corruptWriter struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (cw *corruptWriter) WriteHeader(status int) {
+	if etag := cw.Header().Get("ETag"); etag != "" {
+		cw.Header().Set("ETag", "\"corrupt\"")
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *corruptWriter) Write(p []byte) (int, error) {
+	if !cw.written && len(p) > 0 {
+		cw.written = true
+		p = append([]byte{p[0] ^ 0xff}, p[1:]...)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// A truncatedWriter drops the response body after the remaining bytes,
+// so the client sees the connection close early.
+type truncatedWriter struct {
+	http.ResponseWriter
+	remaining int
+}
+
+func (tw *truncatedWriter) Write(p []byte) (int, error) {
+	if len(p) > tw.remaining {
+		p = p[:tw.remaining]
+	}
+	tw.remaining -= len(p)
+	return tw.ResponseWriter.Write(p)
+}
+
+// testSource creates a temporary directory holding files.
+func testSource(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "gosync")
+	if err != nil {
+		t.Fatalf("Error creating temp dir.")
+	}
+	for file, data := range files {
+		path := filepath.Join(dir, file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Error creating temp file.")
+		}
+	}
+	return dir
+}
+
+func syncFinished(sp *SyncPair) *Event {
+	finished := &Event{}
+	sp.EventHandlers = append(sp.EventHandlers, EventHandlerFunc(func(e Event) {
+		if e.Type == SyncFinished {
+			*finished = e
+		}
+	}))
+	return finished
+}
+
+func TestFaultyS3RoundTrip(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testSource(t, map[string]string{"a": "a", "dir/b": "bb", "big": "0123456789"})
+	defer os.RemoveAll(source)
+
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/pre", faultyRegion)
+	up.MultipartThreshold = 8
+	up.PartSize = 4
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing to S3: %s", err)
+	}
+	if f.count("PutPart") != 3 || f.count("CompleteMulti") != 1 {
+		t.Fatalf("Expected big to be uploaded in 3 parts, got '%v'.", f.calls)
+	}
+	if data, _ := m.get("bucket", "pre/big"); data != "0123456789" {
+		t.Fatalf("Unexpected multipart object '%s'.", data)
+	}
+
+	// Nothing differs, including the multipart object.
+	finished := syncFinished(up)
+	if err := up.Sync(); err != nil || finished.Files != 0 {
+		t.Fatalf("Expected nothing to sync, got '%+v'.", finished)
+	}
+
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+	down := NewSyncPair(aws.Auth{}, "s3://bucket/pre", target, faultyRegion)
+	if err := down.Sync(); err != nil {
+		t.Fatalf("Error syncing from S3: %s", err)
+	}
+	files, _ := loadLocalFiles(filepath.Join(target, "pre"))
+	if len(files) != 3 || files["dir/b"] != "21ad0bd836b90d08f4cf640b4c298e7c" {
+		t.Fatalf("Unexpected files '%v'.", files)
+	}
+}
+
+func TestSyncThrottleRetry(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+	f.inject(throttleOn("Put", 1), throttleOn("Put", 2))
+
+	source := testSource(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(source)
+
+	sp := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket", faultyRegion)
+	sp.retryDelay = time.Millisecond
+	finished := syncFinished(sp)
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Expected throttled upload to be retried, got '%s'.", err)
+	}
+	if f.count("Put") != 3 || finished.Files != 1 || finished.Failed != 0 {
+		t.Fatalf("Expected success on the third attempt, got '%d' attempts '%+v'.", f.count("Put"), finished)
+	}
+	if _, ok := m.get("bucket", "a"); !ok {
+		t.Fatalf("Expected object to be uploaded.")
+	}
+}
+
+func TestSyncPartialFailure(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+	f.inject(failOn("Put", 2, 403, "AccessDenied"))
+
+	source := testSource(t, map[string]string{"a": "a", "b": "b", "c": "c"})
+	defer os.RemoveAll(source)
+	journal := source + ".journal"
+	defer os.Remove(journal)
+
+	// With one transfer at a time, the second fails and the third is
+	// never started.
+	sp := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket", faultyRegion)
+	sp.JournalPath = journal
+	finished := syncFinished(sp)
+	if err := sp.Sync(); err == nil {
+		t.Fatalf("Expected sync to fail.")
+	}
+	if finished.Files != 1 || finished.Failed != 1 || len(m.keys("bucket")) != 1 {
+		t.Fatalf("Expected one transfer and one failure, got '%+v' '%v'.", finished, m.keys("bucket"))
+	}
+
+	// Resuming transfers only what remains.
+	sp.Resume = true
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error resuming sync: %s", err)
+	}
+	if finished.Files != 2 || f.count("Put") != 4 {
+		t.Fatalf("Expected the remaining 2 files to transfer, got '%+v'.", finished)
+	}
+	if keys := m.keys("bucket"); !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+		t.Fatalf("Unexpected keys '%v'.", keys)
+	}
+}
+
+func TestSyncMultipartAbort(t *testing.T) {
+	var abortTests = []struct {
+		fault  *fault
+		aborts int
+	}{
+		{throttleOn("PutPart", 2), 0},
+		{failOn("PutPart", 2, 403, "AccessDenied"), 1},
+	}
+
+	for _, at := range abortTests {
+		func() {
+			_, f, stop := testS3(t, "bucket")
+			defer stop()
+			f.inject(at.fault)
+
+			source := testSource(t, map[string]string{"a": "0123456789"})
+			defer os.RemoveAll(source)
+			journal := source + ".journal"
+			defer os.Remove(journal)
+
+			// Uploads which can not be resumed are aborted, even with a
+			// journal.
+			sp := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket", faultyRegion)
+			sp.JournalPath = journal
+			sp.MultipartThreshold = 8
+			sp.PartSize = 4
+			sp.Sync()
+			if f.count("AbortMulti") != at.aborts {
+				t.Errorf("Expected '%d' aborts with '%+v', got '%v'.", at.aborts, at.fault, f.calls)
+			}
+		}()
+	}
+}
+
+func TestSyncTruncatedDownload(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+	m.put("bucket", "a", "0123456789")
+	f.inject(&fault{op: "Get", call: 1, truncate: 4})
+
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	sp := NewSyncPair(aws.Auth{}, "s3://bucket", target, faultyRegion)
+	if err := sp.Sync(); err == nil {
+		t.Fatalf("Expected truncated download to fail.")
+	}
+	if entries, _ := ioutil.ReadDir(target); len(entries) != 0 {
+		t.Fatalf("Expected no partial file, found '%s'.", entries[0].Name())
+	}
+
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(target, "a")); string(data) != "0123456789" {
+		t.Fatalf("Unexpected file '%s'.", data)
+	}
+}
+
+func TestSyncDeletion(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+	m.put("bucket", "pre/a", "a")
+	m.put("bucket", "pre/old", "old")
+	m.put("bucket", "prefix/other", "other")
+	m.put("bucket", "pre/skip.tmp", "skip")
+
+	source := testSource(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(source)
+
+	sp := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/pre", faultyRegion)
+	sp.Delete = true
+	sp.Exclude = []string{"*.tmp"}
+	finished := syncFinished(sp)
+
+	// A failed delete leaves the objects in place.
+	f.inject(failOn("MultiDel", 1, 403, "AccessDenied"))
+	if err := sp.Sync(); err == nil {
+		t.Fatalf("Expected delete to fail.")
+	}
+	if finished.Deleted != 0 || len(m.keys("bucket")) != 4 {
+		t.Fatalf("Expected nothing deleted, got '%+v' '%v'.", finished, m.keys("bucket"))
+	}
+
+	// Only the object without a file within the prefix is deleted.
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	expected := []string{"pre/a", "pre/skip.tmp", "prefix/other"}
+	if keys := m.keys("bucket"); finished.Deleted != 1 || !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected '%v' to remain, got '%v' '%+v'.", expected, keys, finished)
+	}
+}
+
+func TestSyncS3ToS3Deletion(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+	m.put("bucket", "src/a", "a")
+	m.put("bucket", "dst/a", "a")
+	m.put("bucket", "dst/old", "old")
+	m.put("bucket", "dst/skip.tmp", "skip")
+
+	sp := NewSyncPair(aws.Auth{}, "s3://bucket/src/", "s3://bucket/dst", faultyRegion)
+	sp.Delete = true
+	sp.Exclude = []string{"*.tmp"}
+	finished := syncFinished(sp)
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	expected := []string{"dst/a", "dst/skip.tmp", "src/a"}
+	if keys := m.keys("bucket"); finished.Deleted != 1 || !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected '%v' to remain, got '%v' '%+v'.", expected, keys, finished)
+	}
+
+	// Deleting is not supported for a single object.
+	sp = NewSyncPair(aws.Auth{}, "s3://bucket/src/a", "s3://bucket/one", faultyRegion)
+	sp.Delete = true
+	if err := sp.Sync(); err == nil {
+		t.Fatalf("Expected deleting with a single object to fail.")
+	}
+}
+
+func TestSyncConcurrentLatency(t *testing.T) {
+	_, f, stop := testS3(t, "bucket")
+	defer stop()
+	f.inject(&fault{op: "Put", latency: 100 * time.Millisecond})
+
+	source := testSource(t, map[string]string{"a": "a", "b": "b", "c": "c", "d": "d"})
+	defer os.RemoveAll(source)
+
+	sp := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket", faultyRegion)
+	sp.Concurrent = 2
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if f.maxInFlight != 2 {
+		t.Fatalf("Expected 2 uploads in flight at once, got '%d'.", f.maxInFlight)
+	}
+}
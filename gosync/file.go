@@ -2,37 +2,112 @@ package gosync
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	log "github.com/cihub/seelog"
 )
 
+// A checksumAlgorithm hashes file content to find the files which differ.
+// MD5 is compared with the ETags of objects, the others with the checksum
+// stored in the metadata of objects uploaded.
+type checksumAlgorithm struct {
+	name string
+	new  func() hash.Hash
+}
+
+var (
+	md5Checksum    = &checksumAlgorithm{name: "md5", new: md5.New}
+	sha256Checksum = &checksumAlgorithm{name: "sha256", new: sha256.New}
+	crc32cChecksum = &checksumAlgorithm{name: "crc32c", new: func() hash.Hash {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}}
+)
+
+var checksumAlgorithms = []*checksumAlgorithm{md5Checksum, sha256Checksum, crc32cChecksum}
+
+// lookupChecksumAlgorithm returns the algorithm named, MD5 when name is
+// empty.
+func lookupChecksumAlgorithm(name string) (*checksumAlgorithm, error) {
+	if name == "" {
+		return md5Checksum, nil
+	}
+	for _, algorithm := range checksumAlgorithms {
+		if algorithm.name == strings.ToLower(name) {
+			return algorithm, nil
+		}
+	}
+	return nil, fmt.Errorf("Unknown checksum algorithm '%s'.", name)
+}
+
+// checksumAlgorithmOf returns the algorithm of a hex checksum, by its
+// length, or nil when it is not one.
+func checksumAlgorithmOf(checksum string) *checksumAlgorithm {
+	for _, algorithm := range checksumAlgorithms {
+		if len(checksum) == algorithm.new().Size()*2 {
+			return algorithm
+		}
+	}
+	return nil
+}
+
+// header returns the header of the metadata the checksum is stored in.
+func (a *checksumAlgorithm) header() string {
+	return "X-Amz-Meta-Gosync-" + strings.Title(a.name)
+}
+
+// sum returns the hex checksum of the content of r.
+func (a *checksumAlgorithm) sum(r io.Reader) (string, error) {
+	hasher := a.new()
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// fileSum returns the hex checksum of the file at path.
+func (a *checksumAlgorithm) fileSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return a.sum(f)
+}
+
 func loadLocalFiles(path string) (map[string]string, error) {
+	return loadLocalChecksums(path, md5Checksum, walkOptions{})
+}
+
+// loadLocalChecksums returns the checksums by algorithm of the files below
+// path, as listed with opts, by their path relative to it. Symlinks listed
+// themselves and empty directories are left out, see loadLocalLinks.
+func loadLocalChecksums(path string, algorithm *checksumAlgorithm, opts walkOptions) (map[string]string, error) {
 	files := map[string]string{}
 
 	regulatedPath := filepath.ToSlash(path)
-	loadMd5Sums := func(filePath string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
+	loadSums := func(filePath string, info os.FileInfo) error {
+		if info.Mode().IsRegular() {
 			p := relativePath(regulatedPath, filepath.ToSlash(filePath))
 
-			buf, err := ioutil.ReadFile(filePath)
+			sum, err := algorithm.fileSum(filePath)
 			if err != nil {
 				return err
 			}
-
-			hasher := md5.New()
-			hasher.Write(buf)
-			md5sum := fmt.Sprintf("%x", hasher.Sum(nil))
-			files[p] = md5sum
+			files[p] = sum
 		}
 		return nil
 	}
 
-	err := filepath.Walk(path, loadMd5Sums)
+	err := walkLocal(path, opts, loadSums)
 	if err != nil {
 		return files, err
 	}
@@ -43,6 +118,116 @@ func loadLocalFiles(path string) (map[string]string, error) {
 	return files, nil
 }
 
+// loadLocalLinks returns the targets of the symlinks below path, when opts
+// lists symlinks themselves, and the empty directories, when it lists
+// them, by their path relative to it.
+func loadLocalLinks(path string, opts walkOptions) (map[string]string, []string, error) {
+	links := map[string]string{}
+	dirs := []string{}
+
+	regulatedPath := filepath.ToSlash(path)
+	err := walkLocal(path, opts, func(filePath string, info os.FileInfo) error {
+		p := relativePath(regulatedPath, filepath.ToSlash(filePath))
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, p)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			links[p] = target
+		}
+		return nil
+	})
+	return links, dirs, err
+}
+
+// walkOptions select how walkLocal lists symlinks and directories.
+type walkOptions struct {
+	// followSymlinks lists the files of symlinked directories, which are
+	// otherwise skipped.
+	followSymlinks bool
+	// symlinks lists symlinks themselves, rather than the files they
+	// point to.
+	symlinks bool
+	// emptyDirs lists directories with nothing in them.
+	emptyDirs bool
+}
+
+// walkLocal calls fn with each regular file below root, and the symlinks
+// and empty directories selected by opts. Symlinks to files are read
+// through unless listed themselves, and broken symlinks, symlinked
+// directories not followed and special files such as sockets, FIFOs and
+// devices are skipped with a warning. A symlink to a directory containing
+// it is never followed, so walking never loops.
+func walkLocal(root string, opts walkOptions, fn func(filePath string, info os.FileInfo) error) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fn(root, info)
+	}
+
+	ancestors := map[string]bool{}
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			if ancestors[real] {
+				log.Warnf("Skipping '%s', it links to a directory containing it.", dir)
+				return nil
+			}
+			ancestors[real] = true
+			defer delete(ancestors, real)
+		}
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			filePath := filepath.Join(dir, info.Name())
+			if info.Mode()&os.ModeSymlink != 0 && !opts.symlinks {
+				target, err := os.Stat(filePath)
+				if err != nil {
+					log.Warnf("Skipping broken symlink '%s'.", filePath)
+					continue
+				}
+				if target.IsDir() && !opts.followSymlinks {
+					log.Warnf("Skipping symlinked directory '%s'.", filePath)
+					continue
+				}
+				info = target
+			}
+
+			switch {
+			case info.IsDir():
+				if err := walk(filePath); err != nil {
+					return err
+				}
+				if opts.emptyDirs && emptyDir(filePath) {
+					err = fn(filePath, info)
+				}
+			case info.Mode().IsRegular(), info.Mode()&os.ModeSymlink != 0:
+				err = fn(filePath, info)
+			default:
+				log.Warnf("Skipping special file '%s'.", filePath)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root)
+}
+
+func emptyDir(path string) bool {
+	infos, err := ioutil.ReadDir(path)
+	return err == nil && len(infos) == 0
+}
+
 func pathExists(path string) bool {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -61,3 +246,87 @@ func relativePath(path string, filePath string) string {
 		return strings.TrimPrefix(strings.TrimPrefix(filePath, path), "/")
 	}
 }
+
+// matchesETag reports whether the local file at path, whose md5 is md5sum,
+// has the content of an S3 object with etag. The ETag of an object
+// uploaded in parts is the md5 of the md5s of its parts followed by the
+// number of parts, which is computed for partSize and for the 8MB parts
+// used by other common tools.
+func matchesETag(path, md5sum, etag string, partSize int64) bool {
+	if etag == md5sum {
+		return true
+	}
+
+	sizes, err := etagPartSizes(path, etag, partSize)
+	if err != nil {
+		return false
+	}
+	for _, size := range sizes {
+		if sum, err := multipartETag(path, size); err == nil && sum == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// etagPartSizes returns the part sizes, of partSize and 8MB, which split
+// the file at path into the number of parts of the multipart etag.
+func etagPartSizes(path, etag string, partSize int64) ([]int64, error) {
+	i := strings.LastIndex(etag, "-")
+	if i < 0 {
+		return nil, nil
+	}
+	parts, err := strconv.Atoi(etag[i+1:])
+	if err != nil {
+		return nil, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := []int64{}
+	for _, size := range []int64{partSize, 8 * 1024 * 1024} {
+		if size > 0 && partCount(info.Size(), size) == parts {
+			sizes = append(sizes, size)
+		}
+	}
+	return sizes, nil
+}
+
+func partCount(size, partSize int64) int {
+	if size == 0 {
+		return 1
+	}
+	return int((size + partSize - 1) / partSize)
+}
+
+func multipartETag(path string, partSize int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sums := md5.New()
+	parts := 0
+	for {
+		hasher := md5.New()
+		n, err := io.CopyN(hasher, f, partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n == 0 && parts > 0 {
+			break
+		}
+
+		sums.Write(hasher.Sum(nil))
+		parts++
+		if n < partSize {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%x-%d", sums.Sum(nil), parts), nil
+}
@@ -2,6 +2,7 @@ package gosync
 
 import (
 	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -31,6 +32,42 @@ func TestLoadLocalFiles(t *testing.T) {
 	}
 }
 
+func TestLoadLocalChecksums(t *testing.T) {
+	dir := testSource(t, map[string]string{"file": "test1234"})
+	defer os.RemoveAll(dir)
+
+	var checksumTests = []struct {
+		name string
+		sum  string
+	}{
+		{"", "16d7a4fca7442dda3ad93c9a726597e4"},
+		{"md5", "16d7a4fca7442dda3ad93c9a726597e4"},
+		{"SHA256", "937e8d5fbb48bd4949536cd65b8d35c426b80d2f830c5c308e2cdec422ae2244"},
+		{"crc32c", "36cff317"},
+	}
+
+	for _, ct := range checksumTests {
+		algorithm, err := lookupChecksumAlgorithm(ct.name)
+		if err != nil {
+			t.Fatalf("Error looking up '%s': %s", ct.name, err)
+		}
+		data, err := loadLocalChecksums(dir, algorithm, walkOptions{})
+		if err != nil {
+			t.Fatalf("Error loading local files: %s", err)
+		}
+		if data["file"] != ct.sum {
+			t.Errorf("Expected '%s' checksum '%s', got '%s'.", ct.name, ct.sum, data["file"])
+		}
+		if checksumAlgorithmOf(ct.sum) != algorithm {
+			t.Errorf("Expected checksum '%s' to be '%s'.", ct.sum, algorithm.name)
+		}
+	}
+
+	if _, err := lookupChecksumAlgorithm("sha1"); err == nil {
+		t.Errorf("Expected error looking up 'sha1'.")
+	}
+}
+
 var relativePathTests = []relativePathTestCase{
 	{"/home/me", "/home/me/my/file", "my/file"},
 	{".", "/my/file", "my/file"},
@@ -43,3 +80,43 @@ func TestRelativePaths(t *testing.T) {
 		}
 	}
 }
+
+func TestMatchesETag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dir")
+	if err != nil {
+		t.Fatalf("Error creating temp dir")
+	}
+
+	file := dir + "/file"
+	if err := ioutil.WriteFile(file, []byte("test1234"), 0400); err != nil {
+		t.Fatalf("Error creating temp file")
+	}
+	md5sum := "16d7a4fca7442dda3ad93c9a726597e4"
+
+	etag, err := multipartETag(file, 3)
+	if err != nil {
+		t.Fatalf("Error computing multipart ETag")
+	}
+	if etag != "46861189a5e67272083e94c44cd6ac31-3" {
+		t.Fatalf("Unexpected multipart ETag '%s'.", etag)
+	}
+
+	var matchesETagTests = []struct {
+		etag     string
+		partSize int64
+		result   bool
+	}{
+		{md5sum, 3, true},
+		{etag, 3, true},
+		{etag, 4, false},
+		{"0e6f4c4ea5e4bd6a4b04f3a4b9a0c8fb-3", 3, false},
+		{"46861189a5e67272083e94c44cd6ac31-x", 3, false},
+		{"", 3, false},
+	}
+
+	for _, tc := range matchesETagTests {
+		if matchesETag(file, md5sum, tc.etag, tc.partSize) != tc.result {
+			t.Fatalf("Unexpected match of ETag '%s' with part size %d.", tc.etag, tc.partSize)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package gosync
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// excluded reports whether file, relative to the root of the sync, is
+// left out by the Include and Exclude patterns. When there are Include
+// patterns only files matching one of them are synced, and files matching
+// an Exclude pattern never are.
+func (s *SyncPair) excluded(file string) bool {
+	if len(s.Include) > 0 && !matchesAny(s.Include, file) {
+		return true
+	}
+	return matchesAny(s.Exclude, file)
+}
+
+func (s *SyncPair) validFilters() error {
+	for _, pattern := range append(s.Include, s.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern '%s'.", pattern)
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, file string) bool {
+	for _, pattern := range patterns {
+		if matchesPattern(pattern, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPattern reports whether file matches the glob pattern. A pattern
+// without a slash matches the name of the file or of any directory it is
+// in, one with a slash matches the path of the file or of a directory it
+// is in.
+func matchesPattern(pattern, file string) bool {
+	parts := strings.Split(file, "/")
+	pattern = strings.Trim(pattern, "/")
+
+	for i := range parts {
+		name := parts[i]
+		if strings.Contains(pattern, "/") {
+			name = strings.Join(parts[:i+1], "/")
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
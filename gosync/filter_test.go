@@ -0,0 +1,40 @@
+package gosync
+
+import "testing"
+
+func TestMatchesPattern(t *testing.T) {
+	var matchesPatternTests = []struct {
+		pattern string
+		file    string
+		result  bool
+	}{
+		{"*.tmp", "a.tmp", true},
+		{"*.tmp", "dir/a.tmp", true},
+		{"*.tmp", "a.tmp.gz", false},
+		{"cache", "cache/a", true},
+		{"cache", "dir/cache/a", true},
+		{"cache", "caches/a", false},
+		{"dir/*.log", "dir/a.log", true},
+		{"dir/*.log", "other/dir/a.log", false},
+		{"/dir/sub/", "dir/sub/a", true},
+	}
+
+	for _, tc := range matchesPatternTests {
+		if matchesPattern(tc.pattern, tc.file) != tc.result {
+			t.Errorf("Expected '%s' matching '%s' to be '%t'.", tc.file, tc.pattern, tc.result)
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	s := &SyncPair{Include: []string{"*.jpg"}, Exclude: []string{"private"}}
+	for file, excluded := range map[string]bool{
+		"a.jpg":         false,
+		"a.png":         true,
+		"private/a.jpg": true,
+	} {
+		if s.excluded(file) != excluded {
+			t.Errorf("Expected '%s' excluded to be '%t'.", file, excluded)
+		}
+	}
+}
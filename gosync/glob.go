@@ -0,0 +1,266 @@
+package gosync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// A source may be a shell style glob, a local one expanded as the shell
+// would or an S3 one expanded by listing the keys below its longest
+// literal prefix. Each file, directory, object or prefix matched is synced
+// as a source of its own, into the directory of the target it has relative
+// to the directory of the glob holding no glob characters, so that
+// s3://bucket/logs/*/*.gz syncs logs/2020/a.gz to 2020/a.gz. A glob
+// character is matched literally when escaped with a backslash, and a
+// local source naming an existing file is never a glob.
+
+// globSource is a source matched by a glob and the target it is synced
+// into, with the object when the source is one listed while expanding.
+type globSource struct {
+	source string
+	target string
+	object *s3.Key
+}
+
+// hasGlob reports whether location holds glob characters, escaped or not,
+// and is not an existing local file.
+func hasGlob(location string) bool {
+	if validS3Url(location) {
+		s3url := newS3Url(location)
+		location = s3url.Key()
+	} else if pathExists(location) {
+		return false
+	}
+	return strings.ContainsAny(location, "*?[\\")
+}
+
+// globIndex returns the index of the first glob character of pattern
+// which is not escaped, or the length of pattern when there is none.
+func globIndex(pattern string) int {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return i
+		}
+	}
+	return len(pattern)
+}
+
+// unescapeGlob removes the backslashes escaping characters of pattern.
+func unescapeGlob(pattern string) string {
+	unescaped := make([]byte, 0, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		unescaped = append(unescaped, pattern[i])
+	}
+	return string(unescaped)
+}
+
+// globRoot returns the leading directories of pattern which hold no glob
+// characters, unescaped and ending in a separator, or "" when there are
+// none.
+func globRoot(pattern string) string {
+	literal := pattern[:globIndex(pattern)]
+	return unescapeGlob(literal[:strings.LastIndexAny(literal, "/"+string(os.PathSeparator))+1])
+}
+
+// sources returns the sources of the pair, the Sources when set or else
+// the Source.
+func (s *SyncPair) sources() []string {
+	if len(s.Sources) > 0 {
+		return s.Sources
+	}
+	return []string{s.Source}
+}
+
+// multipleSources reports whether the pair syncs more than one source,
+// or a glob which may match several.
+func (s *SyncPair) multipleSources() bool {
+	sources := s.sources()
+	return len(sources) > 1 || hasGlob(sources[0])
+}
+
+// expandSources returns the sources of the pair with their globs expanded,
+// each with the target it is synced into.
+func (s *SyncPair) expandSources() ([]globSource, error) {
+	expanded := []globSource{}
+	for _, source := range s.sources() {
+		if !hasGlob(source) {
+			expanded = append(expanded, globSource{source: source, target: s.Target})
+			continue
+		}
+
+		var matches []globSource
+		var err error
+		if validS3Url(source) {
+			matches, err = s.expandS3Glob(source)
+		} else {
+			matches, err = s.expandLocalGlob(source)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			log.Warnf("No files match '%s'.", source)
+		}
+		expanded = append(expanded, matches...)
+	}
+	return expanded, nil
+}
+
+func (s *SyncPair) expandLocalGlob(pattern string) ([]globSource, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+
+	root := globRoot(pattern)
+	sources := []globSource{}
+	for _, match := range matches {
+		target, err := s.globTarget(strings.TrimPrefix(match, root))
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, globSource{source: match, target: target})
+	}
+	return sources, nil
+}
+
+func (s *SyncPair) expandS3Glob(pattern string) ([]globSource, error) {
+	s3url := newS3Url(pattern)
+	bucket, err := s.bucket(s3url.Bucket())
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys are matched by as many of their leading elements as the glob
+	// has, so that a glob matching a prefix matches all the keys below it.
+	key := strings.TrimLeft(s3url.Key(), "/")
+	elements := strings.Count(key, "/") + 1
+	root := globRoot(key)
+	keys, err := loadS3Keys(bucket, unescapeGlob(key[:globIndex(key)]), make(map[string]s3.Key), "")
+	if err != nil {
+		return nil, err
+	}
+
+	matched := map[string]bool{}
+	for k := range keys {
+		parts := strings.Split(k, "/")
+		if len(parts) < elements {
+			continue
+		}
+		name := strings.Join(parts[:elements], "/")
+		ok, err := path.Match(key, name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched[name] = true
+		}
+	}
+	names := []string{}
+	for name := range matched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sources := []globSource{}
+	for _, name := range names {
+		target, err := s.globTarget(strings.TrimPrefix(name, root))
+		if err != nil {
+			return nil, err
+		}
+		gs := globSource{source: s3Location(bucket, name), target: target}
+		if key, ok := keys[name]; ok {
+			gs.object = &key
+		}
+		sources = append(sources, gs)
+	}
+	return sources, nil
+}
+
+// globTarget returns the target a match of a glob, at name relative to
+// the root of the glob, is synced into. It is always a directory, created
+// when local and ending in a slash when in S3.
+func (s *SyncPair) globTarget(name string) (string, error) {
+	target := s.Target
+	if dir := path.Dir(filepath.ToSlash(name)); dir != "." {
+		target = joinLocation(target, dir)
+	}
+	if validS3Url(target) {
+		return strings.TrimRight(target, "/") + "/", nil
+	}
+	return target, os.MkdirAll(target, 0755)
+}
+
+// syncSources syncs each of the sources of the pair, expanding globs, into
+// the Target. The files and objects matched are transferred together, up
+// to Concurrent at a time, after the directories and prefixes matched are
+// synced. Items of different sources may have the same names, so the sync
+// is not journalled, and deleting from the target is not supported as
+// each source would delete the files of the others.
+func (s *SyncPair) syncSources(ctx context.Context) error {
+	if s.Delete {
+		return errors.New("Delete is not supported with more than one source.")
+	}
+	if err := s.discardJournal(); err != nil {
+		return err
+	}
+
+	sources, err := s.expandSources()
+	if err != nil {
+		return err
+	}
+
+	source, target := s.Source, s.Target
+	defer func() {
+		s.Source, s.Target = source, target
+	}()
+	items := []*syncItem{}
+	writers := map[*syncItem]writer{}
+	for _, gs := range sources {
+		if s.stopped() {
+			return ErrStopped
+		}
+		s.Source, s.Target = gs.source, gs.target
+
+		single := gs.object != nil
+		if !single {
+			if single, err = s.singleSource(); err != nil {
+				return err
+			}
+		}
+		if !single {
+			if err := s.syncSource(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+
+		planned, write, err := s.planFile(gs.object)
+		if err != nil {
+			return err
+		}
+		for _, item := range planned {
+			writers[item] = write
+		}
+		items = append(items, planned...)
+	}
+
+	return s.transfer(ctx, items, func(ctx context.Context, item *syncItem) (int64, error) {
+		return writers[item](ctx, item)
+	})
+}
@@ -0,0 +1,274 @@
+package gosync
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/mitchellh/goamz/s3/s3test"
+)
+
+// s3testRegion is the region in aws.Regions through which tests reach the
+// s3test server.
+const s3testRegion = "s3test"
+
+// setRegion adds region to aws.Regions, returning a function which
+// restores the entry it replaced.
+func setRegion(region aws.Region) func() {
+	previous, existed := aws.Regions[region.Name]
+	aws.Regions[region.Name] = region
+	return func() {
+		if existed {
+			aws.Regions[region.Name] = previous
+		} else {
+			delete(aws.Regions, region.Name)
+		}
+	}
+}
+
+// startS3Test starts an s3test server with the given buckets, returning
+// a function which stops it.
+func startS3Test(t *testing.T, buckets ...string) func() {
+	srv, err := s3test.NewServer(&s3test.Config{})
+	if err != nil {
+		t.Fatalf("Error starting s3test: %s", err)
+	}
+	region := aws.Region{
+		Name:                 s3testRegion,
+		S3Endpoint:           srv.URL(),
+		S3LocationConstraint: true,
+	}
+	restoreRegion := setRegion(region)
+
+	for _, name := range buckets {
+		if err := s3.New(aws.Auth{}, region).Bucket(name).PutBucket(s3.Private); err != nil {
+			restoreRegion()
+			srv.Quit()
+			t.Fatalf("Error creating bucket '%s': %s", name, err)
+		}
+	}
+
+	return func() {
+		srv.Quit()
+		restoreRegion()
+	}
+}
+
+// The files synced by the integration tests, with nested paths and
+// characters which need escaping in keys.
+var integrationFiles = map[string]string{
+	"top.txt":                   "top",
+	"a/b/c/deep.txt":            "deep",
+	"with space/file name.txt":  "spaces",
+	"special/plus+and&amp.txt":  "plus",
+	"special/percent%20.txt":    "percent",
+	"special/quote'paren(1).md": "quote",
+	"special/unicodé-日本.txt":    "unicode",
+	"empty":                     "",
+	"big.bin":                   "0123456789abcdefghij",
+}
+
+// syncTwice syncs sp, checking it transfers the expected number of files,
+// then syncs again checking nothing is transferred.
+func syncTwice(t *testing.T, sp *SyncPair, files int) {
+	finished := syncFinished(sp)
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing '%s' to '%s': %s", sp.Source, sp.Target, err)
+	}
+	if finished.Files != files || finished.Failed != 0 {
+		t.Fatalf("Expected '%d' files synced to '%s', got '%+v'.", files, sp.Target, finished)
+	}
+
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing '%s' to '%s' again: %s", sp.Source, sp.Target, err)
+	}
+	if finished.Files != 0 || finished.Deleted != 0 {
+		t.Fatalf("Expected nothing synced to '%s' again, got '%+v'.", sp.Target, finished)
+	}
+}
+
+func checkLocalFiles(t *testing.T, dir string, expected map[string]string) {
+	files, err := loadLocalFiles(dir)
+	if err != nil {
+		t.Fatalf("Error loading '%s': %s", dir, err)
+	}
+	if len(files) != len(expected) {
+		t.Fatalf("Expected '%d' files in '%s', got '%v'.", len(expected), dir, files)
+	}
+	for file, data := range expected {
+		got, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil || string(got) != data {
+			t.Fatalf("Expected '%s' to contain '%s', got '%s' '%v'.", file, data, got, err)
+		}
+	}
+}
+
+func TestIntegrationAllDirections(t *testing.T) {
+	defer startS3Test(t, "source", "target")()
+
+	source := testSource(t, integrationFiles)
+	defer os.RemoveAll(source)
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	// Local to S3, uploading big.bin in parts.
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://source/backup", s3testRegion)
+	up.Concurrent = 4
+	up.MultipartThreshold = 16
+	up.PartSize = 8
+	syncTwice(t, up, len(integrationFiles))
+
+	// S3 to S3, including the object uploaded in parts.
+	copy := NewSyncPair(aws.Auth{}, "s3://source/backup", "s3://target/copy", s3testRegion)
+	syncTwice(t, copy, len(integrationFiles))
+
+	// S3 to local.
+	down := NewSyncPair(aws.Auth{}, "s3://target/copy", target, s3testRegion)
+	syncTwice(t, down, len(integrationFiles))
+	checkLocalFiles(t, filepath.Join(target, "copy", "backup"), integrationFiles)
+
+	// Local to local.
+	local, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(local)
+	syncTwice(t, NewSyncPair(aws.Auth{}, source+"/", local, ""), len(integrationFiles))
+	checkLocalFiles(t, local, integrationFiles)
+}
+
+func TestIntegrationCopyOfParts(t *testing.T) {
+	defer startS3Test(t, "source", "target")()
+
+	source := testSource(t, map[string]string{"big.bin": "0123456789abcdefghij"})
+	defer os.RemoveAll(source)
+
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://source/backup", s3testRegion)
+	up.MultipartThreshold = 16
+	up.PartSize = 8
+	syncTwice(t, up, 1)
+
+	copy := NewSyncPair(aws.Auth{}, "s3://source/backup", "s3://target/copy", s3testRegion)
+	syncTwice(t, copy, 1)
+
+	region := aws.Regions[s3testRegion]
+	original, _, _ := lookupS3Key(s3.New(aws.Auth{}, region).Bucket("source"), "backup/big.bin")
+	resp, err := s3.New(aws.Auth{}, region).Bucket("target").Head("copy/backup/big.bin")
+	if err != nil {
+		t.Fatalf("Error reading the copy: %s", err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get(sourceETagHeader); got != s3Checksum(original) {
+		t.Fatalf("Expected the copy to record source ETag '%s', got '%s'.", s3Checksum(original), got)
+	}
+
+	// A changed source of the same size is copied again.
+	ioutil.WriteFile(filepath.Join(source, "big.bin"), []byte("abcdefghij0123456789"), 0644)
+	syncTwice(t, up, 1)
+	syncTwice(t, copy, 1)
+}
+
+func TestIntegrationChangesAndDeletes(t *testing.T) {
+	defer startS3Test(t, "bucket")()
+
+	source := testSource(t, integrationFiles)
+	defer os.RemoveAll(source)
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/backup", s3testRegion)
+	up.Delete = true
+	down := NewSyncPair(aws.Auth{}, "s3://bucket/backup", target, s3testRegion)
+	down.Delete = true
+	syncTwice(t, up, len(integrationFiles))
+	syncTwice(t, down, len(integrationFiles))
+
+	// Change one file and remove another.
+	expected := map[string]string{}
+	for file, data := range integrationFiles {
+		expected[file] = data
+	}
+	expected["top.txt"] = "changed"
+	delete(expected, "special/plus+and&amp.txt")
+	ioutil.WriteFile(filepath.Join(source, "top.txt"), []byte("changed"), 0644)
+	os.Remove(filepath.Join(source, "special/plus+and&amp.txt"))
+
+	finished := syncFinished(up)
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing changes: %s", err)
+	}
+	if finished.Files != 1 || finished.Deleted != 1 {
+		t.Fatalf("Expected 1 file synced and 1 deleted, got '%+v'.", finished)
+	}
+
+	finished = syncFinished(down)
+	if err := down.Sync(); err != nil {
+		t.Fatalf("Error syncing changes: %s", err)
+	}
+	if finished.Files != 1 || finished.Deleted != 1 {
+		t.Fatalf("Expected 1 file synced and 1 deleted, got '%+v'.", finished)
+	}
+	checkLocalFiles(t, filepath.Join(target, "backup"), expected)
+}
+
+func TestIntegrationPagination(t *testing.T) {
+	defer startS3Test(t, "bucket")()
+
+	// More files than fit in a single listing or multiple object delete.
+	files := map[string]string{}
+	for i := 0; i < 1100; i++ {
+		files[fmt.Sprintf("dir%d/file%04d", i%3, i)] = fmt.Sprintf("%d", i)
+	}
+	source := testSource(t, files)
+	defer os.RemoveAll(source)
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/many", s3testRegion)
+	up.Concurrent = 20
+	up.Delete = true
+	syncTwice(t, up, len(files))
+
+	down := NewSyncPair(aws.Auth{}, "s3://bucket/many", target, s3testRegion)
+	down.Concurrent = 20
+	syncTwice(t, down, len(files))
+	checkLocalFiles(t, filepath.Join(target, "many"), files)
+
+	// Deleting every file needs more than one request.
+	os.RemoveAll(source)
+	os.Mkdir(source, 0755)
+	finished := syncFinished(up)
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error deleting: %s", err)
+	}
+	bucket := s3.New(aws.Auth{}, aws.Regions[s3testRegion]).Bucket("bucket")
+	keys, _ := loadS3Keys(bucket, "many", map[string]s3.Key{}, "")
+	if finished.Deleted != len(files) || len(keys) != 0 {
+		t.Fatalf("Expected every object deleted, got '%+v' with '%d' remaining.", finished, len(keys))
+	}
+}
+
+func TestIntegrationDelta(t *testing.T) {
+	defer startS3Test(t, "bucket")()
+
+	source := testSource(t, map[string]string{"disk.img": "aaaaaaaabbbbbbbbcccc"})
+	defer os.RemoveAll(source)
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/images", s3testRegion)
+	up.MultipartThreshold = 16
+	up.PartSize = 8
+	up.Delta = true
+	syncTwice(t, up, 1)
+
+	changed := map[string]string{"disk.img": "aaaaaaaaBBBBBBBBcccc"}
+	ioutil.WriteFile(filepath.Join(source, "disk.img"), []byte(changed["disk.img"]), 0644)
+	syncTwice(t, up, 1)
+
+	down := NewSyncPair(aws.Auth{}, "s3://bucket/images", target, s3testRegion)
+	down.PartSize = 8
+	syncTwice(t, down, 1)
+	checkLocalFiles(t, filepath.Join(target, "images"), changed)
+}
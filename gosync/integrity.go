@@ -0,0 +1,131 @@
+package gosync
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// A verifyError reports content transferred which does not match the
+// checksum of its source.
+type verifyError struct {
+	location string
+	expected string
+	actual   string
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("Verification of '%s' failed, expected '%s' got '%s'.", e.location, e.expected, e.actual)
+}
+
+// isVerifyFailure reports whether err is a failed verification, including
+// S3 rejecting a body which does not match its Content-MD5.
+func isVerifyFailure(err error) bool {
+	switch e := err.(type) {
+	case *verifyError:
+		return true
+	case *s3.Error:
+		return e.Code == "BadDigest"
+	}
+	return false
+}
+
+// verifyFailed records and reports a failed verification of item.
+func (s *SyncPair) verifyFailed(item *syncItem, err error) {
+	log.Warnf("Verification failed: %s -> %s: %s", item.Source, item.Target, err.Error())
+	s.stats.mu.Lock()
+	s.stats.verifyFailed++
+	s.stats.mu.Unlock()
+
+	e := item.event(VerifyFailed)
+	e.Err = err
+	s.emit(e)
+}
+
+// contentMD5 returns the Content-MD5 header value of a hex MD5.
+func contentMD5(md5sum string) string {
+	b, _ := hex.DecodeString(md5sum)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// verifyDownload checks the file downloaded for item to path, whose MD5 is
+// md5sum, against the checksum of its source: one of the checksum
+// algorithms, told apart by length, or the ETag of an object uploaded in
+// parts. An ETag of parts of an unknown size can not be checked.
+func (s *SyncPair) verifyDownload(path, md5sum string, item *syncItem) error {
+	expected := item.Checksum
+	actual := md5sum
+	algorithm := checksumAlgorithmOf(expected)
+	switch {
+	case expected == "":
+		return nil
+	case strings.Contains(expected, "-"):
+		if matchesETag(path, md5sum, expected, s.PartSize) {
+			return nil
+		}
+		sizes, err := etagPartSizes(path, expected, s.PartSize)
+		if err != nil {
+			return err
+		}
+		if len(sizes) == 0 {
+			log.Debugf("Unable to verify '%s', its part size is unknown.", item.Target)
+			return nil
+		}
+		if actual, err = multipartETag(path, sizes[0]); err != nil {
+			return err
+		}
+	case algorithm != nil && algorithm != md5Checksum:
+		sum, err := algorithm.fileSum(path)
+		if err != nil {
+			return err
+		}
+		actual = sum
+	}
+
+	if actual != expected {
+		return &verifyError{location: item.Target, expected: expected, actual: actual}
+	}
+	return nil
+}
+
+// verifyUpload checks the object uploaded for item has the expected ETag
+// and size.
+func verifyUpload(bucket *s3.Bucket, item *syncItem, etag string, size int64) error {
+	resp, err := bucket.Head(item.TargetPath)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	actual := strings.Trim(resp.Header.Get("ETag"), "\"")
+	length, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if actual != etag || length != size {
+		return &verifyError{
+			location: item.Target,
+			expected: fmt.Sprintf("%s (%d bytes)", etag, size),
+			actual:   fmt.Sprintf("%s (%d bytes)", actual, length),
+		}
+	}
+	log.Debugf("Verified '%s'.", item.Target)
+	return nil
+}
+
+// partsETag returns the ETag of an object uploaded in parts, the MD5 of
+// the MD5s of its parts followed by the number of parts.
+func partsETag(parts []s3.Part) (string, error) {
+	sums := md5.New()
+	for _, part := range parts {
+		b, err := hex.DecodeString(strings.Trim(part.ETag, "\""))
+		if err != nil {
+			return "", fmt.Errorf("Unexpected ETag '%s' of part '%d'.", part.ETag, part.N)
+		}
+		sums.Write(b)
+	}
+	return fmt.Sprintf("%x-%d", sums.Sum(nil), len(parts)), nil
+}
@@ -0,0 +1,155 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestVerifyDownload(t *testing.T) {
+	dir := testSource(t, map[string]string{"a": "0123456789"})
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a")
+	md5sum := "781e5e245d69b566979b86e28d23f2c7"
+
+	var verifyTests = []struct {
+		checksum string
+		partSize int64
+		valid    bool
+	}{
+		{md5sum, 0, true},
+		{"00000000000000000000000000000000", 0, false},
+		{"84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882", 0, true},
+		{"0000000000000000000000000000000000000000000000000000000000000000", 0, false},
+		{"280c069e", 0, true},
+		{"00000000", 0, false},
+		{"2ba4f3e7ddd4d8e3dfb8e5d3c4c0a3b0-2", 5, false},
+		{"2ba4f3e7ddd4d8e3dfb8e5d3c4c0a3b0-3", 5, true}, // unknown part size
+		{"", 0, true},
+	}
+
+	for _, vt := range verifyTests {
+		sp := &SyncPair{PartSize: vt.partSize}
+		err := sp.verifyDownload(path, md5sum, &syncItem{Target: path, Checksum: vt.checksum})
+		if (err == nil) != vt.valid {
+			t.Errorf("Expected checksum '%s' valid '%t', got '%v'.", vt.checksum, vt.valid, err)
+		}
+		if err != nil && !isVerifyFailure(err) {
+			t.Errorf("Expected verification failure, got '%v'.", err)
+		}
+	}
+}
+
+func TestSyncVerifyRetries(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testSource(t, map[string]string{"a": "0123456789"})
+	defer os.RemoveAll(source)
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	// S3 rejects the corrupted upload, and the HEAD after the retry
+	// reports a corrupted ETag, so it is uploaded a third time.
+	f.inject(corruptOn("Put", 1), corruptOn("Head", 1))
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket", faultyRegion)
+	up.retryDelay = time.Millisecond
+	up.Verify = true
+	finished := syncFinished(up)
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if finished.Files != 1 || finished.VerifyFailures != 2 || f.count("Put") != 3 {
+		t.Fatalf("Expected 1 file synced after 2 verify failures, got '%+v' '%v'.", finished, f.calls)
+	}
+	if data, _ := m.get("bucket", "a"); data != "0123456789" {
+		t.Fatalf("Unexpected object '%s'.", data)
+	}
+
+	f.inject(corruptOn("Get", 1))
+	down := NewSyncPair(aws.Auth{}, "s3://bucket", target, faultyRegion)
+	down.retryDelay = time.Millisecond
+	finished = syncFinished(down)
+	if err := down.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if finished.Files != 1 || finished.VerifyFailures != 1 || f.count("Get") != 2 {
+		t.Fatalf("Expected 1 file synced after 1 verify failure, got '%+v' '%v'.", finished, f.calls)
+	}
+	checkLocalFiles(t, target, map[string]string{"a": "0123456789"})
+
+	// Persistent corruption fails the transfer, leaving no file.
+	os.Remove(filepath.Join(target, "a"))
+	f.inject(corruptOn("Get", 0))
+	if err := down.Sync(); err == nil || !isVerifyFailure(err) {
+		t.Fatalf("Expected verification failure, got '%v'.", err)
+	}
+	if finished.Failed != 1 || finished.VerifyFailures != throttleAttempts {
+		t.Fatalf("Expected 1 failed after '%d' verify failures, got '%+v'.", throttleAttempts, finished)
+	}
+	checkLocalFiles(t, target, map[string]string{})
+}
+
+func TestSyncChecksumAlgorithm(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testSource(t, map[string]string{"a": "0123456789", "b": "abc"})
+	defer os.RemoveAll(source)
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	// An object with the same content but no stored checksum is uploaded
+	// again, to store one.
+	m.put("bucket", "b", "abc")
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket", faultyRegion)
+	up.ChecksumAlgorithm = "sha256"
+	finished := syncFinished(up)
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if finished.Files != 2 {
+		t.Fatalf("Expected 2 files synced, got '%+v'.", finished)
+	}
+	stored := m.header("bucket", "a").Get("X-Amz-Meta-Gosync-Sha256")
+	if stored != "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882" {
+		t.Fatalf("Unexpected stored checksum '%s'.", stored)
+	}
+
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if finished.Files != 0 || f.count("Put") != 2 {
+		t.Fatalf("Expected nothing synced, got '%+v' '%v'.", finished, f.calls)
+	}
+
+	// Downloads are verified against the stored checksum.
+	f.inject(corruptOn("Get", 1))
+	down := NewSyncPair(aws.Auth{}, "s3://bucket", target, faultyRegion)
+	down.retryDelay = time.Millisecond
+	down.ChecksumAlgorithm = "sha256"
+	finished = syncFinished(down)
+	if err := down.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if finished.Files != 2 || finished.VerifyFailures != 1 {
+		t.Fatalf("Expected 2 files synced after 1 verify failure, got '%+v'.", finished)
+	}
+	checkLocalFiles(t, target, map[string]string{"a": "0123456789", "b": "abc"})
+
+	if err := down.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if finished.Files != 0 {
+		t.Fatalf("Expected nothing synced, got '%+v'.", finished)
+	}
+
+	up.ChecksumAlgorithm = "sha1"
+	if err := up.Sync(); err == nil {
+		t.Fatalf("Expected error syncing with an unknown checksum algorithm.")
+	}
+}
@@ -0,0 +1,206 @@
+package gosync
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// A journal records the planned work of a sync, the items completed and
+// the multipart uploads in progress, so an interrupted sync can be
+// resumed. It is an append only file of JSON records, one per line, which
+// is removed once the sync succeeds. Uploaded parts are recorded too,
+// though on resuming S3 is asked which parts it has.
+type journal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	enc  *json.Encoder
+
+	// The plan replayed from the journal of the sync being resumed, and
+	// the multipart uploads of it and this sync.
+	planned bool
+	items   []*syncItem
+	done    map[string]bool
+	uploads map[string]string
+}
+
+type journalRecord struct {
+	Op       string    `json:"op"`
+	Source   string    `json:"source,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Item     *syncItem `json:"item,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	UploadId string    `json:"upload_id,omitempty"`
+	Part     *s3.Part  `json:"part,omitempty"`
+}
+
+// openJournal opens the journal at path for a sync from source to target.
+// When resume is set the records of a previous sync between the same
+// locations are replayed, otherwise any previous journal is discarded.
+func openJournal(path, source, target string, resume bool) (*journal, error) {
+	j := &journal{
+		path:    path,
+		done:    map[string]bool{},
+		uploads: map[string]string{},
+	}
+
+	if resume && pathExists(path) {
+		if err := j.replay(source, target); err != nil {
+			return nil, err
+		}
+	}
+
+	if j.planned {
+		log.Infof("Resuming sync from journal '%s'.", path)
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		j.f = f
+		j.enc = json.NewEncoder(f)
+		return j, nil
+	}
+
+	if resume {
+		log.Infof("No journal to resume at '%s', starting a full sync.", path)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	j.f = f
+	j.enc = json.NewEncoder(f)
+	return j, j.write(journalRecord{Op: "start", Source: source, Target: target})
+}
+
+func (j *journal) replay(source, target string) error {
+	f, err := os.Open(j.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r journalRecord
+		// A record cut short by the interruption ends the journal.
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			break
+		}
+
+		switch r.Op {
+		case "start":
+			if r.Source != source || r.Target != target {
+				log.Warnf("Journal '%s' is for '%s' -> '%s', not resuming.", j.path, r.Source, r.Target)
+				return nil
+			}
+		case "plan":
+			j.items = append(j.items, r.Item)
+		case "planned":
+			j.planned = true
+		case "done":
+			j.done[r.Key] = true
+		case "upload":
+			j.uploads[r.Key] = r.UploadId
+		}
+	}
+	return scanner.Err()
+}
+
+// resuming reports whether the plan of a previous sync was replayed.
+func (j *journal) resuming() bool {
+	return j != nil && j.planned
+}
+
+// remaining returns the planned items of the previous sync which did not
+// complete.
+func (j *journal) remaining() []*syncItem {
+	items := []*syncItem{}
+	for _, item := range j.items {
+		if !j.done[item.Key] {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (j *journal) plan(items []*syncItem) error {
+	if j == nil {
+		return nil
+	}
+	for _, item := range items {
+		if err := j.write(journalRecord{Op: "plan", Item: item}); err != nil {
+			return err
+		}
+	}
+	return j.write(journalRecord{Op: "planned"})
+}
+
+func (j *journal) complete(item *syncItem) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	delete(j.uploads, item.Key)
+	j.mu.Unlock()
+	return j.write(journalRecord{Op: "done", Key: item.Key})
+}
+
+func (j *journal) upload(item *syncItem, uploadId string) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	j.uploads[item.Key] = uploadId
+	j.mu.Unlock()
+	return j.write(journalRecord{Op: "upload", Key: item.Key, UploadId: uploadId})
+}
+
+func (j *journal) part(item *syncItem, part s3.Part) error {
+	if j == nil {
+		return nil
+	}
+	return j.write(journalRecord{Op: "part", Key: item.Key, Part: &part})
+}
+
+// uploadId returns the id of the multipart upload of item started by this
+// or the previous sync, if any.
+func (j *journal) uploadId(item *syncItem) string {
+	if j == nil {
+		return ""
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.uploads[item.Key]
+}
+
+// close closes the journal, removing it if the sync succeeded.
+func (j *journal) close(success bool) error {
+	if j == nil {
+		return nil
+	}
+
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	if success {
+		return os.Remove(j.path)
+	}
+	log.Infof("Sync incomplete, resume it with the journal at '%s'.", j.path)
+	return nil
+}
+
+func (j *journal) write(r journalRecord) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.enc.Encode(r)
+}
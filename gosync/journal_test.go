@@ -0,0 +1,102 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestJournalResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("Error creating temp dir")
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/journal"
+
+	j, err := openJournal(path, "/src", "s3://bucket", false)
+	if err != nil {
+		t.Fatalf("Error opening journal: %s", err)
+	}
+	if j.resuming() {
+		t.Fatalf("New journal should not be resuming.")
+	}
+
+	a := &syncItem{Key: "a", SourcePath: "/src/a", TargetPath: "a", Size: 1}
+	b := &syncItem{Key: "b", SourcePath: "/src/b", TargetPath: "b", Size: 2}
+	if err := j.plan([]*syncItem{a, b}); err != nil {
+		t.Fatalf("Error recording plan: %s", err)
+	}
+	j.complete(a)
+	j.upload(b, "upload-1")
+	j.close(false)
+
+	j, err = openJournal(path, "/src", "s3://bucket", true)
+	if err != nil {
+		t.Fatalf("Error reopening journal: %s", err)
+	}
+	if !j.resuming() {
+		t.Fatalf("Expected journal to resume.")
+	}
+	remaining := j.remaining()
+	if len(remaining) != 1 || remaining[0].Key != "b" || remaining[0].Size != 2 {
+		t.Fatalf("Unexpected remaining items %v.", remaining)
+	}
+	if j.uploadId(remaining[0]) != "upload-1" {
+		t.Fatalf("Upload id not replayed.")
+	}
+	j.close(true)
+
+	if pathExists(path) {
+		t.Fatalf("Journal not removed after success.")
+	}
+}
+
+func TestJournalOtherSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("Error creating temp dir")
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/journal"
+
+	j, _ := openJournal(path, "/src", "s3://bucket", false)
+	j.plan([]*syncItem{{Key: "a"}})
+	j.close(false)
+
+	j, err = openJournal(path, "/other", "s3://bucket", true)
+	if err != nil {
+		t.Fatalf("Error reopening journal: %s", err)
+	}
+	if j.resuming() {
+		t.Fatalf("Journal of another sync should not resume.")
+	}
+	j.close(true)
+}
+
+func TestJournalInvalidPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("Error creating temp dir")
+	}
+	defer os.RemoveAll(dir)
+	path := dir + "/journal"
+
+	var invalidTests = []*SyncPair{
+		NewSyncPair(aws.Auth{}, dir+"/missing", dir, ""),
+		NewSyncPair(aws.Auth{}, dir, "s3://bucket", ""),
+	}
+	invalidTests[1].Include = []string{"["}
+
+	for _, sp := range invalidTests {
+		sp.JournalPath = path
+		if err := sp.Sync(); err == nil {
+			t.Fatalf("Expected syncing '%s' to '%s' to fail.", sp.Source, sp.Target)
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("Expected no journal for an invalid sync, got '%v'.", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package gosync
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// EventSchemaVersion is the version of the JSON event schema written by
+// JSONEvents. It is incremented when a field is removed or changes
+// meaning, adding fields or event types does not change it.
+const EventSchemaVersion = 1
+
+// JSONEvents is an EventHandler writing each event as a JSON object on its
+// own line (NDJSON). Every object has "version", "type" and "time" (RFC
+// 3339) fields, and a "job" field naming the job when the sync is one.
+// The remaining fields depend on the type:
+//
+//	list_started       location
+//	list_finished      location, files
+//	transfer_planned   key, source, target, size, checksum
+//	transfer_started   key, source, target, size, checksum
+//	transfer_finished  key, source, target, size, checksum, duration_ms
+//	transfer_failed    key, source, target, size, checksum, duration_ms, error
+//	verify_failed      key, source, target, size, checksum, error
+//	file_deleted       key, target
+//	conflict           key, source, target, resolution
+//	sync_finished      files, bytes, failed, deleted, conflicts, verify_failures, duration_ms, error (on failure)
+//	poll_finished      location, files, bytes, failed, deleted, conflicts, verify_failures, duration_ms, error (on failure)
+//	file_mismatch      key, source, target, difference
+//
+// Progress events are not written.
+type JSONEvents struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONEvents returns a JSONEvents writing to w.
+func NewJSONEvents(w io.Writer) *JSONEvents {
+	return &JSONEvents{enc: json.NewEncoder(w)}
+}
+
+func (j *JSONEvents) HandleEvent(e Event) {
+	obj := jsonEvent(e)
+	if obj == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.enc.Encode(obj)
+}
+
+func jsonEvent(e Event) map[string]interface{} {
+	obj := map[string]interface{}{
+		"version": EventSchemaVersion,
+		"type":    string(e.Type),
+		"time":    e.Time.UTC().Format(time.RFC3339Nano),
+	}
+
+	if e.Job != "" {
+		obj["job"] = e.Job
+	}
+
+	switch e.Type {
+	case ListStarted:
+		obj["location"] = e.Source
+	case ListFinished:
+		obj["location"] = e.Source
+		obj["files"] = e.Files
+	case TransferPlanned, TransferStarted, TransferFinished, TransferFailed, VerifyFailed:
+		obj["key"] = e.Key
+		obj["source"] = e.Source
+		obj["target"] = e.Target
+		obj["size"] = e.Size
+		obj["checksum"] = e.Checksum
+		if e.Type == TransferFinished || e.Type == TransferFailed {
+			obj["duration_ms"] = durationMs(e.Duration)
+		}
+		if e.Type == TransferFailed || e.Type == VerifyFailed {
+			obj["error"] = errorString(e.Err)
+		}
+	case FileDeleted:
+		obj["key"] = e.Key
+		obj["target"] = e.Target
+	case Conflict:
+		obj["key"] = e.Key
+		obj["source"] = e.Source
+		obj["target"] = e.Target
+		obj["resolution"] = e.Resolution
+	case FileMismatch:
+		obj["key"] = e.Key
+		obj["source"] = e.Source
+		obj["target"] = e.Target
+		obj["difference"] = string(e.Difference)
+	case SyncFinished, PollFinished:
+		if e.Type == PollFinished {
+			obj["location"] = e.Source
+		}
+		obj["files"] = e.Files
+		obj["bytes"] = e.Bytes
+		obj["failed"] = e.Failed
+		obj["deleted"] = e.Deleted
+		obj["conflicts"] = e.Conflicts
+		obj["verify_failures"] = e.VerifyFailures
+		obj["duration_ms"] = durationMs(e.Duration)
+		if e.Err != nil {
+			obj["error"] = e.Err.Error()
+		}
+	default:
+		return nil
+	}
+
+	return obj
+}
+
+func durationMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
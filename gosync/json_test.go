@@ -0,0 +1,41 @@
+package gosync
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestJSONEvents(t *testing.T) {
+	at := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	j := NewJSONEvents(buf)
+
+	j.HandleEvent(Event{Type: ListFinished, Time: at, Source: "/files", Files: 2})
+	j.HandleEvent(Event{Type: TransferProgress, Time: at, Bytes: 10})
+	j.HandleEvent(Event{
+		Type:     TransferFailed,
+		Time:     at,
+		Key:      "a",
+		Source:   "/files/a",
+		Target:   "s3://bucket/a",
+		Size:     0,
+		Checksum: "abc",
+		Duration: 1500 * time.Millisecond,
+		Err:      errors.New("denied"),
+	})
+	j.HandleEvent(Event{Type: VerifyFailed, Time: at, Key: "b", Source: "s3://bucket/b", Target: "/files/b", Size: 1, Checksum: "def", Err: errors.New("mismatch")})
+	j.HandleEvent(Event{Type: SyncFinished, Time: at, Files: 1, Bytes: 5, VerifyFailures: 1, Duration: time.Second})
+	j.HandleEvent(Event{Type: PollFinished, Time: at, Source: "s3://bucket", Deleted: 1, Duration: time.Second})
+
+	expected := `{"files":2,"location":"/files","time":"2014-06-01T12:00:00Z","type":"list_finished","version":1}
+{"checksum":"abc","duration_ms":1500,"error":"denied","key":"a","size":0,"source":"/files/a","target":"s3://bucket/a","time":"2014-06-01T12:00:00Z","type":"transfer_failed","version":1}
+{"checksum":"def","error":"mismatch","key":"b","size":1,"source":"s3://bucket/b","target":"/files/b","time":"2014-06-01T12:00:00Z","type":"verify_failed","version":1}
+{"bytes":5,"conflicts":0,"deleted":0,"duration_ms":1000,"failed":0,"files":1,"time":"2014-06-01T12:00:00Z","type":"sync_finished","verify_failures":1,"version":1}
+{"bytes":0,"conflicts":0,"deleted":1,"duration_ms":1000,"failed":0,"files":0,"location":"s3://bucket","time":"2014-06-01T12:00:00Z","type":"poll_finished","verify_failures":0,"version":1}
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected JSON events:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,151 @@
+package gosync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// The metadata recording the path a symlink copied as an object links to.
+const symlinkHeader = "X-Amz-Meta-Gosync-Symlink"
+
+// planLinksToS3 plans the upload of the symlinks and empty directories of
+// the source which are not already in the target, when they are copied as
+// objects. It also returns the names of all of them, relative to the
+// target prefix, which are not to be deleted.
+func (s *SyncPair) planLinksToS3(s3url s3Url, bucket *s3.Bucket, targetKeys map[string]s3.Key) ([]*syncItem, map[string]bool, error) {
+	items := []*syncItem{}
+	names := map[string]bool{}
+	if !s.CopySymlinksAsObjects && !s.DirMarkers {
+		return items, names, nil
+	}
+
+	links, dirs, err := loadLocalLinks(s.Source, s.walkOptions())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for file, link := range links {
+		if s.excluded(file) {
+			continue
+		}
+		names[file] = true
+		key, exists := targetKeys[s3Key(s3url.Path(), file)]
+		if exists && key.Size == 0 && objectSymlink(bucket, key.Key) == link {
+			continue
+		}
+		item := s.linkToS3Item(s3url, bucket, file)
+		item.Symlink = link
+		items = append(items, item)
+	}
+
+	for _, dir := range dirs {
+		if s.excluded(dir) {
+			continue
+		}
+		file := dir + "/"
+		names[file] = true
+		if _, exists := targetKeys[s3Key(s3url.Path(), file)]; exists {
+			continue
+		}
+		item := s.linkToS3Item(s3url, bucket, file)
+		item.Dir = true
+		items = append(items, item)
+	}
+
+	return items, names, nil
+}
+
+// linkToS3Item plans the upload of file, a symlink or empty directory
+// relative to the source directory, as an empty object.
+func (s *SyncPair) linkToS3Item(s3url s3Url, bucket *s3.Bucket, file string) *syncItem {
+	filePath := strings.Join([]string{s.Source, file}, "/")
+	keyPath := s3Key(s3url.Path(), file)
+	return &syncItem{
+		Key:        file,
+		Source:     filePath,
+		Target:     fmt.Sprintf("s3://%s/%s", bucket.Name, keyPath),
+		SourcePath: filePath,
+		TargetPath: keyPath,
+	}
+}
+
+// writeLinkToS3 uploads the empty object of a symlink or directory marker.
+func (s *SyncPair) writeLinkToS3(bucket *s3.Bucket, item *syncItem) error {
+	headers := map[string][]string{"Content-Type": {"application/x-directory"}}
+	if !item.Dir {
+		headers = objectHeaders(item.SourcePath, s.Headers)
+		headers[symlinkHeader] = []string{item.Symlink}
+	}
+	return bucket.PutHeader(item.TargetPath, []byte{}, headers, s3.Private)
+}
+
+// objectSymlink returns the path the object at key links to, or "" when
+// it is not a symlink.
+func objectSymlink(bucket *s3.Bucket, key string) string {
+	resp, err := bucket.Head(key)
+	if err != nil {
+		log.Debugf("Unable to load '%s': %s", s3Location(bucket, key), err.Error())
+		return ""
+	}
+	resp.Body.Close()
+	return resp.Header.Get(symlinkHeader)
+}
+
+// planLinkToDir plans recreating key, named file, in the target when it
+// is a directory marker, or a symlink copied as an object. It reports
+// whether key is either, returning no item when the target already has
+// the directory or symlink.
+func (s *SyncPair) planLinkToDir(bucket *s3.Bucket, file string, key s3.Key) (*syncItem, bool) {
+	filePath := strings.Join([]string{s.target(), file}, "/")
+	item := &syncItem{
+		Key:        file,
+		Source:     s3Location(bucket, key.Key),
+		Target:     filePath,
+		SourcePath: key.Key,
+		TargetPath: filePath,
+	}
+
+	if strings.HasSuffix(file, "/") {
+		if info, err := os.Stat(filePath); err == nil && info.IsDir() {
+			return nil, true
+		}
+		item.TargetPath = strings.TrimSuffix(filePath, "/")
+		item.Dir = true
+		return item, true
+	}
+
+	if !s.CopySymlinksAsObjects || key.Size != 0 {
+		return nil, false
+	}
+	link := objectSymlink(bucket, key.Key)
+	if link == "" {
+		return nil, false
+	}
+	if current, err := os.Readlink(filePath); err == nil && current == link {
+		return nil, true
+	}
+	item.Symlink = link
+	return item, true
+}
+
+// writeLinkToPath creates the directory or symlink of item, replacing any
+// file in its place.
+func writeLinkToPath(item *syncItem) error {
+	if item.Dir {
+		return os.MkdirAll(item.TargetPath, 0755)
+	}
+	if err := os.MkdirAll(filepath.Dir(item.TargetPath), 0755); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(item.TargetPath); err == nil && !info.IsDir() {
+		if err := os.Remove(item.TargetPath); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(item.Symlink, item.TargetPath)
+}
@@ -0,0 +1,226 @@
+//go:build !windows
+// +build !windows
+
+package gosync
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+// testLinks creates a directory holding a file, a symlink to it, a
+// symlinked directory, a symlink looping back to its parent, a broken
+// symlink, an empty directory and a socket.
+func testLinks(t *testing.T) string {
+	dir := testSource(t, map[string]string{"a": "abc", "d/b": "0123456789"})
+	os.Symlink("a", filepath.Join(dir, "l"))
+	os.Symlink("d", filepath.Join(dir, "ld"))
+	os.Symlink("..", filepath.Join(dir, "d", "loop"))
+	os.Symlink("missing", filepath.Join(dir, "broken"))
+	os.Mkdir(filepath.Join(dir, "e"), 0755)
+	if l, err := net.Listen("unix", filepath.Join(dir, "socket")); err == nil {
+		defer l.Close()
+	}
+	return dir
+}
+
+func TestWalkLocal(t *testing.T) {
+	dir := testLinks(t)
+	defer os.RemoveAll(dir)
+
+	var walkTests = []struct {
+		opts  walkOptions
+		files []string
+	}{
+		{walkOptions{}, []string{"a", "d/b", "l"}},
+		{walkOptions{followSymlinks: true}, []string{"a", "d/b", "l", "ld/b"}},
+		{walkOptions{symlinks: true}, []string{"a", "broken", "d/b", "d/loop", "l", "ld"}},
+		{walkOptions{emptyDirs: true}, []string{"a", "d/b", "e", "l"}},
+	}
+
+	for _, wt := range walkTests {
+		files := []string{}
+		err := walkLocal(dir, wt.opts, func(filePath string, info os.FileInfo) error {
+			files = append(files, relativePath(filepath.ToSlash(dir), filepath.ToSlash(filePath)))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("Error walking '%+v': %s", wt.opts, err)
+		}
+		sort.Strings(files)
+		if !reflect.DeepEqual(files, wt.files) {
+			t.Errorf("Expected '%+v' to list '%v', got '%v'.", wt.opts, wt.files, files)
+		}
+	}
+}
+
+func TestSyncLinks(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testLinks(t)
+	defer os.RemoveAll(source)
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket", faultyRegion)
+	up.CopySymlinksAsObjects = true
+	up.DirMarkers = true
+	up.Delete = true
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	expected := []string{"a", "broken", "d/b", "d/loop", "e/", "l", "ld"}
+	if keys := m.keys("bucket"); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected keys '%v', got '%v'.", expected, keys)
+	}
+
+	puts := f.count("Put")
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if f.count("Put") != puts || !reflect.DeepEqual(m.keys("bucket"), expected) {
+		t.Fatalf("Expected nothing synced, got '%v' '%v'.", m.keys("bucket"), f.calls)
+	}
+
+	down := NewSyncPair(aws.Auth{}, "s3://bucket", target, faultyRegion)
+	down.CopySymlinksAsObjects = true
+	if err := down.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	for link, dest := range map[string]string{"l": "a", "ld": "d", "broken": "missing", "d/loop": ".."} {
+		if got, err := os.Readlink(filepath.Join(target, link)); err != nil || got != dest {
+			t.Errorf("Expected '%s' to link to '%s', got '%s' '%v'.", link, dest, got, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(target, "e")); err != nil || !info.IsDir() {
+		t.Errorf("Expected directory 'e', got '%v'.", err)
+	}
+
+	// Without copying symlinks they are downloaded as empty files, and
+	// directory markers are still created as directories.
+	plain, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(plain)
+	if err := NewSyncPair(aws.Auth{}, "s3://bucket", plain, faultyRegion).Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	checkLocalFiles(t, plain, map[string]string{"a": "abc", "broken": "", "d/b": "0123456789", "d/loop": "", "l": "", "ld": ""})
+	if info, err := os.Stat(filepath.Join(plain, "e")); err != nil || !info.IsDir() {
+		t.Errorf("Expected directory 'e', got '%v'.", err)
+	}
+
+	up.FollowSymlinks = true
+	if err := up.Sync(); err == nil {
+		t.Fatalf("Expected error both following and copying symlinks.")
+	}
+}
+
+// testTar writes a tar archive of entries, symlinks when link is set and
+// otherwise files holding data.
+func testTar(entries [][3]string) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, entry := range entries {
+		name, link, data := entry[0], entry[1], entry[2]
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if link != "" {
+			header.Typeflag, header.Linkname = tar.TypeSymlink, link
+		}
+		tw.WriteHeader(header)
+		tw.Write([]byte(data))
+	}
+	tw.Close()
+	return buf
+}
+
+func TestUnpackTar(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(dir)
+	outside, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(outside)
+
+	buf := testTar([][3]string{
+		{"./a", "", "a"},
+		{"/abs", "", "abs"},
+		{"../escape", "", "escape"},
+		{"d/../../escape", "", "escape"},
+		{"abslink", outside, ""},
+		{"abslink/escape", "", "escape"},
+		{"uplink", "../" + filepath.Base(outside), ""},
+		{"deep/l", "..", ""},
+		{"chain", "deep/l/../" + filepath.Base(outside), ""},
+		{"rel", "a", ""},
+	})
+	if err := unpackTar(buf, dir); err != nil {
+		t.Fatalf("Error unpacking: %s", err)
+	}
+	files := []string{}
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if path != dir {
+			files = append(files, relativePath(dir, path))
+		}
+		return nil
+	})
+	if expected := []string{"a", "abs", "abslink", "abslink/escape", "deep", "deep/l", "rel"}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected '%v' unpacked, got '%v'.", expected, files)
+	}
+	if entries, _ := ioutil.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("Expected nothing written outside, got '%v'.", entries)
+	}
+}
+
+func TestSyncArchiveLinks(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+
+	secret := testSource(t, map[string]string{"secret": "secret"})
+	defer os.RemoveAll(secret)
+	archive := filepath.Join(secret, "links.tar")
+	buf := testTar([][3]string{
+		{"a", "", "a"},
+		{"rel", "a", ""},
+		{"secret", filepath.Join(secret, "secret"), ""},
+		{"up", "../" + filepath.Base(secret) + "/secret", ""},
+	})
+	ioutil.WriteFile(archive, buf.Bytes(), 0644)
+
+	// Links are kept as links rather than read through, even when
+	// symlinks are followed otherwise.
+	up := NewSyncPair(aws.Auth{}, archive, "s3://bucket", faultyRegion)
+	up.Unpack = true
+	up.FollowSymlinks = true
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error unpacking: %s", err)
+	}
+	if keys := m.keys("bucket"); !reflect.DeepEqual(keys, []string{"a", "rel"}) {
+		t.Fatalf("Expected keys 'a' and 'rel', got '%v'.", keys)
+	}
+	if data, _ := m.get("bucket", "rel"); data != "" || m.header("bucket", "rel").Get(symlinkHeader) != "a" {
+		t.Errorf("Expected 'rel' uploaded as a symlink, got '%s'.", data)
+	}
+
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+	down := NewSyncPair(aws.Auth{}, archive, target, faultyRegion)
+	down.Unpack = true
+	if err := down.Sync(); err != nil {
+		t.Fatalf("Error unpacking: %s", err)
+	}
+	if link, err := os.Readlink(filepath.Join(target, "rel")); err != nil || link != "a" {
+		t.Errorf("Expected 'rel' to link to 'a', got '%s' '%v'.", link, err)
+	}
+	for _, name := range []string{"secret", "up"} {
+		if _, err := os.Lstat(filepath.Join(target, name)); err == nil {
+			t.Errorf("Expected '%s' not unpacked.", name)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package gosync
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+// Sources are synced as rsync syncs them. The contents of a source ending
+// in a slash, or of a whole bucket, are synced into the target, while a
+// directory or prefix without one is synced into the target under its own
+// name. A single file or object is synced to the target itself, or into it
+// under its own name when the target is a directory or prefix.
+
+// syncContents reports whether the contents of source are synced into the
+// target, rather than source itself.
+func syncContents(source string) bool {
+	if validS3Url(source) {
+		s3url := newS3Url(source)
+		return strings.Trim(s3url.Key(), "/") == "" || strings.HasSuffix(source, "/")
+	}
+	base := filepath.Base(source)
+	return strings.HasSuffix(source, "/") || strings.HasSuffix(source, string(os.PathSeparator)) ||
+		base == "." || base == ".."
+}
+
+// baseName returns the last element of location, a local path or S3 URL.
+func baseName(location string) string {
+	if validS3Url(location) {
+		s3url := newS3Url(location)
+		return path.Base(strings.Trim(s3url.Key(), "/"))
+	}
+	return filepath.Base(location)
+}
+
+// joinLocation returns name within location, a local directory or S3 URL.
+func joinLocation(location, name string) string {
+	if validS3Url(location) {
+		return strings.TrimRight(location, "/") + "/" + name
+	}
+	return filepath.Join(location, name)
+}
+
+// target returns the directory or S3 URL the contents of the source are
+// synced into, the Target or, for a source synced under its own name, its
+// name within the Target.
+func (s *SyncPair) target() string {
+	if syncContents(s.Source) {
+		return s.Target
+	}
+	return joinLocation(s.Target, baseName(s.Source))
+}
+
+// s3Key returns the key of name, a path relative to prefix.
+func s3Key(prefix, name string) string {
+	if prefix = strings.Trim(prefix, "/"); prefix == "" {
+		return strings.TrimLeft(name, "/")
+	}
+	return prefix + "/" + strings.TrimLeft(name, "/")
+}
+
+// Prefix returns the prefix of the keys below the URL, which ends in a
+// slash so that s3://bucket/data does not include data2/, or is empty for
+// a whole bucket.
+func (r *s3Url) Prefix() string {
+	if prefix := strings.Trim(r.Key(), "/"); prefix != "" {
+		return prefix + "/"
+	}
+	return ""
+}
+
+// lookupS3Key returns the object at key, reporting whether it exists.
+func lookupS3Key(bucket *s3.Bucket, key string) (s3.Key, bool, error) {
+	data, err := bucket.List(key, "", "", 1)
+	if err != nil {
+		return s3.Key{}, false, err
+	}
+	for _, k := range data.Contents {
+		if k.Key == key {
+			return k, true, nil
+		}
+	}
+	return s3.Key{}, false, nil
+}
+
+// s3PrefixExists reports whether there are any objects below prefix.
+func s3PrefixExists(bucket *s3.Bucket, prefix string) (bool, error) {
+	data, err := bucket.List(prefix, "", "", 1)
+	if err != nil {
+		return false, err
+	}
+	return len(data.Contents) > 0, nil
+}
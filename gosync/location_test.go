@@ -0,0 +1,236 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestLocationNames(t *testing.T) {
+	var locationTests = []struct {
+		location string
+		contents bool
+		base     string
+		prefix   string
+	}{
+		{"/data", false, "data", ""},
+		{"/data/", true, "data", ""},
+		{".", true, ".", ""},
+		{"s3://bucket", true, ".", ""},
+		{"s3://bucket/", true, ".", ""},
+		{"s3://bucket/data", false, "data", "data/"},
+		{"s3://bucket/data/", true, "data", "data/"},
+		{"s3://bucket/data/logs", false, "logs", "data/logs/"},
+	}
+
+	for _, lt := range locationTests {
+		if contents := syncContents(lt.location); contents != lt.contents {
+			t.Errorf("Expected '%s' contents '%t', got '%t'.", lt.location, lt.contents, contents)
+		}
+		if !lt.contents || lt.base != "." {
+			if base := baseName(lt.location); base != lt.base {
+				t.Errorf("Expected '%s' base '%s', got '%s'.", lt.location, lt.base, base)
+			}
+		}
+		if validS3Url(lt.location) {
+			s3url := newS3Url(lt.location)
+			if prefix := s3url.Prefix(); prefix != lt.prefix {
+				t.Errorf("Expected '%s' prefix '%s', got '%s'.", lt.location, lt.prefix, prefix)
+			}
+		}
+	}
+
+	var keyTests = []struct {
+		prefix string
+		name   string
+		key    string
+	}{
+		{"", "a", "a"},
+		{"/", "a", "a"},
+		{"data", "a", "data/a"},
+		{"data/", "dir/a", "data/dir/a"},
+		{"/data/", "/a", "data/a"},
+	}
+
+	for _, kt := range keyTests {
+		if key := s3Key(kt.prefix, kt.name); key != kt.key {
+			t.Errorf("Expected '%s' in '%s' to be '%s', got '%s'.", kt.name, kt.prefix, kt.key, key)
+		}
+	}
+}
+
+func TestSyncLocations(t *testing.T) {
+	var syncTests = []struct {
+		source string
+		target string
+		files  []string
+	}{
+		// Local sources, $src holding a and d/b.
+		{"$src/", "s3://output/dst", []string{"dst/a", "dst/d/b"}},
+		{"$src", "s3://output/dst", []string{"dst/src/a", "dst/src/d/b"}},
+		{"$src/d", "s3://output", []string{"d/b"}},
+		{"$src/a", "s3://output/one", []string{"one"}},
+		{"$src/a", "s3://output/dst/", []string{"dst/a"}},
+		{"$src", "$dst", []string{"src/a", "src/d/b"}},
+		{"$src/", "$dst", []string{"a", "d/b"}},
+		{"$src/a", "$dst", []string{"a"}},
+		{"$src/a", "$dst/renamed", []string{"renamed"}},
+
+		// S3 sources, holding data/x, data/sub/z and data2/y.
+		{"s3://input", "$dst", []string{"data/sub/z", "data/x", "data2/y"}},
+		{"s3://input/data", "$dst", []string{"data/sub/z", "data/x"}},
+		{"s3://input/data/", "$dst", []string{"sub/z", "x"}},
+		{"s3://input/data/x", "$dst/renamed", []string{"renamed"}},
+		{"s3://input/data", "s3://output/copy", []string{"copy/data/sub/z", "copy/data/x"}},
+		{"s3://input/data/", "s3://output/copy", []string{"copy/sub/z", "copy/x"}},
+		{"s3://input/data2/y", "s3://output", []string{"y"}},
+	}
+
+	for _, st := range syncTests {
+		func() {
+			m, _, stop := testS3(t, "input", "output")
+			defer stop()
+			m.put("input", "data/x", "x")
+			m.put("input", "data/sub/z", "z")
+			m.put("input", "data2/y", "y")
+
+			root := testSource(t, map[string]string{"src/a": "a", "src/d/b": "b"})
+			defer os.RemoveAll(root)
+			dst, _ := ioutil.TempDir("", "gosync")
+			defer os.RemoveAll(dst)
+
+			location := func(l string) string {
+				return strings.Replace(strings.Replace(l, "$src", root+"/src", 1), "$dst", dst, 1)
+			}
+			sp := NewSyncPair(aws.Auth{}, location(st.source), location(st.target), faultyRegion)
+			if err := sp.Sync(); err != nil {
+				t.Fatalf("Error syncing '%s' to '%s': %s", st.source, st.target, err)
+			}
+
+			files := m.keys("output")
+			if !validS3Url(st.target) {
+				files = []string{}
+				local, _ := loadLocalFiles(dst)
+				for file := range local {
+					files = append(files, file)
+				}
+				sort.Strings(files)
+			}
+			if !reflect.DeepEqual(files, st.files) {
+				t.Errorf("Expected '%s' to '%s' to sync '%v', got '%v'.", st.source, st.target, st.files, files)
+			}
+
+			// Syncing again transfers nothing.
+			finished := syncFinished(sp)
+			if err := sp.Sync(); err != nil || finished.Files != 0 {
+				t.Errorf("Expected '%s' to '%s' to sync nothing again, got '%+v' '%v'.", st.source, st.target, finished, err)
+			}
+		}()
+	}
+}
+
+func TestSyncGlobs(t *testing.T) {
+	var globTests = []struct {
+		sources []string
+		target  string
+		files   []string
+	}{
+		{[]string{"$src/*"}, "s3://output/dst", []string{"dst/a", "dst/d/b"}},
+		{[]string{"$src/[a]"}, "s3://output/one", []string{"one/a"}},
+		{[]string{"$src/*/b"}, "s3://output", []string{"d/b"}},
+		{[]string{"$src/a", "$src/d"}, "s3://output", []string{"a", "d/b"}},
+		{[]string{"$src/a", "s3://input/data2/y"}, "$dst", []string{"a", "y"}},
+		{[]string{"s3://input/data/*"}, "$dst", []string{"sub/z", "x"}},
+		{[]string{"s3://input/data/?"}, "s3://output/one", []string{"one/x"}},
+		{[]string{"s3://input/*/x"}, "$dst", []string{"data/x"}},
+		{[]string{"s3://input/data*"}, "s3://output", []string{"data/sub/z", "data/x", "data2/y"}},
+		{[]string{"s3://input/missing*"}, "$dst", []string{}},
+		{[]string{"s3://input/lit/\\[1\\].txt"}, "$dst", []string{"[1].txt"}},
+		{[]string{"$lit/\\[1\\]*"}, "s3://output", []string{"[1].txt"}},
+		{[]string{"$lit/[1].txt"}, "s3://output", []string{"[1].txt"}},
+	}
+
+	for _, gt := range globTests {
+		func() {
+			m, _, stop := testS3(t, "input", "output")
+			defer stop()
+			m.put("input", "data/x", "x")
+			m.put("input", "data/sub/z", "z")
+			m.put("input", "data2/y", "y")
+			m.put("input", "lit/[1].txt", "1")
+			m.put("input", "lit/1.txt", "1")
+
+			root := testSource(t, map[string]string{"src/a": "a", "src/d/b": "b", "lit/[1].txt": "1", "lit/1.txt": "1"})
+			defer os.RemoveAll(root)
+			dst, _ := ioutil.TempDir("", "gosync")
+			defer os.RemoveAll(dst)
+
+			location := func(l string) string {
+				l = strings.Replace(l, "$lit", root+"/lit", 1)
+				return strings.Replace(strings.Replace(l, "$src", root+"/src", 1), "$dst", dst, 1)
+			}
+			sources := []string{}
+			for _, source := range gt.sources {
+				sources = append(sources, location(source))
+			}
+			sp := NewSyncPair(aws.Auth{}, sources[0], location(gt.target), faultyRegion)
+			sp.Sources = sources
+			if err := sp.Sync(); err != nil {
+				t.Fatalf("Error syncing '%v' to '%s': %s", gt.sources, gt.target, err)
+			}
+
+			files := m.keys("output")
+			if !validS3Url(gt.target) {
+				files = []string{}
+				local, _ := loadLocalFiles(dst)
+				for file := range local {
+					files = append(files, file)
+				}
+				sort.Strings(files)
+			}
+			if !reflect.DeepEqual(files, gt.files) {
+				t.Errorf("Expected '%v' to '%s' to sync '%v', got '%v'.", gt.sources, gt.target, gt.files, files)
+			}
+
+			finished := syncFinished(sp)
+			if err := sp.Sync(); err != nil || finished.Files != 0 {
+				t.Errorf("Expected '%v' to '%s' to sync nothing again, got '%+v' '%v'.", gt.sources, gt.target, finished, err)
+			}
+
+			sp.Delete = true
+			if err := sp.Sync(); err == nil {
+				t.Errorf("Expected error deleting with '%v'.", gt.sources)
+			}
+		}()
+	}
+}
+
+func TestSyncGlobConcurrent(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+	for _, key := range []string{"logs/a.gz", "logs/b.gz", "logs/c.gz", "logs/d.gz"} {
+		m.put("bucket", key, key)
+	}
+	f.inject(&fault{op: "Get", latency: 100 * time.Millisecond})
+
+	dst, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(dst)
+
+	// The objects matched are downloaded together, without looking each
+	// of them up again.
+	sp := NewSyncPair(aws.Auth{}, "s3://bucket/logs/*.gz", dst, faultyRegion)
+	sp.Concurrent = 2
+	finished := syncFinished(sp)
+	if err := sp.Sync(); err != nil || finished.Files != 4 {
+		t.Fatalf("Expected 4 files synced, got '%+v' '%v'.", finished, err)
+	}
+	if f.maxInFlight != 2 || f.count("List") != 2 {
+		t.Fatalf("Expected 2 downloads at once after 2 listings, got '%d' '%v'.", f.maxInFlight, f.calls)
+	}
+}
@@ -0,0 +1,228 @@
+package gosync
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// writeLocalFileToS3Multipart uploads a large file in parts of PartSize.
+// The upload and its parts are recorded in the journal, and when resuming
+// the parts S3 already has are reused rather than sent again.
+func (s *SyncPair) writeLocalFileToS3Multipart(ctx context.Context, bucket *s3.Bucket, item *syncItem) (int64, error) {
+	if s.PartSize <= 0 {
+		return 0, errors.New("Part size must be greater than 0.")
+	}
+
+	f, err := os.Open(item.SourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size()
+
+	multi, existing, err := s.resumeMulti(bucket, item)
+	if err != nil {
+		return 0, err
+	}
+	if multi == nil {
+		headers := objectHeaders(item.SourcePath, s.Headers)
+		if err := s.setChecksumHeader(headers, item.SourcePath); err != nil {
+			return 0, err
+		}
+		multi, err = bucket.InitMultiHeader(item.TargetPath, headers, s3.ACL("private"))
+		if err != nil {
+			return 0, err
+		}
+		if err := s.journal.upload(item, multi.UploadId); err != nil {
+			return 0, err
+		}
+	}
+
+	// A delta upload copies the parts unchanged since the last upload.
+	var previous *partManifest
+	if s.Delta {
+		previous = s.loadPartManifest(bucket, item)
+	}
+
+	parts, err := s.putParts(ctx, multi, item, f, size, existing, previous)
+	if err == nil {
+		err = multi.Complete(parts)
+	}
+	if err != nil {
+		// The upload is kept only when it may be resumed, by a retry or
+		// by resuming the stopped sync from the journal, and is otherwise
+		// aborted so its parts are not left accruing storage.
+		resumable := isThrottle(err) || isVerifyFailure(err) || s.stopped()
+		if s.journal == nil || ctx.Err() != nil || !resumable {
+			log.Infof("Aborting upload of '%s'.", item.Target)
+			if aerr := multi.Abort(); aerr != nil {
+				log.Warnf("Error aborting upload of '%s': %s", item.Target, aerr.Error())
+			}
+		}
+		return 0, err
+	}
+
+	if s.Verify {
+		etag, err := partsETag(parts)
+		if err == nil {
+			err = verifyUpload(bucket, item, etag, size)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if s.Delta {
+		if err := s.writePartManifest(bucket, item, size, parts); err != nil {
+			log.Warnf("Error writing part manifest of '%s': %s", item.Target, err.Error())
+		}
+	}
+	return size, nil
+}
+
+// resumeMulti returns the multipart upload of item started by an
+// interrupted sync and the parts S3 has for it, or nil if there is none.
+func (s *SyncPair) resumeMulti(bucket *s3.Bucket, item *syncItem) (*s3.Multi, map[int]s3.Part, error) {
+	uploadId := s.journal.uploadId(item)
+	if uploadId == "" {
+		return nil, nil, nil
+	}
+
+	multi := &s3.Multi{Bucket: bucket, Key: item.TargetPath, UploadId: uploadId}
+	parts, err := multi.ListParts()
+	if err != nil {
+		if e, ok := err.(*s3.Error); ok && e.Code == "NoSuchUpload" {
+			log.Infof("Upload of '%s' no longer exists, starting again.", item.Target)
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+
+	log.Infof("Resuming upload of '%s' with '%d' parts uploaded.", item.Target, len(parts))
+	existing := map[int]s3.Part{}
+	for _, part := range parts {
+		existing[part.N] = part
+	}
+	return multi, existing, nil
+}
+
+func (s *SyncPair) putParts(ctx context.Context, multi *s3.Multi, item *syncItem, f *os.File, size int64, existing map[int]s3.Part, previous *partManifest) ([]s3.Part, error) {
+	parts := []s3.Part{}
+	copied := 0
+
+	// An empty file is still uploaded as one empty part.
+	for n, offset := 1, int64(0); offset < size || n == 1; n, offset = n+1, offset+s.PartSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		length := s.PartSize
+		if offset+length > size {
+			length = size - offset
+		}
+		section := io.NewSectionReader(f, offset, length)
+
+		if old, ok := existing[n]; ok && old.Size == length {
+			sum, err := md5Sum(section)
+			if err != nil {
+				return nil, err
+			}
+			if old.ETag == fmt.Sprintf("\"%s\"", sum) {
+				log.Debugf("Reusing part '%d' of '%s'.", n, item.Target)
+				s.addProgress(item, length)
+				parts = append(parts, old)
+				continue
+			}
+		}
+
+		var part s3.Part
+		var err error
+		if previous != nil {
+			sum, serr := md5Sum(section)
+			if serr != nil {
+				return nil, serr
+			}
+			if previous.unchangedPart(n, length, sum) {
+				log.Debugf("Copying unchanged part '%d' of '%s'.", n, item.Target)
+				part, err = multi.PutPartCopy(n, item.TargetPath, offset, length)
+				if err == nil {
+					copied++
+					s.addProgress(item, length)
+				}
+			}
+		}
+		if part.ETag == "" && err == nil {
+			part, err = multi.PutPart(n, s.partReader(ctx, item, section))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := s.journal.part(item, part); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+
+	if previous != nil {
+		log.Infof("Copied '%d' unchanged of '%d' parts of '%s'.", copied, len(parts), item.Target)
+	}
+	return parts, nil
+}
+
+func md5Sum(rs io.ReadSeeker) (string, error) {
+	if _, err := rs.Seek(0, 0); err != nil {
+		return "", err
+	}
+	hasher := md5.New()
+	if _, err := io.Copy(hasher, rs); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// partReader wraps a part so it is subject to the bandwidth limit and
+// reports its progress as it is sent. goamz reads each part once to hash
+// it before rewinding to send it, so reads before the first rewind are
+// not counted.
+func (s *SyncPair) partReader(ctx context.Context, item *syncItem, rs io.ReadSeeker) io.ReadSeeker {
+	return &partReader{rs: rs, r: s.reader(ctx, item, rs)}
+}
+
+type partReader struct {
+	rs     io.ReadSeeker
+	r      io.Reader
+	pos    int64
+	hashed bool
+}
+
+func (pr *partReader) Read(p []byte) (int, error) {
+	var n int
+	var err error
+	if pr.hashed {
+		n, err = pr.r.Read(p)
+	} else {
+		n, err = pr.rs.Read(p)
+	}
+	pr.pos += int64(n)
+	return n, err
+}
+
+func (pr *partReader) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == 0 && pr.pos > 0 {
+		pr.hashed = true
+	}
+	pos, err := pr.rs.Seek(offset, whence)
+	pr.pos = pos
+	return pos, err
+}
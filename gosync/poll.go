@@ -0,0 +1,157 @@
+package gosync
+
+import (
+	"context"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+const defaultPollInterval = time.Minute
+
+// poll syncs an S3 source to a local directory and then polls it for
+// changes every PollInterval. The keys listed by each poll are remembered,
+// so only those added or changed since are downloaded and local files are
+// not read again. The target is fully resynced every RescanInterval to
+// repair any changes made to it locally.
+func (s *SyncPair) poll(ctx context.Context) error {
+	s3url := newS3Url(s.Source)
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+
+	// List before the initial sync, so a key changed during it is
+	// downloaded again by the first poll rather than missed.
+	seen, err := loadS3Keys(bucket, s3url.Prefix(), make(map[string]s3.Key), "")
+	if err != nil {
+		return err
+	}
+
+	if err := s.run(ctx, s.sync); err != nil {
+		return err
+	}
+	s.Resume = false
+	log.Infof("Polling '%s' for changes every %s.", s.Source, s.PollInterval)
+
+	ticker := time.NewTicker(s.PollInterval)
+	defer ticker.Stop()
+	var rescan <-chan time.Time
+	if s.RescanInterval > 0 {
+		rescanTicker := time.NewTicker(s.RescanInterval)
+		defer rescanTicker.Stop()
+		rescan = rescanTicker.C
+	}
+	stop := time.NewTicker(watchStopInterval)
+	defer stop.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stop.C:
+			if s.stopped() {
+				return ErrStopped
+			}
+			continue
+		case <-rescan:
+			log.Infof("Resyncing '%s'.", s.Target)
+			err = s.run(ctx, s.sync)
+		case <-ticker.C:
+			seen, err = s.pollChanges(ctx, s3url, bucket, seen)
+		}
+
+		switch {
+		case err == nil:
+		case err == ErrStopped || ctx.Err() != nil:
+			return err
+		default:
+			log.Errorf("Error syncing changes from '%s': %s", s.Source, err.Error())
+		}
+	}
+}
+
+// pollChanges lists the source and syncs the keys which differ from those
+// seen by the previous poll, returning the keys now seen. Keys which could
+// not be synced are returned as they were, so they are retried by the next
+// poll. Each poll ends with a PollFinished event.
+func (s *SyncPair) pollChanges(ctx context.Context, s3url s3Url, bucket *s3.Bucket, seen map[string]s3.Key) (map[string]s3.Key, error) {
+	start := time.Now()
+	s.stats = syncStats{}
+
+	keys, err := loadS3Keys(bucket, s3url.Prefix(), make(map[string]s3.Key), "")
+	if err != nil {
+		s.emitPollFinished(start, err)
+		return seen, err
+	}
+
+	items := []*syncItem{}
+	for name, key := range keys {
+		old, ok := seen[name]
+		file, within := relativeKey(s3url.Prefix(), name)
+		if !within || s.excluded(file) {
+			continue
+		}
+		if ok && old.ETag == key.ETag && old.LastModified == key.LastModified {
+			continue
+		}
+		if item, link := s.planLinkToDir(bucket, file, key); link {
+			if item != nil {
+				items = append(items, item)
+			}
+		} else {
+			items = append(items, s.s3ToDirItem(bucket, file, key))
+		}
+	}
+	if s.Delete {
+		for name, _ := range seen {
+			file, within := relativeKey(s3url.Prefix(), name)
+			if _, ok := keys[name]; !ok && within && !s.excluded(file) {
+				items = append(items, localDeletionItem(s.target(), file))
+			}
+		}
+	}
+
+	if len(items) > 0 {
+		log.Infof("Found '%d' changes in '%s'.", len(items), s.Source)
+		err = s.run(ctx, func(ctx context.Context) error {
+			if err := s.journal.plan(items); err != nil {
+				return err
+			}
+			return s.transferToDir(ctx, bucket, items)
+		})
+	}
+
+	if err != nil {
+		for _, item := range items {
+			name := item.SourcePath
+			if item.Delete {
+				name = s3Key(s3url.Prefix(), item.Key)
+			}
+			if old, ok := seen[name]; ok {
+				keys[name] = old
+			} else {
+				delete(keys, name)
+			}
+		}
+	}
+
+	s.emitPollFinished(start, err)
+	return keys, err
+}
+
+func (s *SyncPair) emitPollFinished(start time.Time, err error) {
+	s.emit(Event{
+		Type:           PollFinished,
+		Source:         s.Source,
+		Files:          s.stats.files,
+		Bytes:          s.stats.bytes,
+		Failed:         s.stats.failed,
+		Deleted:        s.stats.deleted,
+		Conflicts:      s.stats.conflicts,
+		VerifyFailures: s.stats.verifyFailed,
+		Duration:       time.Since(start),
+		Err:            err,
+	})
+}
@@ -1,11 +1,214 @@
 package gosync
 
-func newPool(concurrent int) chan int {
-	pool := make(chan int, concurrent)
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+const (
+	// Throughput is sampled over this window before an adaptive pool
+	// decides whether to grow.
+	adaptiveWindow = 2 * time.Second
+
+	// Growth must improve throughput by this factor to continue.
+	adaptiveGrowthFactor = 1.05
+
+	// Attempts made at a transfer which is being throttled or fails
+	// verification.
+	throttleAttempts = 5
+
+	// Delay before retrying a throttled transfer, which grows with each
+	// attempt.
+	throttleDelay = time.Second
+)
+
+// A pool hands out reservations for concurrent transfers. A fixed pool
+// always allows the same number of transfers. An adaptive pool starts at
+// its minimum, adds a reservation while aggregate throughput improves and
+// halves on throttling or timeouts (AIMD).
+type pool struct {
+	tokens   chan int
+	adaptive bool
+	min      int
+	max      int
+
+	// retryDelay is the delay before the first retry of a transfer.
+	retryDelay time.Duration
+
+	// size is the number of reservations wanted, retire the number
+	// handed out above that which are dropped as they are released.
+	mu          sync.Mutex
+	size        int
+	retire      int
+	bytes       int64
+	windowStart time.Time
+	throughput  float64
+	backedOff   time.Time
+}
+
+func newPool(concurrent int) *pool {
+	p := &pool{
+		tokens:     make(chan int, concurrent),
+		min:        concurrent,
+		max:        concurrent,
+		size:       concurrent,
+		retryDelay: throttleDelay,
+	}
 
 	for x := 0; x < concurrent; x++ {
-		pool <- 1
+		p.tokens <- 1
+	}
+
+	return p
+}
+
+func newAdaptivePool(min, max int) *pool {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+
+	p := newPool(max)
+	p.adaptive = true
+	p.min = min
+	p.windowStart = time.Now()
+
+	// Start at the minimum by retiring the reservations above it
+	// before any are handed out.
+	for x := min; x < max; x++ {
+		<-p.tokens
+	}
+	p.size = min
+
+	return p
+}
+
+// acquire blocks until a reservation is available or ctx is done.
+func (p *pool) acquire(ctx context.Context) error {
+	select {
+	case <-p.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release returns a reservation, reporting the bytes transferred and the
+// error (if any) of the transfer which held it.
+func (p *pool) release(bytes int64, err error) {
+	if !p.adaptive {
+		p.tokens <- 1
+		return
 	}
 
-	return pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.bytes += bytes
+	if isThrottle(err) {
+		p.backOff()
+	} else {
+		p.sample()
+	}
+
+	if p.retire > 0 {
+		p.retire--
+		return
+	}
+	p.tokens <- 1
+}
+
+// run performs a transfer holding a reservation acquired by the caller
+// and releases it when done. Throttled transfers are retried after giving
+// the pool time to back off, unless ctx is done.
+func (p *pool) run(ctx context.Context, transfer func() (int64, error)) error {
+	for attempt := 1; ; attempt++ {
+		n, err := transfer()
+		p.release(n, err)
+		if err == nil || !(isThrottle(err) || isVerifyFailure(err)) || attempt >= throttleAttempts {
+			return err
+		}
+
+		if isThrottle(err) {
+			log.Warnf("Transfer throttled, retrying (attempt %d): %s", attempt, err.Error())
+		} else {
+			log.Warnf("Transfer failed verification, retrying (attempt %d).", attempt)
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * p.retryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := p.acquire(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *pool) backOff() {
+	// Transfers in flight when throttling began are likely to fail
+	// together, only back off once per window for them.
+	if time.Since(p.backedOff) < adaptiveWindow {
+		return
+	}
+	p.backedOff = time.Now()
+
+	target := p.size / 2
+	if target < p.min {
+		target = p.min
+	}
+	if shrink := p.size - target; shrink > 0 {
+		log.Infof("Throttled, reducing concurrent transfers to '%d'.", target)
+		p.retire += shrink
+		p.size = target
+	}
+
+	// Start a fresh sample after backing off.
+	p.bytes = 0
+	p.throughput = 0
+	p.windowStart = time.Now()
+}
+
+func (p *pool) sample() {
+	elapsed := time.Since(p.windowStart)
+	if elapsed < adaptiveWindow {
+		return
+	}
+
+	throughput := float64(p.bytes) / elapsed.Seconds()
+	if throughput >= p.throughput*adaptiveGrowthFactor && p.size < p.max {
+		p.size++
+		log.Debugf("Throughput %.0f bytes/sec, increasing concurrent transfers to '%d'.", throughput, p.size)
+
+		// Keep a reservation which is due to be retired rather than
+		// adding a new one.
+		if p.retire > 0 {
+			p.retire--
+		} else {
+			p.tokens <- 1
+		}
+	}
+
+	p.throughput = throughput
+	p.bytes = 0
+	p.windowStart = time.Now()
+}
+
+// isThrottle reports whether err indicates S3 is asking us to slow down
+// or the transfer timed out.
+func isThrottle(err error) bool {
+	switch e := err.(type) {
+	case *s3.Error:
+		return e.StatusCode == 503 || e.Code == "SlowDown"
+	case net.Error:
+		return e.Timeout()
+	}
+	return false
 }
@@ -0,0 +1,97 @@
+package gosync
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+)
+
+func TestFixedPool(t *testing.T) {
+	p := newPool(3)
+	for x := 0; x < 3; x++ {
+		p.acquire(context.Background())
+	}
+	if len(p.tokens) != 0 {
+		t.Fatalf("Expected all reservations to be taken.")
+	}
+
+	p.release(10, &s3.Error{StatusCode: 503, Code: "SlowDown"})
+	if len(p.tokens) != 1 {
+		t.Fatalf("Fixed pool should not shrink when throttled.")
+	}
+}
+
+func TestAdaptivePoolBacksOff(t *testing.T) {
+	p := newAdaptivePool(2, 16)
+	p.size = 16
+	for x := 2; x < 16; x++ {
+		p.tokens <- 1
+	}
+
+	for x := 0; x < 16; x++ {
+		p.acquire(context.Background())
+	}
+
+	p.release(0, &s3.Error{StatusCode: 503, Code: "SlowDown"})
+	if p.size != 8 {
+		t.Fatalf("Expected pool to halve to 8, got %d.", p.size)
+	}
+
+	for x := 0; x < 15; x++ {
+		p.release(0, nil)
+	}
+	if len(p.tokens) != 8 {
+		t.Fatalf("Expected 8 reservations after backing off, got %d.", len(p.tokens))
+	}
+
+	for x := 0; x < 8; x++ {
+		p.acquire(context.Background())
+	}
+	for x := 0; x < 8; x++ {
+		p.release(0, &s3.Error{StatusCode: 503})
+	}
+	if p.size != 8 || len(p.tokens) != 8 {
+		t.Fatalf("Expected no further back off within a window, got %d.", p.size)
+	}
+
+	for x := 0; x < 8; x++ {
+		p.acquire(context.Background())
+	}
+	for x := 0; x < 8; x++ {
+		p.backedOff = time.Time{}
+		p.release(0, &s3.Error{StatusCode: 503})
+	}
+	if p.size != 2 || len(p.tokens) != 2 {
+		t.Fatalf("Expected pool to stop at its minimum of 2, got %d.", p.size)
+	}
+}
+
+func TestAdaptivePoolGrows(t *testing.T) {
+	p := newAdaptivePool(1, 2)
+	p.acquire(context.Background())
+	p.windowStart = time.Now().Add(-adaptiveWindow)
+	p.release(1024, nil)
+
+	if p.size != 2 || len(p.tokens) != 2 {
+		t.Fatalf("Expected pool to grow to 2, got %d.", p.size)
+	}
+
+	p.acquire(context.Background())
+	p.windowStart = time.Now().Add(-adaptiveWindow)
+	p.release(4096, nil)
+	if p.size != 2 || len(p.tokens) != 2 {
+		t.Fatalf("Pool grew beyond its maximum.")
+	}
+}
+
+func TestIsThrottle(t *testing.T) {
+	if !isThrottle(&s3.Error{StatusCode: 503}) || !isThrottle(&s3.Error{Code: "SlowDown"}) {
+		t.Fatalf("Expected S3 slow down to be throttling.")
+	}
+	if isThrottle(&s3.Error{StatusCode: 404}) || isThrottle(errors.New("x")) || isThrottle(nil) {
+		t.Fatalf("Unexpected throttling error.")
+	}
+}
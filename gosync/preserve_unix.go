@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package gosync
+
+import (
+	"os"
+	"syscall"
+)
+
+// preserveMetadata gives f the mode and, when permitted, the owner of the
+// file described by info.
+func preserveMetadata(f *os.File, info os.FileInfo) error {
+	if err := f.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		err := f.Chown(int(stat.Uid), int(stat.Gid))
+		if err != nil && !os.IsPermission(err) {
+			return err
+		}
+	}
+	return nil
+}
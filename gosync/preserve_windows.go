@@ -0,0 +1,9 @@
+package gosync
+
+import "os"
+
+// preserveMetadata gives f the mode of the file described by info, files
+// on Windows have no owner to preserve.
+func preserveMetadata(f *os.File, info os.FileInfo) error {
+	return f.Chmod(info.Mode().Perm())
+}
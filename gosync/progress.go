@@ -0,0 +1,209 @@
+package gosync
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// Throughput is averaged over this window.
+const progressWindow = 10 * time.Second
+
+// Progress is an EventHandler which tracks the files and bytes completed
+// against those planned, and reports them with the current throughput and
+// estimated time remaining every Interval until the sync finishes. On a
+// terminal the report is a single line redrawn in place, otherwise it is
+// logged. Jobs running in parallel share a Progress, which reports their
+// combined totals until the last of them finishes.
+type Progress struct {
+	Interval time.Duration
+
+	mu           sync.Mutex
+	out          io.Writer
+	tty          bool
+	running      bool
+	stop         chan bool
+	jobs         map[string]bool
+	plannedFiles int
+	doneFiles    int
+	failedFiles  int
+	plannedBytes int64
+	doneBytes    int64
+	samples      []progressSample
+	lineWidth    int
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// NewProgress returns a Progress reporting to out, which is usually
+// os.Stderr.
+func NewProgress(out io.Writer) *Progress {
+	return &Progress{
+		Interval: time.Second,
+		out:      out,
+		tty:      isTerminal(out),
+	}
+}
+
+func (p *Progress) HandleEvent(e Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.running {
+		p.begin()
+	}
+	p.jobs[e.Job] = true
+
+	switch e.Type {
+	case TransferPlanned:
+		p.plannedFiles++
+		p.plannedBytes += e.Size
+	case TransferProgress:
+		p.doneBytes += e.Bytes
+	case TransferFinished:
+		p.doneFiles++
+	case TransferFailed:
+		p.failedFiles++
+	case SyncFinished:
+		delete(p.jobs, e.Job)
+		if len(p.jobs) == 0 {
+			p.end()
+		}
+	}
+}
+
+// String returns the current report.
+func (p *Progress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.line()
+}
+
+func (p *Progress) begin() {
+	p.running = true
+	p.plannedFiles, p.doneFiles, p.failedFiles = 0, 0, 0
+	p.plannedBytes, p.doneBytes = 0, 0
+	p.samples = []progressSample{{at: time.Now()}}
+	p.stop = make(chan bool)
+	p.jobs = map[string]bool{}
+
+	go func(stop chan bool) {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.sample()
+				p.render()
+				p.mu.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}(p.stop)
+}
+
+func (p *Progress) end() {
+	close(p.stop)
+	p.running = false
+	p.sample()
+	p.render()
+	if p.tty {
+		fmt.Fprintln(p.out)
+	}
+}
+
+func (p *Progress) sample() {
+	now := time.Now()
+	p.samples = append(p.samples, progressSample{at: now, bytes: p.doneBytes})
+
+	// Keep one sample older than the window to measure across it.
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) > progressWindow {
+		p.samples = p.samples[1:]
+	}
+}
+
+func (p *Progress) throughput() float64 {
+	if len(p.samples) < 2 {
+		return 0
+	}
+	first, last := p.samples[0], p.samples[len(p.samples)-1]
+	elapsed := last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.bytes-first.bytes) / elapsed
+}
+
+func (p *Progress) line() string {
+	line := fmt.Sprintf("Files %d/%d, %s/%s", p.doneFiles, p.plannedFiles,
+		formatBytes(p.doneBytes), formatBytes(p.plannedBytes))
+	if p.plannedBytes > 0 {
+		line += fmt.Sprintf(" (%d%%)", p.doneBytes*100/p.plannedBytes)
+	}
+	if len(p.jobs) > 1 {
+		line = fmt.Sprintf("Jobs %d, %s", len(p.jobs), line)
+	}
+	if p.failedFiles > 0 {
+		line += fmt.Sprintf(", %d failed", p.failedFiles)
+	}
+
+	rate := p.throughput()
+	line += fmt.Sprintf(", %s/s", formatBytes(int64(rate)))
+	if remaining := p.plannedBytes - p.doneBytes; rate > 0 && remaining > 0 {
+		eta := time.Duration(float64(remaining)/rate) * time.Second
+		line += fmt.Sprintf(", ETA %s", eta)
+	}
+	return line
+}
+
+func (p *Progress) render() {
+	line := p.line()
+	if !p.tty {
+		log.Infof("Progress: %s.", line)
+		return
+	}
+
+	// Pad over the remains of a longer previous line.
+	padding := ""
+	if p.lineWidth > len(line) {
+		padding = strings.Repeat(" ", p.lineWidth-len(line))
+	}
+	p.lineWidth = len(line)
+	fmt.Fprintf(p.out, "\r%s%s", line, padding)
+}
+
+func formatBytes(n int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	size := float64(n)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d%s", n, units[unit])
+	}
+	return fmt.Sprintf("%.1f%s", size, units[unit])
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
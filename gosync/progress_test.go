@@ -0,0 +1,76 @@
+package gosync
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	p := NewProgress(&bytes.Buffer{})
+	p.Interval = time.Hour
+
+	p.HandleEvent(Event{Type: TransferPlanned, Size: 1024})
+	p.HandleEvent(Event{Type: TransferPlanned, Size: 3072})
+	p.HandleEvent(Event{Type: TransferProgress, Bytes: 1024})
+	p.HandleEvent(Event{Type: TransferFinished})
+	p.HandleEvent(Event{Type: TransferProgress, Bytes: 512})
+	p.HandleEvent(Event{Type: TransferProgress, Bytes: -512})
+	p.HandleEvent(Event{Type: TransferFailed, Err: errors.New("failed")})
+
+	line := "Files 1/2, 1.0KB/4.0KB (25%), 1 failed, 0B/s"
+	if p.String() != line {
+		t.Fatalf("Unexpected progress '%s'.", p.String())
+	}
+
+	p.HandleEvent(Event{Type: SyncFinished})
+	if p.running {
+		t.Fatalf("Progress still running after sync finished.")
+	}
+}
+
+func TestProgressSharedByJobs(t *testing.T) {
+	p := NewProgress(&bytes.Buffer{})
+	p.Interval = time.Hour
+
+	p.HandleEvent(Event{Type: TransferPlanned, Job: "a", Size: 1024})
+	p.HandleEvent(Event{Type: TransferPlanned, Job: "b", Size: 1024})
+	p.HandleEvent(Event{Type: TransferProgress, Job: "b", Bytes: 1024})
+	p.HandleEvent(Event{Type: TransferFinished, Job: "b"})
+
+	line := "Jobs 2, Files 1/2, 1.0KB/2.0KB (50%), 0B/s"
+	if p.String() != line {
+		t.Fatalf("Unexpected progress '%s'.", p.String())
+	}
+
+	// The totals are kept until the last job finishes.
+	p.HandleEvent(Event{Type: SyncFinished, Job: "b"})
+	if !p.running || p.String() != "Files 1/2, 1.0KB/2.0KB (50%), 0B/s" {
+		t.Fatalf("Unexpected progress '%s' after the first job finished.", p.String())
+	}
+	p.HandleEvent(Event{Type: SyncFinished, Job: "a"})
+	if p.running {
+		t.Fatalf("Progress still running after all jobs finished.")
+	}
+}
+
+var formatBytesTests = []struct {
+	bytes  int64
+	result string
+}{
+	{0, "0B"},
+	{1023, "1023B"},
+	{1024, "1.0KB"},
+	{1536, "1.5KB"},
+	{5 * 1024 * 1024, "5.0MB"},
+	{3 * 1024 * 1024 * 1024, "3.0GB"},
+}
+
+func TestFormatBytes(t *testing.T) {
+	for _, tc := range formatBytesTests {
+		if formatBytes(tc.bytes) != tc.result {
+			t.Fatalf("Formatted %d as '%s', expected '%s'.", tc.bytes, formatBytes(tc.bytes), tc.result)
+		}
+	}
+}
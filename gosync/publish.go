@@ -0,0 +1,259 @@
+package gosync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// The published manifest of a prefix, and its signature, are kept in the
+// prefix under these names and left out of listings.
+const (
+	publishedManifestName  = ".gosync-manifest.json"
+	publishedSignatureName = ".gosync-manifest.sig"
+)
+
+const publishedManifestVersion = 1
+
+// publishedManifest lists the files synced to a prefix, so that those
+// downloading them can check what they receive.
+type publishedManifest struct {
+	Version int             `json:"version"`
+	Source  string          `json:"source"`
+	Time    time.Time       `json:"time"`
+	Files   []publishedFile `json:"files"`
+}
+
+type publishedFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+}
+
+// publishedKey returns the key of name in prefix.
+func publishedKey(prefix, name string) string {
+	if prefix = strings.Trim(prefix, "/"); prefix == "" {
+		return name
+	}
+	return prefix + "/" + name
+}
+
+// internalKey reports whether key holds data gosync keeps alongside the
+// objects synced, which is never synced itself.
+func internalKey(key string) bool {
+	name := path.Base(key)
+	return strings.HasPrefix(key, partManifestPrefix) ||
+		name == publishedManifestName || name == publishedSignatureName
+}
+
+// publishManifest writes the manifest of the files in the source to the
+// target prefix, signed with the SigningKey when it is set.
+func (s *SyncPair) publishManifest(bucket *s3.Bucket, prefix string) error {
+	files, err := s.loadPublishedFiles(s.Source)
+	if err != nil {
+		return err
+	}
+	manifest := &publishedManifest{
+		Version: publishedManifestVersion,
+		Source:  s.Source,
+		Time:    time.Now().UTC(),
+		Files:   files,
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The signature is written first, so a manifest is never replaced
+	// without it, and fails to verify if the sync is interrupted between
+	// the two.
+	headers := map[string][]string{"Content-Type": {"application/json"}}
+	if s.SigningKey != nil {
+		sig, err := signManifest(s.SigningKey, data)
+		if err != nil {
+			return err
+		}
+		encoded := []byte(base64.StdEncoding.EncodeToString(sig))
+		sigHeaders := map[string][]string{"Content-Type": {"text/plain"}}
+		if err := bucket.PutHeader(publishedKey(prefix, publishedSignatureName), encoded, sigHeaders, s3.Private); err != nil {
+			return err
+		}
+	}
+	if err := bucket.PutHeader(publishedKey(prefix, publishedManifestName), data, headers, s3.Private); err != nil {
+		return err
+	}
+
+	log.Infof("Published manifest of '%d' files to '%s'.", len(files), s3Location(bucket, publishedKey(prefix, publishedManifestName)))
+	return nil
+}
+
+// loadSignedManifest returns the files of the manifest of prefix, by path,
+// once its signature is verified with the PublicKey. Each manifest is
+// loaded once per sync.
+func (s *SyncPair) loadSignedManifest(bucket *s3.Bucket, prefix string) (map[string]publishedFile, error) {
+	location := s3Location(bucket, publishedKey(prefix, publishedManifestName))
+	if files, ok := s.manifests[location]; ok {
+		return files, nil
+	}
+	data, err := bucket.Get(publishedKey(prefix, publishedManifestName))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load manifest '%s': %s", location, err.Error())
+	}
+	encoded, err := bucket.Get(publishedKey(prefix, publishedSignatureName))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load signature of manifest '%s': %s", location, err.Error())
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signature of manifest '%s'.", location)
+	}
+
+	valid, err := verifyManifest(s.PublicKey, data, sig)
+	if err != nil {
+		return nil, err
+	}
+	if !valid {
+		return nil, fmt.Errorf("Signature of manifest '%s' is not valid.", location)
+	}
+
+	manifest := &publishedManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest '%s': %s", location, err.Error())
+	}
+	if manifest.Version != publishedManifestVersion {
+		return nil, fmt.Errorf("Unsupported version '%d' of manifest '%s'.", manifest.Version, location)
+	}
+	log.Infof("Verified signature of manifest '%s'.", location)
+
+	files := map[string]publishedFile{}
+	for _, f := range manifest.Files {
+		files[f.Path] = f
+	}
+	if s.manifests == nil {
+		s.manifests = map[string]map[string]publishedFile{}
+	}
+	s.manifests[location] = files
+	return files, nil
+}
+
+// findSignedManifest returns the prefix of the manifest nearest to key,
+// the one published by the sync of a prefix containing it, and its files
+// once its signature is verified.
+func (s *SyncPair) findSignedManifest(bucket *s3.Bucket, key string) (string, map[string]publishedFile, error) {
+	for prefix := path.Dir(key); ; prefix = path.Dir(prefix) {
+		if prefix == "." || prefix == "/" {
+			prefix = ""
+		}
+		_, found, err := lookupS3Key(bucket, publishedKey(prefix, publishedManifestName))
+		if err != nil {
+			return "", nil, err
+		}
+		if found {
+			files, err := s.loadSignedManifest(bucket, prefix)
+			return prefix, files, err
+		}
+		if prefix == "" {
+			return "", nil, fmt.Errorf("No manifest found for '%s'.", s3Location(bucket, key))
+		}
+	}
+}
+
+// checkManifest drops the downloads planned which do not match the signed
+// manifest, counting them as failed transfers, and has those which do
+// verified against its SHA-256.
+func (s *SyncPair) checkManifest(items []*syncItem, prefix string, files map[string]publishedFile) []*syncItem {
+	checked := []*syncItem{}
+	for _, item := range items {
+		if item.Delete {
+			checked = append(checked, item)
+			continue
+		}
+		file, _ := relativeKey(prefix, item.SourcePath)
+		f, ok := files[file]
+		switch {
+		case !ok:
+			s.refuse(item, errors.New("Not in the manifest."))
+		case f.Size != item.Size:
+			s.refuse(item, errors.New("Size does not match the manifest."))
+		default:
+			item.Checksum = f.SHA256
+			checked = append(checked, item)
+		}
+	}
+	return checked
+}
+
+// refuse fails the transfer of item without starting it.
+func (s *SyncPair) refuse(item *syncItem, err error) {
+	log.Errorf("Refusing '%s': %s", item.Source, err.Error())
+	s.stats.add(0, err)
+	e := item.event(TransferFailed)
+	e.Err = err
+	s.emit(e)
+}
+
+// loadPublishedFiles returns the files below dir which are not excluded,
+// with their size, MD5 and SHA-256, sorted by path.
+func (s *SyncPair) loadPublishedFiles(dir string) ([]publishedFile, error) {
+	files := []publishedFile{}
+	root := filepath.ToSlash(dir)
+	err := walkLocal(dir, s.walkOptions(), func(filePath string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file := relativePath(root, filepath.ToSlash(filePath))
+		if s.excluded(file) {
+			return nil
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		md5er, sha256er := md5.New(), sha256.New()
+		if _, err := io.Copy(io.MultiWriter(md5er, sha256er), f); err != nil {
+			return err
+		}
+
+		files = append(files, publishedFile{
+			Path:   file,
+			Size:   info.Size(),
+			MD5:    fmt.Sprintf("%x", md5er.Sum(nil)),
+			SHA256: fmt.Sprintf("%x", sha256er.Sum(nil)),
+		})
+		return nil
+	})
+	sort.Sort(publishedFiles(files))
+	return files, err
+}
+
+// loadKey parses the key in the file at path.
+func loadKey(file string, parse func(data []byte) ([]byte, error)) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return parse(data)
+}
+
+type publishedFiles []publishedFile
+
+func (f publishedFiles) Len() int           { return len(f) }
+func (f publishedFiles) Less(a, b int) bool { return f[a].Path < f[b].Path }
+func (f publishedFiles) Swap(a, b int)      { f[a], f[b] = f[b], f[a] }
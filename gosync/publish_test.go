@@ -0,0 +1,143 @@
+//go:build go1.13
+// +build go1.13
+
+package gosync
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestParseKeys(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	privDER, _ := x509.MarshalPKCS8PrivateKey(priv)
+	pubDER, _ := x509.MarshalPKIXPublicKey(pub)
+	privPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER})
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER})
+
+	if key, err := ParsePrivateKey(privPEM); err != nil || string(key) != string(priv) {
+		t.Fatalf("Error parsing private key: %v", err)
+	}
+	if key, err := ParsePublicKey(pubPEM); err != nil || string(key) != string(pub) {
+		t.Fatalf("Error parsing public key: %v", err)
+	}
+	if _, err := ParsePrivateKey(pubPEM); err == nil {
+		t.Fatalf("Expected parsing a public key as private to fail.")
+	}
+	if _, err := ParsePublicKey([]byte("not a key")); err == nil {
+		t.Fatalf("Expected parsing garbage to fail.")
+	}
+}
+
+func TestSignedManifest(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+
+	files := map[string]string{"a": "a", "dir/b": "b"}
+	source := testSource(t, files)
+	defer os.RemoveAll(source)
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/release", faultyRegion)
+	up.SigningKey = priv
+	up.Delete = true
+	syncTwice(t, up, len(files))
+	for _, name := range []string{publishedManifestName, publishedSignatureName} {
+		if _, ok := m.get("bucket", publishedKey("release", name)); !ok {
+			t.Fatalf("Expected '%s' to be published.", name)
+		}
+	}
+
+	down := NewSyncPair(aws.Auth{}, "s3://bucket/release", target, faultyRegion)
+	down.retryDelay = time.Millisecond
+	down.PublicKey = pub
+	syncTwice(t, down, len(files))
+	checkLocalFiles(t, filepath.Join(target, "release"), files)
+
+	// Objects changed or added since the manifest was signed are refused.
+	m.put("bucket", "release/a", "x")
+	m.put("bucket", "release/extra", "extra")
+	if err := down.Sync(); err == nil || !isVerifyFailure(err) {
+		t.Fatalf("Expected changed object to fail verification, got '%v'.", err)
+	}
+	checkLocalFiles(t, filepath.Join(target, "release"), files)
+
+	// A manifest not signed by the key is rejected.
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	down.PublicKey = other
+	if err := down.Sync(); err == nil || !strings.Contains(err.Error(), "not valid") {
+		t.Fatalf("Expected invalid signature error, got '%v'.", err)
+	}
+}
+
+func TestSignedManifestRefused(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+
+	source := testSource(t, map[string]string{"a": "a", "dir/b": "b"})
+	defer os.RemoveAll(source)
+	linked := testSource(t, map[string]string{"c": "c"})
+	defer os.RemoveAll(linked)
+	if err := os.Symlink(linked, filepath.Join(source, "link")); err != nil {
+		t.Fatalf("Error creating symlink: %s", err)
+	}
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	// Files below followed symlinks are published as they are uploaded.
+	up := NewSyncPair(aws.Auth{}, source+"/", "s3://bucket/release", faultyRegion)
+	up.SigningKey = priv
+	up.FollowSymlinks = true
+	if err := up.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	m.put("bucket", "release/extra", "extra")
+
+	// Objects not in the manifest fail the sync once the others are
+	// downloaded.
+	down := NewSyncPair(aws.Auth{}, "s3://bucket/release/", target, faultyRegion)
+	down.PublicKey = pub
+	finished := syncFinished(down)
+	if err := down.Sync(); err == nil {
+		t.Fatalf("Expected an error for the object not in the manifest.")
+	}
+	if finished.Files != 3 || finished.Failed != 1 {
+		t.Errorf("Expected 3 files synced and 1 failed, got '%+v'.", finished)
+	}
+	checkLocalFiles(t, target, map[string]string{"a": "a", "dir/b": "b", "link/c": "c"})
+
+	// A single object is checked against the manifest of its prefix.
+	var singleTests = []struct {
+		source string
+		valid  bool
+	}{
+		{"s3://bucket/release/dir/b", true},
+		{"s3://bucket/release/link/c", true},
+		{"s3://bucket/release/extra", false},
+	}
+
+	for _, st := range singleTests {
+		single := NewSyncPair(aws.Auth{}, st.source, filepath.Join(target, "single"), faultyRegion)
+		single.PublicKey = pub
+		err := single.Sync()
+		if st.valid && err != nil {
+			t.Errorf("Error syncing '%s': %s", st.source, err)
+		}
+		if !st.valid && err == nil {
+			t.Errorf("Expected syncing '%s' to fail.", st.source)
+		}
+	}
+}
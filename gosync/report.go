@@ -0,0 +1,83 @@
+package gosync
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Report is an EventHandler collecting the result of each job in a run,
+// from its SyncFinished event, to write them as a combined report.
+type Report struct {
+	mu      sync.Mutex
+	jobs    []string
+	results map[string]Event
+}
+
+// NewReport returns a Report on the named jobs, in the order given.
+func NewReport(jobs []string) *Report {
+	return &Report{jobs: jobs, results: map[string]Event{}}
+}
+
+func (r *Report) HandleEvent(e Event) {
+	if e.Type != SyncFinished {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.results[e.Job] = e
+}
+
+// Failed returns the number of jobs which failed or did not finish.
+func (r *Report) Failed() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	failed := 0
+	for _, job := range r.jobs {
+		if e, ok := r.results[job]; !ok || e.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+// WriteTo writes the report as a table with a line for each job.
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counter := &countingWriter{w: w}
+	tw := tabwriter.NewWriter(counter, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tFILES\tBYTES\tFAILED\tVERIFY FAILED\tDELETED\tDURATION\tRESULT")
+	for _, job := range r.jobs {
+		e, ok := r.results[job]
+		switch {
+		case !ok:
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\t-\tnot run\n", job)
+		default:
+			result := "ok"
+			if e.Err != nil {
+				result = e.Err.Error()
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%d\t%d\t%d\t%s\t%s\n", job, e.Files, formatBytes(e.Bytes),
+				e.Failed, e.VerifyFailures, e.Deleted, e.Duration-e.Duration%time.Millisecond, result)
+		}
+	}
+	err := tw.Flush()
+	return counter.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
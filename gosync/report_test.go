@@ -0,0 +1,29 @@
+package gosync
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReport(t *testing.T) {
+	r := NewReport([]string{"photos", "logs", "backups"})
+	r.HandleEvent(Event{Type: TransferFinished, Job: "photos"})
+	r.HandleEvent(Event{Type: SyncFinished, Job: "photos", Files: 2, Bytes: 2048, VerifyFailures: 1, Duration: 1500 * time.Millisecond})
+	r.HandleEvent(Event{Type: SyncFinished, Job: "logs", Failed: 1, Duration: time.Second, Err: errors.New("denied")})
+
+	buf := &bytes.Buffer{}
+	r.WriteTo(buf)
+	expected := `JOB      FILES  BYTES  FAILED  VERIFY FAILED  DELETED  DURATION  RESULT
+photos   2      2.0KB  0       1              0        1.5s      ok
+logs     0      0B     1       0              0        1s        denied
+backups  -      -      -       -              -        -         not run
+`
+	if buf.String() != expected {
+		t.Fatalf("Unexpected report:\n%s", buf.String())
+	}
+	if r.Failed() != 2 {
+		t.Fatalf("Expected 2 jobs failed, got '%d'.", r.Failed())
+	}
+}
@@ -2,6 +2,10 @@ package gosync
 
 import (
 	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strings"
 
 	log "github.com/cihub/seelog"
@@ -9,6 +13,10 @@ import (
 	"github.com/mitchellh/goamz/s3"
 )
 
+// The metadata recording the ETag of the source of an object copied from
+// S3, when the copy has a different ETag.
+const sourceETagHeader = "X-Amz-Meta-Source-Etag"
+
 type s3Url struct {
 	Url string
 }
@@ -38,34 +46,157 @@ func (r *s3Url) keys() []string {
 	return strings.Split(trimmed_string, "/")
 }
 
-func loadS3Files(bucket *s3.Bucket, path string, files map[string]string, marker string) (map[string]string, error) {
+// loadS3Keys returns the keys below path, by name, listed after marker,
+// leaving out those gosync keeps alongside the objects synced.
+func loadS3Keys(bucket *s3.Bucket, path string, keys map[string]s3.Key, marker string) (map[string]s3.Key, error) {
 	log.Debugf("Loading files from 's3://%s/%s'.", bucket.Name, path)
 	data, err := bucket.List(path, "", marker, 0)
 	if err != nil {
-		return files, err
+		return keys, err
 	}
 
 	for _, key := range data.Contents {
-		md5sum := strings.Trim(key.ETag, "\"")
-		files[key.Key] = md5sum
+		if internalKey(key.Key) {
+			continue
+		}
+		keys[key.Key] = key
 	}
 
-	// Continue to call loadS3files and add
+	// Continue to call loadS3Keys and add
 	// Files to map if next marker set
 	if data.IsTruncated {
 		lastKey := data.Contents[(len(data.Contents) - 1)].Key
 		log.Infof("Results truncated, loading additional files via previous last key '%s'.", lastKey)
-		loadS3Files(bucket, path, files, lastKey)
+		if _, err := loadS3Keys(bucket, path, keys, lastKey); err != nil {
+			return keys, err
+		}
+	}
+
+	log.Debugf("Loaded '%d' files from 's3://%s/%s' succesfully.", len(keys), bucket.Name, path)
+	return keys, nil
+}
+
+// relativeKey returns key relative to the prefix, reporting false when it
+// is not within the prefix.
+func relativeKey(prefix, key string) (string, bool) {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return key, true
+	}
+	if !strings.HasPrefix(key, prefix+"/") {
+		return "", false
+	}
+	return key[len(prefix)+1:], true
+}
+
+// objectHeaders returns the headers of an object uploaded from path, its
+// Content-Type followed by any custom headers.
+func objectHeaders(path string, custom map[string][]string) map[string][]string {
+	headers := map[string][]string{
+		"Content-Type": {mime.TypeByExtension(filepath.Ext(path))},
+	}
+	for name, values := range custom {
+		headers[name] = values
+	}
+	return headers
+}
+
+// checksum returns the ChecksumAlgorithm of the pair, MD5 unless another
+// is set.
+func (s *SyncPair) checksum() *checksumAlgorithm {
+	algorithm, err := lookupChecksumAlgorithm(s.ChecksumAlgorithm)
+	if err != nil {
+		return md5Checksum
+	}
+	return algorithm
+}
+
+// setChecksumHeader stores the checksum of the file at path in the
+// metadata headers of its object, unless the ChecksumAlgorithm is MD5
+// which S3 records in the ETag.
+func (s *SyncPair) setChecksumHeader(headers map[string][]string, path string) error {
+	algorithm := s.checksum()
+	if algorithm == md5Checksum {
+		return nil
+	}
+	sum, err := algorithm.fileSum(path)
+	if err != nil {
+		return err
+	}
+	headers[algorithm.header()] = []string{sum}
+	return nil
+}
+
+// copyChecksumHeaders copies the checksums stored in the metadata of an
+// object to the headers of its copy.
+func copyChecksumHeaders(headers map[string][]string, source http.Header) {
+	for _, algorithm := range checksumAlgorithms {
+		if sum := source.Get(algorithm.header()); sum != "" {
+			headers[algorithm.header()] = []string{sum}
+		}
+	}
+}
+
+// objectChecksum returns the checksum by algorithm stored in the metadata
+// of the object at key, or "" when it has none.
+func objectChecksum(bucket *s3.Bucket, key string, algorithm *checksumAlgorithm) (string, error) {
+	resp, err := bucket.Head(key)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get(algorithm.header()), nil
+}
+
+// matchesObject reports whether the local file at path, whose checksum by
+// the ChecksumAlgorithm is sum, has the content of the object key. MD5 is
+// compared with the ETag, other checksums with the one stored in the
+// object's metadata, and objects without one are taken to differ.
+func (s *SyncPair) matchesObject(bucket *s3.Bucket, key s3.Key, path, sum string) bool {
+	algorithm := s.checksum()
+	if algorithm == md5Checksum {
+		return matchesETag(path, sum, s3Checksum(key), s.PartSize)
 	}
 
-	log.Debugf("Loaded '%d' files from 's3://%s/%s' succesfully.", len(files), bucket.Name, path)
-	return files, nil
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != key.Size {
+		return false
+	}
+	stored, err := objectChecksum(bucket, key.Key, algorithm)
+	if err != nil {
+		log.Debugf("Unable to load the checksum of '%s': %s", s3Location(bucket, key.Key), err.Error())
+		return false
+	}
+	return stored == sum
+}
+
+func s3Checksum(key s3.Key) string {
+	return strings.Trim(key.ETag, "\"")
+}
+
+// bucket returns the named bucket, looking it up only the first time, as
+// without a Region that lists it in every region.
+func (s *SyncPair) bucket(name string) (*s3.Bucket, error) {
+	s.bucketsMu.Lock()
+	defer s.bucketsMu.Unlock()
+	if bucket, ok := s.buckets[name]; ok {
+		return bucket, nil
+	}
+	bucket, err := lookupBucket(name, s.Auth, s.Region)
+	if err != nil {
+		return nil, err
+	}
+	if s.buckets == nil {
+		s.buckets = map[string]*s3.Bucket{}
+	}
+	s.buckets[name] = bucket
+	return bucket, nil
 }
 
 func lookupBucket(bucketName string, auth aws.Auth, region string) (*s3.Bucket, error) {
 	log.Infof("Looking up region for bucket '%s'.", bucketName)
 
-	if(region != "") {
+	if region != "" {
 		log.Debugf("Looking for bucket '%s' in '%s'.", bucketName, region)
 		s3 := s3.New(auth, aws.Regions[region])
 		bucket := s3.Bucket(bucketName)
@@ -22,3 +22,25 @@ func TestValidS3UrlTests(t *testing.T) {
 		}
 	}
 }
+
+func TestRelativeKey(t *testing.T) {
+	var relativeKeyTests = []struct {
+		prefix string
+		key    string
+		rel    string
+		ok     bool
+	}{
+		{"", "a/b", "a/b", true},
+		{"dir", "dir/a", "a", true},
+		{"dir/", "dir/a/b", "a/b", true},
+		{"dir", "dir", "", false},
+		{"dir", "dir-2/a", "", false},
+	}
+
+	for _, tc := range relativeKeyTests {
+		rel, ok := relativeKey(tc.prefix, tc.key)
+		if rel != tc.rel || ok != tc.ok {
+			t.Errorf("Expected '%s' in '%s' to be '%s' '%t', got '%s' '%t'.", tc.key, tc.prefix, tc.rel, tc.ok, rel, ok)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+//go:build go1.13
+// +build go1.13
+
+package gosync
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+)
+
+// ParsePrivateKey returns the ed25519 private key in the PEM encoded
+// PKCS #8 data, as written by "openssl genpkey -algorithm ed25519".
+func ParsePrivateKey(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM encoded key found.")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("Key is not an ed25519 private key.")
+	}
+	return priv, nil
+}
+
+// ParsePublicKey returns the ed25519 public key in the PEM encoded PKIX
+// data, as written by "openssl pkey -pubout".
+func ParsePublicKey(data []byte) ([]byte, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("No PEM encoded key found.")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("Key is not an ed25519 public key.")
+	}
+	return pub, nil
+}
+
+func signManifest(key, data []byte) ([]byte, error) {
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("Invalid ed25519 private key.")
+	}
+	return ed25519.Sign(ed25519.PrivateKey(key), data), nil
+}
+
+func verifyManifest(key, data, sig []byte) (bool, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return false, errors.New("Invalid ed25519 public key.")
+	}
+	return ed25519.Verify(ed25519.PublicKey(key), data, sig), nil
+}
@@ -0,0 +1,24 @@
+//go:build !go1.13
+// +build !go1.13
+
+package gosync
+
+import "errors"
+
+var errSigningUnsupported = errors.New("Signed manifests require Go 1.13 or greater.")
+
+func ParsePrivateKey(data []byte) ([]byte, error) {
+	return nil, errSigningUnsupported
+}
+
+func ParsePublicKey(data []byte) ([]byte, error) {
+	return nil, errSigningUnsupported
+}
+
+func signManifest(key, data []byte) ([]byte, error) {
+	return nil, errSigningUnsupported
+}
+
+func verifyManifest(key, data, sig []byte) (bool, error) {
+	return false, errSigningUnsupported
+}
@@ -0,0 +1,491 @@
+package gosync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// Snapshots are named after the UTC time they were taken, so they sort
+// in the order taken.
+const snapshotTimeFormat = "2006-01-02T150405Z"
+
+const snapshotManifestVersion = 1
+
+// A Snapshot is a point in time copy of a directory, stored under its Name
+// below the snapshot location.
+type Snapshot struct {
+	Name  string
+	Time  time.Time
+	Files int
+	Size  int64
+}
+
+// Retention decides which snapshots are kept when a new one is taken: the
+// newest of each of the last Daily days, Weekly weeks and Monthly months
+// with snapshots. When all are zero every snapshot is kept.
+type Retention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// snapshotManifest lists the files of a snapshot. It is written once all
+// of them are stored, so a snapshot without one is incomplete.
+type snapshotManifest struct {
+	Version int            `json:"version"`
+	Name    string         `json:"name"`
+	Source  string         `json:"source"`
+	Time    time.Time      `json:"time"`
+	Files   []snapshotFile `json:"files"`
+}
+
+type snapshotFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+// TakeSnapshot copies a local source directory to a new snapshot below the
+// S3 target, returning its name. Files unchanged since the previous
+// snapshot are copied from it within S3 rather than uploaded again. Once
+// the snapshot is complete, older snapshots not kept by the Retention
+// policy are deleted.
+func (s *SyncPair) TakeSnapshot(ctx context.Context) (string, error) {
+	if !s.validPair() || s.multipleSources() || validS3Url(s.Source) || !validS3Url(s.Target) {
+		return "", errors.New("Snapshots require a local source directory and S3 target.")
+	}
+	if err := s.validFilters(); err != nil {
+		return "", err
+	}
+	if s.CopySymlinksAsObjects {
+		return "", errors.New("Symlinks can not be copied as objects to snapshots.")
+	}
+	atomic.StoreInt32(&s.stop, 0)
+
+	taken := time.Now().UTC()
+	name := taken.Format(snapshotTimeFormat)
+	err := s.run(ctx, func(ctx context.Context) error {
+		return s.snapshot(ctx, name, taken)
+	})
+	return name, err
+}
+
+func (s *SyncPair) snapshot(ctx context.Context, name string, taken time.Time) error {
+	s3url := newS3Url(s.Target)
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+	base := s3url.Key()
+
+	complete, incomplete, err := listSnapshots(bucket, base)
+	if err != nil {
+		return err
+	}
+	for _, old := range complete {
+		if old >= name {
+			return fmt.Errorf("Snapshot '%s' already exists.", old)
+		}
+	}
+
+	previous := map[string]snapshotFile{}
+	if len(complete) > 0 {
+		last := complete[len(complete)-1]
+		manifest, err := loadSnapshotManifest(bucket, base, last)
+		if err != nil {
+			return err
+		}
+		for _, f := range manifest.Files {
+			previous[f.Path] = f
+		}
+		log.Infof("Reusing files unchanged since snapshot '%s'.", last)
+	}
+
+	// Manifests record the MD5 of each file whatever the
+	// ChecksumAlgorithm, which only applies to the objects uploaded.
+	s.emit(Event{Type: ListStarted, Source: s.Source})
+	files, err := loadLocalChecksums(s.Source, md5Checksum, s.walkOptions())
+	if err != nil {
+		return err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.Source, Files: len(files)})
+
+	manifest := &snapshotManifest{Version: snapshotManifestVersion, Name: name, Source: s.Source, Time: taken}
+	items := []*syncItem{}
+	copies := map[*syncItem]bool{}
+	for file, sum := range files {
+		if s.excluded(file) {
+			continue
+		}
+
+		item := s.snapshotItem(bucket, base, name, file, sum)
+		if old, ok := previous[file]; ok && old.MD5 == sum {
+			item.SourcePath = snapshotKey(base, complete[len(complete)-1], file)
+			item.Source = s3Location(bucket, item.SourcePath)
+			copies[item] = true
+		}
+		items = append(items, item)
+		manifest.Files = append(manifest.Files, snapshotFile{Path: file, Size: item.Size, MD5: sum})
+	}
+	sort.Sort(snapshotFiles(manifest.Files))
+
+	err = s.transfer(ctx, items, func(ctx context.Context, item *syncItem) (int64, error) {
+		if !copies[item] {
+			return s.writeLocalFileToS3(ctx, bucket, item)
+		}
+		err := bucket.Copy(item.SourcePath, item.TargetPath, s3.Private)
+		if err == nil {
+			return 0, nil
+		}
+		// Objects too large to copy in a single request are uploaded.
+		log.Warnf("Unable to copy %s, uploading it: %s", item.Source, err.Error())
+		item.SourcePath = strings.Join([]string{s.Source, item.Key}, "/")
+		return s.writeLocalFileToS3(ctx, bucket, item)
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	headers := map[string][]string{"Content-Type": {"application/json"}}
+	if err := bucket.PutHeader(snapshotManifestKey(base, name), data, headers, s3.Private); err != nil {
+		return err
+	}
+	log.Infof("Snapshot '%s' complete with '%d' files.", name, len(manifest.Files))
+
+	return s.pruneSnapshots(ctx, bucket, base, append(complete, name), incomplete)
+}
+
+// snapshotItem plans storing file, relative to the source directory, in
+// the named snapshot.
+func (s *SyncPair) snapshotItem(bucket *s3.Bucket, base, name, file, sum string) *syncItem {
+	filePath := strings.Join([]string{s.Source, file}, "/")
+	key := snapshotKey(base, name, file)
+	item := &syncItem{
+		Key:        file,
+		Source:     filePath,
+		Target:     s3Location(bucket, key),
+		SourcePath: filePath,
+		TargetPath: key,
+		Checksum:   sum,
+	}
+	if info, err := os.Stat(filePath); err == nil {
+		item.Size = info.Size()
+	}
+	return item
+}
+
+// pruneSnapshots deletes the snapshots not kept by the Retention policy,
+// and any incomplete snapshots older than the newest.
+func (s *SyncPair) pruneSnapshots(ctx context.Context, bucket *s3.Bucket, base string, complete, incomplete []string) error {
+	if s.Retention == (Retention{}) {
+		return nil
+	}
+
+	newest := complete[len(complete)-1]
+	keep := s.Retention.keep(complete)
+	prune := []string{}
+	manifests := map[string]bool{}
+	for _, name := range complete {
+		if !keep[name] {
+			prune = append(prune, name)
+			manifests[name] = true
+		}
+	}
+	for _, name := range incomplete {
+		if name < newest {
+			prune = append(prune, name)
+		}
+	}
+
+	for _, name := range prune {
+		prefix := snapshotKey(base, name, "")
+		keys, err := loadS3Keys(bucket, prefix, make(map[string]s3.Key), "")
+		if err != nil {
+			return err
+		}
+
+		// The manifest is deleted in the first batch, so a partly deleted
+		// snapshot is no longer listed as complete.
+		items := []*syncItem{}
+		if manifests[name] {
+			key := snapshotManifestKey(base, name)
+			items = append(items, deletionItem(name+".json", s3Location(bucket, key), key))
+		}
+		for key := range keys {
+			if file, ok := relativeKey(prefix, key); ok {
+				items = append(items, deletionItem(file, s3Location(bucket, key), key))
+			}
+		}
+
+		if err := s.delete(ctx, items, func(items []*syncItem) error {
+			return deleteS3Keys(bucket, items)
+		}); err != nil {
+			return err
+		}
+		log.Infof("Pruned snapshot '%s'.", name)
+	}
+	return nil
+}
+
+// keep returns the names of the snapshots to keep, given the names of all
+// of them.
+func (r Retention) keep(names []string) map[string]bool {
+	sorted := append([]string{}, names...)
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+
+	keep := map[string]bool{}
+	periods := []struct {
+		count  int
+		period func(t time.Time) string
+	}{
+		{r.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, p := range periods {
+		seen := map[string]bool{}
+		for _, name := range sorted {
+			t, err := time.Parse(snapshotTimeFormat, name)
+			if err != nil {
+				continue
+			}
+			period := p.period(t)
+			if seen[period] {
+				continue
+			}
+			if len(seen) == p.count {
+				break
+			}
+			seen[period] = true
+			keep[name] = true
+		}
+	}
+	return keep
+}
+
+// Snapshots returns the complete snapshots at the S3 location of the pair,
+// its target when taking snapshots or its source when restoring them,
+// oldest first.
+func (s *SyncPair) Snapshots() ([]Snapshot, error) {
+	location := s.Target
+	if validS3Url(s.Source) {
+		location = s.Source
+	}
+	if !validS3Url(location) {
+		return nil, errors.New("Snapshots require an S3 location.")
+	}
+
+	s3url := newS3Url(location)
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return nil, err
+	}
+	names, _, err := listSnapshots(bucket, s3url.Key())
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []Snapshot{}
+	for _, name := range names {
+		manifest, err := loadSnapshotManifest(bucket, s3url.Key(), name)
+		if err != nil {
+			return nil, err
+		}
+		snapshot := Snapshot{Name: name, Time: manifest.Time, Files: len(manifest.Files)}
+		for _, f := range manifest.Files {
+			snapshot.Size += f.Size
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, nil
+}
+
+// RestoreSnapshot restores the named snapshot, or the newest when name is
+// "latest", from the S3 source to a local target directory. Files already
+// matching the snapshot are left alone, and when Delete is set files not in
+// the snapshot are deleted.
+func (s *SyncPair) RestoreSnapshot(ctx context.Context, name string) error {
+	if !s.validPair() || s.multipleSources() || !validS3Url(s.Source) || validS3Url(s.Target) {
+		return errors.New("Restoring a snapshot requires an S3 source and local target directory.")
+	}
+	if err := s.validFilters(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&s.stop, 0)
+
+	return s.run(ctx, func(ctx context.Context) error {
+		return s.restore(ctx, name)
+	})
+}
+
+func (s *SyncPair) restore(ctx context.Context, name string) error {
+	s3url := newS3Url(s.Source)
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+	base := s3url.Key()
+
+	if name == "latest" {
+		names, _, err := listSnapshots(bucket, base)
+		if err != nil {
+			return err
+		}
+		if len(names) == 0 {
+			return fmt.Errorf("No snapshots found in '%s'.", s.Source)
+		}
+		name = names[len(names)-1]
+	}
+
+	manifest, err := loadSnapshotManifest(bucket, base, name)
+	if err != nil {
+		return err
+	}
+	log.Infof("Restoring snapshot '%s' to '%s'.", name, s.Target)
+
+	s.emit(Event{Type: ListStarted, Source: s.Target})
+	local := map[string]string{}
+	if pathExists(s.Target) {
+		if local, err = loadLocalChecksums(s.Target, md5Checksum, s.walkOptions()); err != nil {
+			return err
+		}
+	}
+	s.emit(Event{Type: ListFinished, Source: s.Target, Files: len(local)})
+
+	items := []*syncItem{}
+	inSnapshot := map[string]bool{}
+	for _, f := range manifest.Files {
+		inSnapshot[f.Path] = true
+		if s.excluded(f.Path) || local[f.Path] == f.MD5 {
+			continue
+		}
+		key := snapshotKey(base, name, f.Path)
+		filePath := strings.Join([]string{s.Target, f.Path}, "/")
+		items = append(items, &syncItem{
+			Key:        f.Path,
+			Source:     s3Location(bucket, key),
+			Target:     filePath,
+			SourcePath: key,
+			TargetPath: filePath,
+			Size:       f.Size,
+			Checksum:   f.MD5,
+		})
+	}
+	if s.Delete {
+		for file := range local {
+			if !inSnapshot[file] && !s.excluded(file) {
+				items = append(items, localDeletionItem(s.Target, file))
+			}
+		}
+	}
+
+	return s.transferToDir(ctx, bucket, items)
+}
+
+// listSnapshots returns the names of the complete and incomplete snapshots
+// below base, oldest first.
+func listSnapshots(bucket *s3.Bucket, base string) (complete, incomplete []string, err error) {
+	prefix := snapshotKey(base, "", "")
+	manifests := map[string]bool{}
+	prefixes := map[string]bool{}
+
+	for marker := ""; ; {
+		data, err := bucket.List(prefix, "/", marker, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range data.Contents {
+			name := strings.TrimSuffix(strings.TrimPrefix(key.Key, prefix), ".json")
+			if _, err := time.Parse(snapshotTimeFormat, name); err == nil {
+				manifests[name] = true
+			}
+			marker = key.Key
+		}
+		for _, p := range data.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+			if _, err := time.Parse(snapshotTimeFormat, name); err == nil {
+				prefixes[name] = true
+			}
+			if p > marker {
+				marker = p
+			}
+		}
+		if !data.IsTruncated {
+			break
+		}
+	}
+
+	for name := range manifests {
+		complete = append(complete, name)
+	}
+	for name := range prefixes {
+		if !manifests[name] {
+			incomplete = append(incomplete, name)
+		}
+	}
+	sort.Strings(complete)
+	sort.Strings(incomplete)
+	return complete, incomplete, nil
+}
+
+func loadSnapshotManifest(bucket *s3.Bucket, base, name string) (*snapshotManifest, error) {
+	data, err := bucket.Get(snapshotManifestKey(base, name))
+	if err != nil {
+		if e, ok := err.(*s3.Error); ok && e.StatusCode == 404 {
+			return nil, fmt.Errorf("Snapshot '%s' not found.", name)
+		}
+		return nil, err
+	}
+
+	manifest := &snapshotManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("Invalid manifest of snapshot '%s': %s", name, err.Error())
+	}
+	if manifest.Version != snapshotManifestVersion {
+		return nil, fmt.Errorf("Unsupported manifest version '%d' of snapshot '%s'.", manifest.Version, name)
+	}
+	return manifest, nil
+}
+
+// snapshotKey returns the key of file in the named snapshot below base.
+// Without a file it is the prefix of the snapshot, and without a name the
+// prefix of all snapshots.
+func snapshotKey(base, name, file string) string {
+	prefix := strings.Trim(base, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	if name == "" {
+		return prefix
+	}
+	return prefix + name + "/" + file
+}
+
+// snapshotManifestKey returns the key of the manifest of the named
+// snapshot, alongside its files.
+func snapshotManifestKey(base, name string) string {
+	return snapshotKey(base, "", "") + name + ".json"
+}
+
+type snapshotFiles []snapshotFile
+
+func (f snapshotFiles) Len() int           { return len(f) }
+func (f snapshotFiles) Less(a, b int) bool { return f[a].Path < f[b].Path }
+func (f snapshotFiles) Swap(a, b int)      { f[a], f[b] = f[b], f[a] }
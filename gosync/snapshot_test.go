@@ -0,0 +1,216 @@
+package gosync
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestRetentionKeep(t *testing.T) {
+	names := []string{
+		"2014-04-30T020000Z",
+		"2014-05-31T020000Z",
+		"2014-06-01T020000Z", // Sunday
+		"2014-06-02T020000Z",
+		"2014-06-02T120000Z",
+		"2014-06-03T020000Z",
+	}
+
+	var retentionTests = []struct {
+		retention Retention
+		keep      []string
+	}{
+		{Retention{Daily: 1}, []string{"2014-06-03T020000Z"}},
+		{Retention{Daily: 2}, []string{"2014-06-02T120000Z", "2014-06-03T020000Z"}},
+		{Retention{Weekly: 2}, []string{"2014-06-01T020000Z", "2014-06-03T020000Z"}},
+		{Retention{Monthly: 3}, []string{"2014-04-30T020000Z", "2014-05-31T020000Z", "2014-06-03T020000Z"}},
+		{Retention{Daily: 1, Monthly: 2}, []string{"2014-05-31T020000Z", "2014-06-03T020000Z"}},
+		{Retention{Daily: 10}, []string{"2014-04-30T020000Z", "2014-05-31T020000Z", "2014-06-01T020000Z", "2014-06-02T120000Z", "2014-06-03T020000Z"}},
+	}
+
+	for _, rt := range retentionTests {
+		keep := []string{}
+		for name := range rt.retention.keep(names) {
+			keep = append(keep, name)
+		}
+		sort.Strings(keep)
+		if !reflect.DeepEqual(keep, rt.keep) {
+			t.Errorf("Expected %+v to keep '%v', got '%v'.", rt.retention, rt.keep, keep)
+		}
+	}
+}
+
+// putSnapshot stores a complete snapshot of files directly in S3.
+func putSnapshot(m *testBuckets, bucket, base, name string, files map[string]string) {
+	manifest := snapshotManifest{Version: snapshotManifestVersion, Name: name}
+	for file, data := range files {
+		m.put(bucket, snapshotKey(base, name, file), data)
+		sum := fmt.Sprintf("%x", md5.Sum([]byte(data)))
+		manifest.Files = append(manifest.Files, snapshotFile{Path: file, Size: int64(len(data)), MD5: sum})
+	}
+	data, _ := json.Marshal(manifest)
+	m.put(bucket, snapshotManifestKey(base, name), string(data))
+}
+
+func TestTakeSnapshot(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+	putSnapshot(m, "bucket", "backups", "2014-06-01T020000Z", map[string]string{"a": "a", "b": "old"})
+
+	source := testSource(t, map[string]string{"a": "a", "b": "new", "dir/c": "c"})
+	defer os.RemoveAll(source)
+
+	sp := NewSyncPair(aws.Auth{}, source, "s3://bucket/backups", faultyRegion)
+	name, err := sp.TakeSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+
+	// Only the unchanged file is copied, the manifest and others are put.
+	if f.count("Copy") != 1 || f.count("Put") != 3 {
+		t.Fatalf("Expected 1 copy and 3 puts, got '%v'.", f.calls)
+	}
+	for file, data := range map[string]string{"a": "a", "b": "new", "dir/c": "c"} {
+		if got, _ := m.get("bucket", snapshotKey("backups", name, file)); got != data {
+			t.Fatalf("Expected '%s' in snapshot to be '%s', got '%s'.", file, data, got)
+		}
+	}
+
+	snapshots, err := sp.Snapshots()
+	if err != nil {
+		t.Fatalf("Error listing snapshots: %s", err)
+	}
+	if len(snapshots) != 2 || snapshots[1].Name != name || snapshots[1].Files != 3 || snapshots[1].Size != 5 {
+		t.Fatalf("Unexpected snapshots '%+v'.", snapshots)
+	}
+}
+
+func TestTakeSnapshotPrunes(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+	putSnapshot(m, "bucket", "", "2014-05-01T020000Z", map[string]string{"a": "a"})
+	putSnapshot(m, "bucket", "", "2014-06-01T020000Z", map[string]string{"a": "a"})
+	putSnapshot(m, "bucket", "", "2014-06-02T020000Z", map[string]string{"a": "a"})
+	m.put("bucket", "2014-06-02T120000Z/a", "incomplete")
+	m.put("bucket", "other/a", "other")
+
+	source := testSource(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(source)
+
+	sp := NewSyncPair(aws.Auth{}, source, "s3://bucket", faultyRegion)
+	sp.Retention = Retention{Daily: 2}
+	name, err := sp.TakeSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+
+	expected := []string{
+		"2014-06-02T020000Z.json", "2014-06-02T020000Z/a",
+		name + ".json", name + "/a",
+		"other/a",
+	}
+	sort.Strings(expected)
+	if keys := m.keys("bucket"); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("Expected '%v' to remain, got '%v'.", expected, keys)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+	putSnapshot(m, "bucket", "backups", "2014-06-01T020000Z", map[string]string{"a": "first", "dir/b": "b"})
+	putSnapshot(m, "bucket", "backups", "2014-06-02T020000Z", map[string]string{"a": "second"})
+
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	sp := NewSyncPair(aws.Auth{}, "s3://bucket/backups", target, faultyRegion)
+	if err := sp.RestoreSnapshot(context.Background(), "2014-06-01T020000Z"); err != nil {
+		t.Fatalf("Error restoring snapshot: %s", err)
+	}
+	checkLocalFiles(t, target, map[string]string{"a": "first", "dir/b": "b"})
+
+	sp.Delete = true
+	if err := sp.RestoreSnapshot(context.Background(), "latest"); err != nil {
+		t.Fatalf("Error restoring snapshot: %s", err)
+	}
+	checkLocalFiles(t, target, map[string]string{"a": "second"})
+
+	if err := sp.RestoreSnapshot(context.Background(), "2014-01-01T000000Z"); err == nil {
+		t.Fatalf("Expected restoring a missing snapshot to fail.")
+	}
+	if _, err := os.Stat(filepath.Join(target, "a")); err != nil {
+		t.Fatalf("Expected failed restore to leave files alone.")
+	}
+}
+
+func TestTakeSnapshotSymlinks(t *testing.T) {
+	m, _, stop := testS3(t, "bucket")
+	defer stop()
+
+	source := testSource(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(source)
+	linked := testSource(t, map[string]string{"b": "b"})
+	defer os.RemoveAll(linked)
+	if err := os.Symlink(linked, filepath.Join(source, "link")); err != nil {
+		t.Fatalf("Error creating symlink: %s", err)
+	}
+
+	// Symlinked directories are skipped unless followed, as in a sync,
+	// with the MD5 recorded whatever the checksum algorithm.
+	sp := NewSyncPair(aws.Auth{}, source, "s3://bucket/skipped", faultyRegion)
+	sp.ChecksumAlgorithm = "sha256"
+	if _, err := sp.TakeSnapshot(context.Background()); err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+	sp = NewSyncPair(aws.Auth{}, source, "s3://bucket/followed", faultyRegion)
+	sp.ChecksumAlgorithm = "sha256"
+	sp.FollowSymlinks = true
+	name, err := sp.TakeSnapshot(context.Background())
+	if err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+	if got, _ := m.get("bucket", snapshotKey("followed", name, "link/b")); got != "b" {
+		t.Fatalf("Expected 'link/b' in snapshot, got '%s'.", got)
+	}
+
+	var snapshotTests = []struct {
+		base  string
+		files int
+	}{
+		{"skipped", 1},
+		{"followed", 2},
+	}
+
+	for _, st := range snapshotTests {
+		snapshots, err := NewSyncPair(aws.Auth{}, "s3://bucket/"+st.base, "", faultyRegion).Snapshots()
+		if err != nil || len(snapshots) != 1 || snapshots[0].Files != st.files {
+			t.Errorf("Expected a snapshot of '%d' files in '%s', got '%+v' '%v'.", st.files, st.base, snapshots, err)
+		}
+	}
+
+	// Restoring leaves the followed files matching the snapshot alone.
+	down := NewSyncPair(aws.Auth{}, "s3://bucket/followed", source, faultyRegion)
+	down.FollowSymlinks = true
+	finished := syncFinished(down)
+	if err := down.RestoreSnapshot(context.Background(), "latest"); err != nil {
+		t.Fatalf("Error restoring snapshot: %s", err)
+	}
+	if finished.Files != 0 {
+		t.Errorf("Expected nothing restored, got '%+v'.", finished)
+	}
+
+	sp.CopySymlinksAsObjects, sp.FollowSymlinks = true, false
+	if _, err := sp.TakeSnapshot(context.Background()); err == nil {
+		t.Fatalf("Expected error copying symlinks as objects to a snapshot.")
+	}
+}
@@ -0,0 +1,208 @@
+package gosync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// A source or target of "-" streams a single object from standard input
+// or to standard output.
+const stdio = "-"
+
+// Standard input and output, replaced in tests.
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+// A streamError is the error of a transfer from standard input or to
+// standard output, which can not be read or written again to retry it.
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string {
+	return e.err.Error()
+}
+
+// streams reports whether the pair streams from standard input or to
+// standard output.
+func (s *SyncPair) streams() bool {
+	return s.Source == stdio || s.Target == stdio
+}
+
+// syncStream uploads standard input to the S3 key of the Target, or
+// writes the object at the S3 key of the Source to standard output. The
+// length of standard input is unknown, so it is uploaded in parts of
+// PartSize unless it fits in one. A stream is always transferred, and can
+// not be resumed.
+func (s *SyncPair) syncStream(ctx context.Context) error {
+	location := s.Target
+	if s.Target == stdio {
+		location = s.Source
+	}
+	s3url := newS3Url(location)
+	if s.Source == s.Target || len(s.Sources) > 1 || !validS3Url(location) ||
+		strings.HasSuffix(location, "/") || s3url.Prefix() == "" {
+		return errors.New("Streaming requires an S3 key to read or write.")
+	}
+	if err := s.discardJournal(); err != nil {
+		return err
+	}
+
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+	key := strings.TrimLeft(s3url.Key(), "/")
+	item := &syncItem{
+		Key:        baseName(location),
+		Source:     s.Source,
+		Target:     s.Target,
+		SourcePath: s.Source,
+		TargetPath: s.Target,
+	}
+
+	if s.Source == stdio {
+		item.TargetPath = key
+		return s.transfer(ctx, []*syncItem{item}, func(ctx context.Context, item *syncItem) (int64, error) {
+			n, err := s.writeStreamToS3(ctx, bucket, item, stdin)
+			if err != nil {
+				return n, &streamError{err: err}
+			}
+			return n, nil
+		})
+	}
+
+	object, found, err := lookupS3Key(bucket, key)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("Source object not found.")
+	}
+	item.SourcePath, item.Size, item.Checksum = key, object.Size, s3Checksum(object)
+	return s.transfer(ctx, []*syncItem{item}, func(ctx context.Context, item *syncItem) (int64, error) {
+		n, err := s.writeS3FileToStream(ctx, bucket, item)
+		if err != nil {
+			return n, &streamError{err: err}
+		}
+		return n, nil
+	})
+}
+
+// writeStreamToS3 uploads r, of unknown length, to the key of item, in a
+// single request when it is no longer than PartSize and otherwise in parts.
+func (s *SyncPair) writeStreamToS3(ctx context.Context, bucket *s3.Bucket, item *syncItem, r io.Reader) (int64, error) {
+	partSize := s.PartSize
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	buf := make([]byte, partSize)
+	headers := objectHeaders(item.TargetPath, s.Headers)
+
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		sum := fmt.Sprintf("%x", md5.Sum(buf[:n]))
+		headers["Content-MD5"] = []string{contentMD5(sum)}
+		body := s.reader(ctx, item, bytes.NewReader(buf[:n]))
+		if err := bucket.PutReaderHeader(item.TargetPath, body, int64(n), headers, s3.Private); err != nil {
+			return 0, err
+		}
+		if s.Verify {
+			if err := verifyUpload(bucket, item, sum, int64(n)); err != nil {
+				return 0, err
+			}
+		}
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	multi, err := bucket.InitMultiHeader(item.TargetPath, headers, s3.Private)
+	if err != nil {
+		return 0, err
+	}
+	parts, size, err := s.putStreamParts(ctx, multi, item, r, buf, n)
+	if err == nil {
+		err = multi.Complete(parts)
+	}
+	if err != nil {
+		log.Infof("Aborting upload of '%s'.", item.Target)
+		if aerr := multi.Abort(); aerr != nil {
+			log.Warnf("Error aborting upload of '%s': %s", item.Target, aerr.Error())
+		}
+		return 0, err
+	}
+
+	if s.Verify {
+		etag, err := partsETag(parts)
+		if err == nil {
+			err = verifyUpload(bucket, item, etag, size)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// putStreamParts uploads r in parts, starting with the n bytes already
+// read from it into buf, until it is exhausted.
+func (s *SyncPair) putStreamParts(ctx context.Context, multi *s3.Multi, item *syncItem, r io.Reader, buf []byte, n int) ([]s3.Part, int64, error) {
+	parts := []s3.Part{}
+	size := int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		part, err := multi.PutPart(len(parts)+1, s.partReader(ctx, item, bytes.NewReader(buf[:n])))
+		if err != nil {
+			return nil, 0, err
+		}
+		parts = append(parts, part)
+		size += int64(n)
+
+		n, err = io.ReadFull(r, buf)
+		if err == io.EOF {
+			return parts, size, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, 0, err
+		}
+	}
+}
+
+// writeS3FileToStream writes the object of item to standard output, then
+// checks it against the object's checksum. The object has already been
+// written by then, so a failed check can only be reported.
+func (s *SyncPair) writeS3FileToStream(ctx context.Context, bucket *s3.Bucket, item *syncItem) (int64, error) {
+	body, err := bucket.GetReader(item.SourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	hasher := md5.New()
+	n, err := io.Copy(io.MultiWriter(stdout, hasher), s.reader(ctx, item, body))
+	if err != nil {
+		return 0, err
+	}
+
+	// Only the ETag of an object uploaded in a single request is its MD5.
+	sum := fmt.Sprintf("%x", hasher.Sum(nil))
+	if checksumAlgorithmOf(item.Checksum) == md5Checksum && sum != item.Checksum {
+		return 0, &verifyError{location: item.Target, expected: item.Checksum, actual: sum}
+	}
+	return n, nil
+}
@@ -0,0 +1,82 @@
+package gosync
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func TestSyncStream(t *testing.T) {
+	var streamTests = []struct {
+		data  string
+		puts  int
+		parts int
+	}{
+		{"", 1, 0},
+		{"0123", 1, 0},
+		{"01234567", 0, 1},
+		{"0123456789abcdefghij", 0, 3},
+	}
+
+	in, out := stdin, stdout
+	defer func() {
+		stdin, stdout = in, out
+	}()
+
+	for _, st := range streamTests {
+		m, f, stop := testS3(t, "bucket")
+
+		stdin = strings.NewReader(st.data)
+		up := NewSyncPair(aws.Auth{}, "-", "s3://bucket/dump.sql", faultyRegion)
+		up.PartSize = 8
+		up.Verify = true
+		if err := up.Sync(); err != nil {
+			t.Fatalf("Error streaming '%s': %s", st.data, err)
+		}
+		if data, ok := m.get("bucket", "dump.sql"); !ok || data != st.data {
+			t.Errorf("Expected object '%s', got '%s' '%t'.", st.data, data, ok)
+		}
+		if f.count("Put") != st.puts || f.count("PutPart") != st.parts {
+			t.Errorf("Expected '%s' in '%d' puts and '%d' parts, got '%v'.", st.data, st.puts, st.parts, f.calls)
+		}
+
+		buf := &bytes.Buffer{}
+		stdout = buf
+		down := NewSyncPair(aws.Auth{}, "s3://bucket/dump.sql", "-", faultyRegion)
+		if err := down.Sync(); err != nil || buf.String() != st.data {
+			t.Errorf("Expected to stream '%s', got '%s' '%v'.", st.data, buf.String(), err)
+		}
+		stop()
+	}
+}
+
+func TestSyncStreamErrors(t *testing.T) {
+	_, f, stop := testS3(t, "bucket")
+	defer stop()
+	in := stdin
+	defer func() {
+		stdin = in
+	}()
+
+	for _, pair := range [][2]string{
+		{"-", "-"},
+		{"-", "s3://bucket"},
+		{"-", "s3://bucket/logs/"},
+		{"-", "/tmp/dump.sql"},
+		{"s3://bucket/missing", "-"},
+	} {
+		if err := NewSyncPair(aws.Auth{}, pair[0], pair[1], faultyRegion).Sync(); err == nil {
+			t.Errorf("Expected error streaming '%s' to '%s'.", pair[0], pair[1])
+		}
+	}
+
+	// Standard input can not be read again, so throttled uploads are not
+	// retried.
+	stdin = strings.NewReader("0123")
+	f.inject(throttleOn("Put", 1))
+	if err := NewSyncPair(aws.Auth{}, "-", "s3://bucket/dump.sql", faultyRegion).Sync(); err == nil || f.count("Put") != 1 {
+		t.Errorf("Expected failure without retrying, got '%v' '%v'.", err, f.calls)
+	}
+}
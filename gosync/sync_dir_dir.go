@@ -0,0 +1,243 @@
+package gosync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/cihub/seelog"
+)
+
+func (s *SyncPair) syncDirToDir(ctx context.Context) error {
+	log.Infof("Syncing to local directory.")
+
+	items, err := s.plan(s.planDirToDir)
+	if err != nil {
+		return err
+	}
+
+	transfers, deletions := splitDeletions(items)
+	err = s.transfer(ctx, transfers, s.writeLocalFileToPath)
+	if err != nil {
+		return err
+	}
+
+	return s.delete(ctx, deletions, deleteLocalFiles)
+}
+
+// checkNestedDirs returns an error when the source directory and the
+// directory it is synced into are the same or one is inside the other, as
+// the target would then be copied into itself on every sync, or the source
+// deleted from the target as extra.
+func (s *SyncPair) checkNestedDirs() error {
+	source, err := filepath.Abs(s.Source)
+	if err != nil {
+		return err
+	}
+	target, err := filepath.Abs(s.target())
+	if err != nil {
+		return err
+	}
+	if pathWithin(source, target) || pathWithin(target, source) {
+		return fmt.Errorf("Source '%s' and target '%s' can not be inside one another.", s.Source, s.Target)
+	}
+	return nil
+}
+
+// pathWithin reports whether path is dir or inside it.
+func pathWithin(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (s *SyncPair) planDirToDir() ([]*syncItem, error) {
+	s.emit(Event{Type: ListStarted, Source: s.Source})
+	opts := walkOptions{followSymlinks: s.FollowSymlinks, symlinks: s.CopySymlinksAsObjects}
+	sourceFiles, err := loadLocalChecksums(s.Source, s.checksum(), opts)
+	if err != nil {
+		return nil, err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.Source, Files: len(sourceFiles)})
+
+	s.emit(Event{Type: ListStarted, Source: s.target()})
+	targetFiles, err := loadLocalChecksums(s.target(), s.checksum(), opts)
+	if err != nil {
+		return nil, err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.target(), Files: len(targetFiles)})
+
+	items := []*syncItem{}
+
+	for file, checksum := range sourceFiles {
+		if s.excluded(file) || targetFiles[file] == checksum {
+			continue
+		}
+
+		sourcePath := strings.Join([]string{s.Source, file}, "/")
+		targetPath := strings.Join([]string{s.target(), file}, "/")
+		info, err := os.Stat(sourcePath)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, &syncItem{
+			Key:        file,
+			Source:     sourcePath,
+			Target:     targetPath,
+			SourcePath: sourcePath,
+			TargetPath: targetPath,
+			Size:       info.Size(),
+			Checksum:   checksum,
+		})
+	}
+
+	links, err := s.planLinksToDir()
+	if err != nil {
+		return nil, err
+	}
+	for file, item := range links {
+		if item != nil {
+			items = append(items, item)
+		}
+		delete(targetFiles, file)
+	}
+
+	if s.Delete {
+		for file, _ := range targetFiles {
+			if _, exists := sourceFiles[file]; !exists && !s.excluded(file) {
+				items = append(items, localDeletionItem(s.target(), file))
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// planLinksToDir plans recreating the symlinks of the source in the
+// target, when they are copied, returning an item for each symlink by
+// name or nil when the target already links to the same path.
+func (s *SyncPair) planLinksToDir() (map[string]*syncItem, error) {
+	items := map[string]*syncItem{}
+	if !s.CopySymlinksAsObjects {
+		return items, nil
+	}
+
+	links, _, err := loadLocalLinks(s.Source, walkOptions{symlinks: true})
+	if err != nil {
+		return nil, err
+	}
+	for file, link := range links {
+		if s.excluded(file) {
+			continue
+		}
+		sourcePath := strings.Join([]string{s.Source, file}, "/")
+		targetPath := strings.Join([]string{s.target(), file}, "/")
+		if current, err := os.Readlink(targetPath); err == nil && current == link {
+			items[file] = nil
+			continue
+		}
+		items[file] = &syncItem{
+			Key:        file,
+			Source:     sourcePath,
+			Target:     targetPath,
+			SourcePath: sourcePath,
+			TargetPath: targetPath,
+			Symlink:    link,
+		}
+	}
+	return items, nil
+}
+
+// writeLocalFileToPath copies, or when HardLink is set links, the file to
+// a temporary file beside its target which is then renamed into place.
+func (s *SyncPair) writeLocalFileToPath(ctx context.Context, item *syncItem) (int64, error) {
+	if item.Symlink != "" {
+		return 0, writeLinkToPath(item)
+	}
+
+	dir := filepath.Dir(item.TargetPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	if s.HardLink {
+		n, err := s.linkLocalFile(item)
+		if err == nil {
+			return n, nil
+		}
+		// Files on different devices cannot be linked, so copy them.
+		log.Debugf("Unable to link '%s', copying it: %s", item.Source, err.Error())
+	}
+
+	src, err := os.Open(item.SourcePath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(dir, ".gosync-")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(f, s.reader(ctx, item, src))
+	if err == nil {
+		if s.PreserveMetadata {
+			err = preserveMetadata(f, info)
+		} else {
+			err = f.Chmod(0644)
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && s.PreserveMetadata {
+		err = os.Chtimes(f.Name(), info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), item.TargetPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// linkLocalFile hard links the file to a temporary name beside its target
+// which is then renamed into place.
+func (s *SyncPair) linkLocalFile(item *syncItem) (int64, error) {
+	info, err := os.Stat(item.SourcePath)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(item.TargetPath), ".gosync-")
+	if err != nil {
+		return 0, err
+	}
+	name := f.Name()
+	f.Close()
+	os.Remove(name)
+
+	if err := os.Link(item.SourcePath, name); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(name, item.TargetPath); err != nil {
+		os.Remove(name)
+		return 0, err
+	}
+
+	s.addProgress(item, info.Size())
+	return info.Size(), nil
+}
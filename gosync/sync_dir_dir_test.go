@@ -0,0 +1,137 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func testDirs(t *testing.T, files map[string]string) (string, string) {
+	source, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatalf("Error creating temp dir.")
+	}
+	target, err := ioutil.TempDir("", "target")
+	if err != nil {
+		t.Fatalf("Error creating temp dir.")
+	}
+
+	for file, data := range files {
+		path := filepath.Join(source, file)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatalf("Error creating temp file.")
+		}
+	}
+	return source, target
+}
+
+func TestSyncDirToDir(t *testing.T) {
+	source, target := testDirs(t, map[string]string{"a": "a", "dir/b": "b", "c.tmp": "c"})
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(target)
+	ioutil.WriteFile(filepath.Join(target, "extra"), []byte("extra"), 0644)
+
+	var finished Event
+	sp := NewSyncPair(aws.Auth{}, source+"/", target, "")
+	sp.Delete = true
+	sp.Exclude = []string{"*.tmp"}
+	sp.EventHandlers = []EventHandler{EventHandlerFunc(func(e Event) {
+		if e.Type == SyncFinished {
+			finished = e
+		}
+	})}
+
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if finished.Files != 2 || finished.Deleted != 1 {
+		t.Fatalf("Expected 2 files synced and 1 deleted, got '%+v'.", finished)
+	}
+
+	files, _ := loadLocalFiles(target)
+	if len(files) != 2 || files["a"] != "0cc175b9c0f1b6a831c399e269772661" || files["dir/b"] == "" {
+		t.Fatalf("Unexpected target files '%v'.", files)
+	}
+	if info, _ := os.Stat(filepath.Join(target, "a")); info.Mode().Perm() != 0644 {
+		t.Fatalf("Expected copy to have mode 0644, got '%s'.", info.Mode())
+	}
+
+	// A second sync has nothing to do.
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+	if finished.Files != 0 || finished.Deleted != 0 {
+		t.Fatalf("Expected nothing synced, got '%+v'.", finished)
+	}
+}
+
+func TestSyncDirToDirNested(t *testing.T) {
+	source, target := testDirs(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(target)
+	os.Mkdir(filepath.Join(source, "sub"), 0755)
+
+	var nestedTests = []struct {
+		source string
+		target string
+	}{
+		{source + "/", filepath.Join(source, "backup")},
+		{source, source + "/"},
+		{source + "/", source},
+		{filepath.Join(source, "sub"), source},
+		{source + "/", filepath.Dir(source)},
+	}
+
+	for _, tc := range nestedTests {
+		sp := NewSyncPair(aws.Auth{}, tc.source, tc.target, "")
+		if err := sp.Sync(); err == nil {
+			t.Errorf("Expected syncing '%s' to '%s' to fail.", tc.source, tc.target)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(source, "backup")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no backup created inside the source.")
+	}
+}
+
+func TestSyncDirToDirHardLink(t *testing.T) {
+	source, target := testDirs(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(target)
+
+	sp := NewSyncPair(aws.Auth{}, source+"/", target, "")
+	sp.HardLink = true
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+
+	sourceInfo, _ := os.Stat(filepath.Join(source, "a"))
+	targetInfo, _ := os.Stat(filepath.Join(target, "a"))
+	if !os.SameFile(sourceInfo, targetInfo) {
+		t.Fatalf("Expected target to be linked to source.")
+	}
+}
+
+func TestSyncDirToDirPreserveMetadata(t *testing.T) {
+	source, target := testDirs(t, map[string]string{"a": "a"})
+	defer os.RemoveAll(source)
+	defer os.RemoveAll(target)
+
+	modTime := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(source, "a"), modTime, modTime)
+
+	sp := NewSyncPair(aws.Auth{}, source+"/", target, "")
+	sp.PreserveMetadata = true
+	if err := sp.Sync(); err != nil {
+		t.Fatalf("Error syncing: %s", err)
+	}
+
+	info, _ := os.Stat(filepath.Join(target, "a"))
+	if info.Mode().Perm() != 0600 || !info.ModTime().Equal(modTime) {
+		t.Fatalf("Expected mode 0600 and time '%s', got '%s' '%s'.", modTime, info.Mode(), info.ModTime())
+	}
+}
@@ -1,96 +1,182 @@
 package gosync
 
 import (
-	"io/ioutil"
-	"mime"
-	"path/filepath"
+	"context"
+	"fmt"
+	"os"
 	"strings"
-	"sync"
 
 	log "github.com/cihub/seelog"
 	"github.com/mitchellh/goamz/s3"
 )
 
-func (s *SyncPair) syncDirToS3() error {
+func (s *SyncPair) syncDirToS3(ctx context.Context) error {
 	log.Infof("Syncing to S3.")
 
-	sourceFiles, err := loadLocalFiles(s.Source)
+	s3url := newS3Url(s.target())
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
 	if err != nil {
 		return err
 	}
 
-	s3url := newS3Url(s.Target)
-	path := s3url.Path()
-
-	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	items, err := s.plan(func() ([]*syncItem, error) {
+		return s.planDirToS3(s3url, bucket)
+	})
 	if err != nil {
 		return err
 	}
 
-	// Load files and do not specify marker to start
-	targetFiles := make(map[string]string)
-	targetFiles, err = loadS3Files(bucket, path, targetFiles, "")
+	if err := s.transferToS3(ctx, bucket, items); err != nil {
+		return err
+	}
+	if s.PublishManifest || s.SigningKey != nil {
+		return s.publishManifest(bucket, s3url.Path())
+	}
+	return nil
+}
+
+// transferToS3 uploads items to bucket, then deletes those to delete.
+func (s *SyncPair) transferToS3(ctx context.Context, bucket *s3.Bucket, items []*syncItem) error {
+	transfers, deletions := splitDeletions(items)
+	err := s.transfer(ctx, transfers, func(ctx context.Context, item *syncItem) (int64, error) {
+		return s.writeLocalFileToS3(ctx, bucket, item)
+	})
 	if err != nil {
 		return err
 	}
 
-	return s.concurrentSyncDirToS3(s3url, bucket, targetFiles, sourceFiles)
+	return s.delete(ctx, deletions, func(items []*syncItem) error {
+		if err := deleteS3Keys(bucket, items); err != nil {
+			return err
+		}
+		if s.Delta {
+			return deletePartManifests(bucket, items)
+		}
+		return nil
+	})
 }
 
-func (s *SyncPair) concurrentSyncDirToS3(s3url s3Url, bucket *s3.Bucket, targetFiles, sourceFiles map[string]string) error {
-	doneChan := newDoneChan(s.Concurrent)
-	pool := newPool(s.Concurrent)
-	var wg sync.WaitGroup
+func (s *SyncPair) planDirToS3(s3url s3Url, bucket *s3.Bucket) ([]*syncItem, error) {
+	s.emit(Event{Type: ListStarted, Source: s.Source})
+	sourceFiles, err := loadLocalChecksums(s.Source, s.checksum(), s.walkOptions())
+	if err != nil {
+		return nil, err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.Source, Files: len(sourceFiles)})
+
+	// Load files and do not specify marker to start
+	s.emit(Event{Type: ListStarted, Source: s.target()})
+	targetKeys, err := loadS3Keys(bucket, s3url.Prefix(), make(map[string]s3.Key), "")
+	if err != nil {
+		return nil, err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.target(), Files: len(targetKeys)})
+
+	items := []*syncItem{}
 
 	for file, _ := range sourceFiles {
-		// ensure the file has no leading slashes to it compares correctly
-		relativeTargetFile := strings.TrimLeft(strings.Join([]string{s3url.Path(), file}, "/"), "/")
-
-		if targetFiles[relativeTargetFile] != sourceFiles[file] {
-			filePath := strings.Join([]string{s.Source, file}, "/")
-			keyPath := strings.Join([]string{s3url.Key(), file}, "/")
-
-			// Get transfer reservation from pool
-			log.Tracef("Requesting reservation for '%s'.", keyPath)
-			<-pool
-			log.Tracef("Retrieved reservation for '%s'.", keyPath)
-
-			log.Infof("Starting sync: %s -> s3://%s/%s", filePath, bucket.Name, file)
-			wg.Add(1)
-			go func(doneChan chan error, filePath string, bucket *s3.Bucket, keyPath string) {
-				defer wg.Done()
-				writeLocalFileToS3Routine(doneChan, filePath, bucket, keyPath)
-				pool <- 1
-			}(doneChan, filePath, bucket, keyPath)
+		if s.excluded(file) {
+			continue
+		}
+
+		filePath := strings.Join([]string{s.Source, file}, "/")
+
+		key, exists := targetKeys[s3Key(s3url.Path(), file)]
+		if !exists || !s.matchesObject(bucket, key, filePath, sourceFiles[file]) {
+			item, err := s.dirToS3Item(s3url, bucket, file, sourceFiles[file])
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
 		}
 	}
 
-	// Wait for all routines to finish
-	wg.Wait()
-	return nil
+	// Symlinks and empty directories may be uploaded as empty objects.
+	linkItems, links, err := s.planLinksToS3(s3url, bucket, targetKeys)
+	if err != nil {
+		return nil, err
+	}
+	items = append(items, linkItems...)
+
+	if s.Delete {
+		for key, _ := range targetKeys {
+			file, ok := relativeKey(s3url.Path(), key)
+			if _, exists := sourceFiles[file]; ok && !exists && !links[file] && !s.excluded(file) {
+				items = append(items, deletionItem(file, s3Location(bucket, key), key))
+			}
+		}
+	}
+
+	return items, nil
 }
 
-func writeLocalFileToS3Routine(doneChan chan error, filePath string, bucket *s3.Bucket, file string) {
-	err := writeLocalFileToS3(bucket, file, filePath)
+// dirToS3Item plans the upload of file, relative to the source directory,
+// with the given checksum.
+func (s *SyncPair) dirToS3Item(s3url s3Url, bucket *s3.Bucket, file string, checksum string) (*syncItem, error) {
+	filePath := strings.Join([]string{s.Source, file}, "/")
+	keyPath := s3Key(s3url.Path(), file)
+
+	info, err := os.Stat(filePath)
 	if err != nil {
-		doneChan <- err
+		return nil, err
 	}
-	log.Infof("Sync completed successfully: %s -> s3://%s/%s.", filePath, bucket.Name, file)
-	doneChan <- nil
+
+	return &syncItem{
+		Key:        file,
+		Source:     filePath,
+		Target:     fmt.Sprintf("s3://%s/%s", bucket.Name, keyPath),
+		SourcePath: filePath,
+		TargetPath: keyPath,
+		Size:       info.Size(),
+		Checksum:   checksum,
+	}, nil
 }
 
-func writeLocalFileToS3(bucket *s3.Bucket, path string, file string) error {
-	contType := mime.TypeByExtension(filepath.Ext(file))
+func (s *SyncPair) writeLocalFileToS3(ctx context.Context, bucket *s3.Bucket, item *syncItem) (int64, error) {
 	Perms := s3.ACL("private")
 
-	data, err := ioutil.ReadFile(file)
+	if item.Symlink != "" || item.Dir {
+		return 0, s.writeLinkToS3(bucket, item)
+	}
+
+	f, err := os.Open(item.SourcePath)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer f.Close()
 
-	if err := bucket.Put(path, data, contType, Perms); err != nil {
-		return err
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
 	}
 
-	return nil
+	if s.MultipartThreshold > 0 && info.Size() >= s.MultipartThreshold {
+		return s.writeLocalFileToS3Multipart(ctx, bucket, item)
+	}
+
+	// S3 rejects a body which does not match its Content-MD5.
+	sum, err := md5Sum(f)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, err
+	}
+
+	body := s.reader(ctx, item, f)
+	headers := objectHeaders(item.SourcePath, s.Headers)
+	headers["Content-MD5"] = []string{contentMD5(sum)}
+	if err := s.setChecksumHeader(headers, item.SourcePath); err != nil {
+		return 0, err
+	}
+	if err := bucket.PutReaderHeader(item.TargetPath, body, info.Size(), headers, Perms); err != nil {
+		return 0, err
+	}
+
+	if s.Verify {
+		if err := verifyUpload(bucket, item, sum, info.Size()); err != nil {
+			return 0, err
+		}
+	}
+	return info.Size(), nil
 }
@@ -0,0 +1,267 @@
+package gosync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// singleSource reports whether the Source names a single file or object,
+// rather than a directory or prefix. An object named by a source without a
+// trailing slash is synced as a single file even if there are also
+// objects below it.
+func (s *SyncPair) singleSource() (bool, error) {
+	if syncContents(s.Source) {
+		return false, nil
+	}
+	if !validS3Url(s.Source) {
+		info, err := os.Stat(s.Source)
+		if err != nil {
+			return false, err
+		}
+		return !info.IsDir(), nil
+	}
+
+	s3url := newS3Url(s.Source)
+	bucket, err := s.bucket(s3url.Bucket())
+	if err != nil {
+		return false, err
+	}
+	_, found, err := lookupS3Key(bucket, s3url.Key())
+	return found, err
+}
+
+// newFileTarget reports whether the Target is a file to create in an
+// existing directory, for a Source which may be a single file.
+func (s *SyncPair) newFileTarget() bool {
+	if s.multipleSources() || validS3Url(s.Target) || syncContents(s.Source) || !pathExists(filepath.Dir(s.Target)) {
+		return false
+	}
+	if validS3Url(s.Source) {
+		return true
+	}
+	info, err := os.Stat(s.Source)
+	return err == nil && !info.IsDir()
+}
+
+// fileTarget returns where the single file Source is written: into the
+// Target under its own name when the Target ends in a slash or is a
+// directory, a bucket or a prefix with objects below it, and otherwise to
+// the Target itself.
+func (s *SyncPair) fileTarget() (string, error) {
+	into := joinLocation(s.Target, baseName(s.Source))
+	if strings.HasSuffix(s.Target, "/") {
+		return into, nil
+	}
+
+	if !validS3Url(s.Target) {
+		if info, err := os.Stat(s.Target); err == nil && info.IsDir() {
+			return into, nil
+		}
+		return s.Target, nil
+	}
+
+	s3url := newS3Url(s.Target)
+	if s3url.Prefix() == "" {
+		return into, nil
+	}
+	bucket, err := s.bucket(s3url.Bucket())
+	if err != nil {
+		return "", err
+	}
+	exists, err := s3PrefixExists(bucket, s3url.Prefix())
+	if err != nil || !exists {
+		return s.Target, err
+	}
+	return into, nil
+}
+
+// syncFile syncs the single file or object at the Source to the file or
+// key fileTarget returns, unless it already has the same content.
+func (s *SyncPair) syncFile(ctx context.Context) error {
+	items, write, err := s.planFile(nil)
+	if err != nil {
+		return err
+	}
+	return s.transfer(ctx, items, write)
+}
+
+// planFile plans the sync of the single file or object at the Source,
+// returning the items to transfer and the writer transferring them. The
+// source object is looked up unless it is given.
+func (s *SyncPair) planFile(object *s3.Key) ([]*syncItem, writer, error) {
+	target, err := s.fileTarget()
+	if err != nil {
+		return nil, nil, err
+	}
+	if target == s.Source {
+		return nil, nil, errors.New("Invalid sync pair.")
+	}
+	log.Infof("Syncing '%s' to '%s'.", s.Source, target)
+
+	name := baseName(s.Source)
+	switch {
+	case validS3Url(s.Source) && validS3Url(target):
+		return s.planS3FileToS3(name, target, object)
+	case validS3Url(s.Source):
+		return s.planS3FileToPath(name, target, object)
+	case validS3Url(target):
+		return s.planLocalFileToS3(name, target)
+	}
+
+	sum, err := s.checksum().fileSum(s.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	items, err := s.plan(func() ([]*syncItem, error) {
+		if existing, err := s.checksum().fileSum(target); err == nil && existing == sum {
+			return nil, nil
+		}
+		item, err := localFileItem(name, s.Source, target, sum)
+		if err != nil {
+			return nil, err
+		}
+		return []*syncItem{item}, nil
+	})
+	return items, s.writeLocalFileToPath, err
+}
+
+func (s *SyncPair) planLocalFileToS3(name, target string) ([]*syncItem, writer, error) {
+	s3url := newS3Url(target)
+	bucket, err := s.bucket(s3url.Bucket())
+	if err != nil {
+		return nil, nil, err
+	}
+	sum, err := s.checksum().fileSum(s.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items, err := s.plan(func() ([]*syncItem, error) {
+		key, found, err := lookupS3Key(bucket, s3url.Key())
+		if err != nil {
+			return nil, err
+		}
+		if found && s.matchesObject(bucket, key, s.Source, sum) {
+			return nil, nil
+		}
+		item, err := localFileItem(name, s.Source, s3Location(bucket, s3url.Key()), sum)
+		if err != nil {
+			return nil, err
+		}
+		item.TargetPath = s3url.Key()
+		return []*syncItem{item}, nil
+	})
+	return items, func(ctx context.Context, item *syncItem) (int64, error) {
+		return s.writeLocalFileToS3(ctx, bucket, item)
+	}, err
+}
+
+func (s *SyncPair) planS3FileToPath(name, target string, object *s3.Key) ([]*syncItem, writer, error) {
+	s3url := newS3Url(s.Source)
+	bucket, err := s.bucket(s3url.Bucket())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items, err := s.plan(func() ([]*syncItem, error) {
+		key, err := sourceObject(bucket, s3url.Key(), object)
+		if err != nil {
+			return nil, err
+		}
+		if sum, err := s.checksum().fileSum(target); err == nil && s.matchesObject(bucket, key, target, sum) {
+			return nil, nil
+		}
+		item := s.s3ToDirItem(bucket, name, key)
+		item.Target, item.TargetPath = target, target
+		if s.PublicKey == nil {
+			return []*syncItem{item}, nil
+		}
+
+		prefix, manifest, err := s.findSignedManifest(bucket, key.Key)
+		if err != nil {
+			return nil, err
+		}
+		return s.checkManifest([]*syncItem{item}, prefix, manifest), nil
+	})
+	return items, func(ctx context.Context, item *syncItem) (int64, error) {
+		return s.writeS3FileToPath(ctx, bucket, item)
+	}, err
+}
+
+func (s *SyncPair) planS3FileToS3(name, target string, object *s3.Key) ([]*syncItem, writer, error) {
+	sourceS3Url, targetS3Url := newS3Url(s.Source), newS3Url(target)
+	sourceBucket, err := s.bucket(sourceS3Url.Bucket())
+	if err != nil {
+		return nil, nil, err
+	}
+	targetBucket, err := s.bucket(targetS3Url.Bucket())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	items, err := s.plan(func() ([]*syncItem, error) {
+		source, err := sourceObject(sourceBucket, sourceS3Url.Key(), object)
+		if err != nil {
+			return nil, err
+		}
+		existing, found, err := lookupS3Key(targetBucket, targetS3Url.Key())
+		if err != nil {
+			return nil, err
+		}
+		if found && sameS3Object(targetBucket, source, existing) {
+			return nil, nil
+		}
+		return []*syncItem{{
+			Key:        name,
+			Source:     s.Source,
+			Target:     target,
+			SourcePath: source.Key,
+			TargetPath: targetS3Url.Key(),
+			Size:       source.Size,
+			Checksum:   s3Checksum(source),
+		}}, nil
+	})
+	return items, func(ctx context.Context, item *syncItem) (int64, error) {
+		return s.writeS3FileToS3(ctx, sourceBucket, targetBucket, item)
+	}, err
+}
+
+// sourceObject returns object when given, and otherwise looks up the
+// source object at key.
+func sourceObject(bucket *s3.Bucket, key string, object *s3.Key) (s3.Key, error) {
+	if object != nil {
+		return *object, nil
+	}
+	found, ok, err := lookupS3Key(bucket, key)
+	if err != nil {
+		return s3.Key{}, err
+	}
+	if !ok {
+		return s3.Key{}, errors.New("Source object not found.")
+	}
+	return found, nil
+}
+
+// localFileItem plans the transfer of the local file at path, named name
+// and with the given checksum, to target.
+func localFileItem(name, path, target, checksum string) (*syncItem, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &syncItem{
+		Key:        name,
+		Source:     path,
+		Target:     target,
+		SourcePath: path,
+		TargetPath: target,
+		Size:       info.Size(),
+		Checksum:   checksum,
+	}, nil
+}
@@ -1,52 +1,377 @@
 package gosync
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	log "github.com/cihub/seelog"
 	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// ErrStopped is returned by a sync which was stopped before all its
+// transfers were started.
+var ErrStopped = errors.New("Sync stopped.")
+
+const (
+	defaultMultipartThreshold = 64 * 1024 * 1024
+	defaultPartSize           = 16 * 1024 * 1024
 )
 
 type SyncPair struct {
-	Auth       aws.Auth
-	Source     string
-	Target     string
-	Concurrent int
-	Region string
+	// Name identifies the sync in events, it is set for jobs loaded from
+	// a config file.
+	Name string
+
+	Auth             aws.Auth
+	Source           string
+	Target           string
+	Concurrent       int
+	MinConcurrent    int
+	Adaptive         bool
+	Region           string
+	BandwidthLimiter *BandwidthLimiter
+	EventHandlers    []EventHandler
+
+	// When Unpack is set the Source is a tar archive, optionally gzipped,
+	// whose entries are synced to the Target, and when Pack is set the
+	// Source is written to the Target as a tar archive.
+	Unpack bool
+	Pack   bool
+
+	// When Sources is set each of them is synced into the Target in
+	// place of the Source. Any source may be a glob, matching local files
+	// or S3 keys.
+	Sources []string
+
+	// Files of at least MultipartThreshold bytes are uploaded in parts of
+	// PartSize, a threshold of 0 disables multipart uploads.
+	MultipartThreshold int64
+	PartSize           int64
+
+	// Uploads are sent with their Content-MD5 and downloads checked
+	// against the checksum listed. When Verify is set each object
+	// uploaded is also checked with a HEAD request.
+	Verify bool
+
+	// Files are compared by the MD5 in the ETag of their objects unless
+	// ChecksumAlgorithm is "sha256" or "crc32c", in which case the
+	// checksum is stored in the metadata of objects uploaded and
+	// compared with that.
+	ChecksumAlgorithm string
+
+	// When Delta is set the MD5 of each part uploaded is recorded in a
+	// part manifest, and uploading a changed file copies the parts which
+	// are unchanged from the object in S3 rather than sending them.
+	Delta bool
+
+	// Files are filtered by the Include and Exclude glob patterns, and
+	// objects uploaded have Headers set, overriding their Content-Type.
+	Include []string
+	Exclude []string
+	Headers map[string][]string
+
+	// Symlinks to files are read through, and symlinked directories are
+	// skipped unless FollowSymlinks is set. With CopySymlinksAsObjects
+	// symlinks are uploaded as empty objects recording the path they link
+	// to, and recreated when downloaded. When DirMarkers is set empty
+	// directories are uploaded as empty objects named "dir/".
+	FollowSymlinks        bool
+	CopySymlinksAsObjects bool
+	DirMarkers            bool
+
+	// When Delete is set files missing from the source are deleted from
+	// the target.
+	Delete bool
+
+	// When watching, files are synced once unchanged for Debounce and
+	// the source is rescanned every RescanInterval, 0 disables rescans.
+	// An S3 source is polled for changes every PollInterval.
+	Debounce       time.Duration
+	RescanInterval time.Duration
+	PollInterval   time.Duration
+
+	// When syncing between local directories files are hard linked
+	// rather than copied when HardLink is set, and copies have the mode,
+	// modification time and, where permitted, owner of their source when
+	// PreserveMetadata is set.
+	HardLink         bool
+	PreserveMetadata bool
+
+	// A two way sync records the state of the last sync at StatePath,
+	// by default in the source directory, and resolves files changed on
+	// both sides with the Conflict policy.
+	StatePath      string
+	Conflict       ConflictPolicy
+	ConflictSuffix string
+
+	// Taking a snapshot prunes the older snapshots not kept by the
+	// Retention policy.
+	Retention Retention
+
+	// When Dedup is set the S3 location is a deduplicated store, holding
+	// each file content once and the tree synced in the named Manifest.
+	Dedup    bool
+	Manifest string
+
+	// When PublishManifest is set syncing to S3 writes a manifest of the
+	// files synced into the target prefix, signed when SigningKey, an
+	// ed25519 private key, is set. Syncing from S3 with PublicKey set
+	// requires a manifest signed with its private key, and refuses files
+	// which do not match it.
+	PublishManifest bool
+	SigningKey      []byte
+	PublicKey       []byte
+
+	// When JournalPath is set the sync is recorded there, so that after
+	// an interruption it can be continued by a sync with Resume set.
+	JournalPath string
+	Resume      bool
+
+	stats   syncStats
+	journal *journal
+	stop    int32
+
+	// retryDelay replaces the throttleDelay before retrying a transfer
+	// when set.
+	retryDelay time.Duration
+
+	bucketsMu sync.Mutex
+	buckets   map[string]*s3.Bucket
+	manifests map[string]map[string]publishedFile
 }
 
 func NewSyncPair(auth aws.Auth, source string, target string, region string) *SyncPair {
 	return &SyncPair{
-		Auth:       auth,
-		Source:     source,
-		Target:     target,
-		Concurrent: 1,
-		Region: region,
+		Auth:               auth,
+		Source:             source,
+		Target:             target,
+		Concurrent:         1,
+		MinConcurrent:      1,
+		Region:             region,
+		MultipartThreshold: defaultMultipartThreshold,
+		PartSize:           defaultPartSize,
+		Debounce:           defaultDebounce,
+		RescanInterval:     defaultRescanInterval,
+		PollInterval:       defaultPollInterval,
+		Conflict:           ConflictNewer,
+		ConflictSuffix:     defaultConflictSuffix,
 	}
 }
 
 func (s *SyncPair) Sync() error {
-	if !s.validPair() {
+	return s.SyncWithContext(context.Background())
+}
+
+// SyncWithContext syncs the pair until ctx is done. Once it is no more
+// transfers are started, those in progress are aborted and ctx's error is
+// returned.
+func (s *SyncPair) SyncWithContext(ctx context.Context) error {
+	atomic.StoreInt32(&s.stop, 0)
+	return s.run(ctx, s.sync)
+}
+
+// run performs a sync with fn, recording it in the journal and reporting
+// its totals once it completes. A pair which is not valid is never synced,
+// nor journalled.
+func (s *SyncPair) run(ctx context.Context, fn func(ctx context.Context) error) error {
+	start := time.Now()
+	s.stats = syncStats{}
+	s.manifests = nil
+
+	err := s.validate()
+	if err == nil {
+		err = s.openJournal()
+	}
+	if err == nil {
+		err = fn(ctx)
+		if err == nil && s.stats.failed > 0 {
+			err = fmt.Errorf("'%d' transfers failed.", s.stats.failed)
+		}
+		if jerr := s.journal.close(err == nil); jerr != nil {
+			log.Warnf("Error closing journal: %s", jerr.Error())
+		}
+		s.journal = nil
+	}
+
+	s.emit(Event{
+		Type:           SyncFinished,
+		Files:          s.stats.files,
+		Bytes:          s.stats.bytes,
+		Failed:         s.stats.failed,
+		Deleted:        s.stats.deleted,
+		Conflicts:      s.stats.conflicts,
+		VerifyFailures: s.stats.verifyFailed,
+		Duration:       time.Since(start),
+		Err:            err,
+	})
+
+	log.Infof("Transferred '%d' files (%s), '%d' failed, '%d' deleted, in %s.",
+		s.stats.files, formatBytes(s.stats.bytes), s.stats.failed, s.stats.deleted, time.Since(start))
+	if s.stats.verifyFailed > 0 {
+		log.Warnf("'%d' transfers failed verification.", s.stats.verifyFailed)
+	}
+	return err
+}
+
+// Stop stops the sync in progress from starting any more transfers. Those
+// already started are allowed to finish, after which the sync returns
+// ErrStopped.
+func (s *SyncPair) Stop() {
+	atomic.StoreInt32(&s.stop, 1)
+}
+
+func (s *SyncPair) stopped() bool {
+	return atomic.LoadInt32(&s.stop) == 1
+}
+
+func (s *SyncPair) openJournal() error {
+	if s.JournalPath == "" {
+		return nil
+	}
+
+	j, err := openJournal(s.JournalPath, s.Source, s.Target, s.Resume)
+	if err != nil {
+		return err
+	}
+	s.journal = j
+	return nil
+}
+
+// discardJournal closes and removes the journal of a sync which can not
+// be resumed.
+func (s *SyncPair) discardJournal() error {
+	if s.journal == nil {
+		return nil
+	}
+	log.Infof("Not journalling sync to '%s', it can not be resumed.", s.Target)
+	err := s.journal.close(true)
+	s.journal = nil
+	return err
+}
+
+func (s *SyncPair) sync(ctx context.Context) error {
+	if s.streams() {
+		return s.syncStream(ctx)
+	}
+	if s.Unpack || s.Pack {
+		return s.syncArchive(ctx)
+	}
+	if s.Dedup && s.multipleSources() {
+		return errors.New("Deduplicated syncs require a single source.")
+	}
+	if s.Dedup {
+		return s.syncDedup(ctx)
+	}
+	if s.multipleSources() {
+		return s.syncSources(ctx)
+	}
+	return s.syncSource(ctx)
+}
+
+// validate returns an error when the pair, its filters or its options are
+// not valid. Streams and archives check their own locations.
+func (s *SyncPair) validate() error {
+	if !s.streams() && !s.Unpack && !s.Pack && !s.validPair() {
 		return errors.New("Invalid sync pair.")
 	}
+	if err := s.validFilters(); err != nil {
+		return err
+	}
+	if _, err := lookupChecksumAlgorithm(s.ChecksumAlgorithm); err != nil {
+		return err
+	}
+	if s.FollowSymlinks && s.CopySymlinksAsObjects {
+		return errors.New("Symlinks can not be both followed and copied as objects.")
+	}
+	return nil
+}
+
+// syncSource syncs the Source, a single file or object or a directory or
+// prefix, to the Target.
+func (s *SyncPair) syncSource(ctx context.Context) error {
+	single, err := s.singleSource()
+	if err != nil {
+		return err
+	}
+	if single {
+		if s.Delete {
+			return errors.New("Delete is not supported when syncing a single file.")
+		}
+		return s.syncFile(ctx)
+	}
+
+	if !validS3Url(s.Source) && !validS3Url(s.Target) {
+		if err := s.checkNestedDirs(); err != nil {
+			return err
+		}
+	}
+
+	// A source synced under its own name has its directory created in a
+	// local target.
+	if !validS3Url(s.Target) {
+		if err := os.MkdirAll(s.target(), 0755); err != nil {
+			return err
+		}
+	}
 
 	if validS3Url(s.Source) && validS3Url(s.Target) {
-		return s.syncS3ToS3()
+		return s.syncS3ToS3(ctx)
 	}
 
 	if validS3Url(s.Source) {
-		return s.syncS3ToDir()
+		return s.syncS3ToDir(ctx)
 	}
 
-	return s.syncDirToS3()
+	if validS3Url(s.Target) {
+		return s.syncDirToS3(ctx)
+	}
+
+	return s.syncDirToDir(ctx)
+}
+
+// walkOptions returns how the local files of a sync with S3 are listed.
+func (s *SyncPair) walkOptions() walkOptions {
+	return walkOptions{
+		followSymlinks: s.FollowSymlinks,
+		symlinks:       s.CopySymlinksAsObjects,
+		emptyDirs:      s.DirMarkers,
+	}
+}
+
+// newPool returns a pool of Concurrent reservations, or when Adaptive is
+// set one which varies between MinConcurrent and Concurrent.
+func (s *SyncPair) newPool() *pool {
+	var p *pool
+	if s.Adaptive {
+		p = newAdaptivePool(s.MinConcurrent, s.Concurrent)
+	} else {
+		p = newPool(s.Concurrent)
+	}
+	if s.retryDelay > 0 {
+		p.retryDelay = s.retryDelay
+	}
+	return p
 }
 
 func (s *SyncPair) validPair() bool {
-	if !validS3Url(s.Source) && !validS3Url(s.Target) {
-		return false
+	for _, source := range s.sources() {
+		if source == s.Target {
+			return false
+		}
+		// Globs matching nothing are warned of when expanded.
+		if !hasGlob(source) && !validTarget(source) {
+			return false
+		}
 	}
 
-	if validTarget(s.Source) && validTarget(s.Target) {
+	if validTarget(s.Target) || s.newFileTarget() {
 		return true
 	}
 	return false
@@ -23,6 +23,11 @@ func TestValidSyncPair(t *testing.T) {
 		}
 	}
 
+	tcFile := tcDir1 + "/file"
+	if err := ioutil.WriteFile(tcFile, []byte("file"), 0644); err != nil {
+		t.Fatalf("Error creating temp file")
+	}
+
 	var syncPairTCs = []struct {
 		source string
 		target string
@@ -31,8 +36,13 @@ func TestValidSyncPair(t *testing.T) {
 		{"s3://b1", "s3://b2", true},
 		{tcDir1, "s3://b2", true},
 		{"s3://b1", tcDir2, true},
-		{tcDir1, tcDir2, false},
+		{tcDir1, tcDir2, true},
+		{tcDir1, tcDir1, false},
 		{"s3://b1", tempDir + "/bad_dir", false},
+		{tcFile, tempDir + "/new_file", true},
+		{"s3://b1/key", tempDir + "/new_file", true},
+		{"s3://b1/key", tempDir + "/bad_dir/new_file", false},
+		{tcDir1, tempDir + "/new_file", false},
 	}
 
 	for _, tc := range syncPairTCs {
@@ -1,17 +1,20 @@
 package gosync
 
 import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 
 	log "github.com/cihub/seelog"
 	"github.com/mitchellh/goamz/s3"
 )
 
-func (s *SyncPair) syncS3ToDir() error {
+func (s *SyncPair) syncS3ToDir(ctx context.Context) error {
 	log.Infof("Syncing from S3.")
 
 	s3url := newS3Url(s.Source)
@@ -20,73 +23,169 @@ func (s *SyncPair) syncS3ToDir() error {
 		return err
 	}
 
-	sourceFiles := make(map[string]string)
-	sourceFiles, err = loadS3Files(bucket, s3url.Path(), sourceFiles, "")
+	items, err := s.plan(func() ([]*syncItem, error) {
+		if s.PublicKey == nil {
+			return s.planS3ToDir(s3url, bucket)
+		}
+
+		manifest, err := s.loadSignedManifest(bucket, s3url.Path())
+		if err != nil {
+			return nil, err
+		}
+		items, err := s.planS3ToDir(s3url, bucket)
+		if err != nil {
+			return nil, err
+		}
+		return s.checkManifest(items, s3url.Path(), manifest), nil
+	})
 	if err != nil {
 		return err
 	}
 
-	targetFiles, err := loadLocalFiles(s.Target)
+	return s.transferToDir(ctx, bucket, items)
+}
+
+// transferToDir downloads items from bucket, then deletes those to delete.
+func (s *SyncPair) transferToDir(ctx context.Context, bucket *s3.Bucket, items []*syncItem) error {
+	transfers, deletions := splitDeletions(items)
+	err := s.transfer(ctx, transfers, func(ctx context.Context, item *syncItem) (int64, error) {
+		return s.writeS3FileToPath(ctx, bucket, item)
+	})
 	if err != nil {
 		return err
 	}
-	return s.concurrentSyncS3ToDir(s3url, bucket, targetFiles, sourceFiles)
+
+	return s.delete(ctx, deletions, deleteLocalFiles)
 }
 
-func (s *SyncPair) concurrentSyncS3ToDir(s3url s3Url, bucket *s3.Bucket, targetFiles, sourceFiles map[string]string) error {
-	doneChan := newDoneChan(s.Concurrent)
-	pool := newPool(s.Concurrent)
-	var wg sync.WaitGroup
-
-	for file, _ := range sourceFiles {
-		if targetFiles[file] != sourceFiles[file] {
-			filePath := strings.Join([]string{s.Target, file}, "/")
-			if filepath.Dir(filePath) != "." {
-				err := os.MkdirAll(filepath.Dir(filePath), 0755)
-				if err != nil {
-					return err
-				}
+func (s *SyncPair) planS3ToDir(s3url s3Url, bucket *s3.Bucket) ([]*syncItem, error) {
+	s.emit(Event{Type: ListStarted, Source: s.Source})
+	sourceKeys, err := loadS3Keys(bucket, s3url.Prefix(), make(map[string]s3.Key), "")
+	if err != nil {
+		return nil, err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.Source, Files: len(sourceKeys)})
+
+	s.emit(Event{Type: ListStarted, Source: s.target()})
+	targetFiles, err := loadLocalChecksums(s.target(), s.checksum(), s.walkOptions())
+	if err != nil {
+		return nil, err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.target(), Files: len(targetFiles)})
+
+	items := []*syncItem{}
+	sourceFiles := map[string]bool{}
+
+	for name, key := range sourceKeys {
+		file, ok := relativeKey(s3url.Prefix(), name)
+		if !ok || s.excluded(file) {
+			continue
+		}
+		sourceFiles[file] = true
+
+		if item, link := s.planLinkToDir(bucket, file, key); link {
+			if item != nil {
+				items = append(items, item)
 			}
+			continue
+		}
+
+		filePath := strings.Join([]string{s.target(), file}, "/")
+		_, exists := targetFiles[file]
+
+		if !exists || !s.matchesObject(bucket, key, filePath, targetFiles[file]) {
+			items = append(items, s.s3ToDirItem(bucket, file, key))
+		}
+	}
 
-			// Get transfer reservation from pool
-			log.Tracef("Requesting reservation for '%s'.", filePath)
-			<-pool
-			log.Tracef("Retrieved reservation for '%s'.", filePath)
-
-			log.Infof("Starting sync: s3://%s/%s -> %s.", bucket.Name, file, filePath)
-			wg.Add(1)
-			go func(doneChan chan error, filePath string, bucket *s3.Bucket, file string) {
-				defer wg.Done()
-				writeS3FileToPathRoutine(doneChan, filePath, bucket, file)
-				pool <- 1
-			}(doneChan, filePath, bucket, file)
+	if s.Delete {
+		for file, _ := range targetFiles {
+			if !sourceFiles[file] && !s.excluded(file) {
+				items = append(items, localDeletionItem(s.target(), file))
+			}
 		}
 	}
 
-	wg.Wait()
-	return nil
+	return items, nil
 }
 
-func writeS3FileToPathRoutine(doneChan chan error, filePath string, bucket *s3.Bucket, file string) {
-	err := writeS3FileToPath(filePath, bucket, file)
-	if err != nil {
-		doneChan <- err
+// s3ToDirItem plans the download of key, named file relative to the source
+// prefix, to the target. It is verified against the checksum stored in its
+// metadata by the ChecksumAlgorithm when it has one, and otherwise its
+// ETag.
+func (s *SyncPair) s3ToDirItem(bucket *s3.Bucket, file string, key s3.Key) *syncItem {
+	filePath := strings.Join([]string{s.target(), file}, "/")
+	item := &syncItem{
+		Key:        file,
+		Source:     s3Location(bucket, key.Key),
+		Target:     filePath,
+		SourcePath: key.Key,
+		TargetPath: filePath,
+		Size:       key.Size,
+		Checksum:   s3Checksum(key),
+	}
+
+	if algorithm := s.checksum(); algorithm != md5Checksum {
+		sum, err := objectChecksum(bucket, key.Key, algorithm)
+		if err != nil {
+			log.Debugf("Unable to load the checksum of '%s': %s", item.Source, err.Error())
+		} else if sum != "" {
+			item.Checksum = sum
+		}
 	}
-	log.Infof("Sync completed successfully: s3://%s/%s -> %s.", bucket.Name, file, filePath)
-	doneChan <- nil
+	return item
 }
 
-func writeS3FileToPath(file string, bucket *s3.Bucket, path string) error {
-	data, err := bucket.Get(path)
+// localDeletionItem plans the deletion of file from the directory dir.
+func localDeletionItem(dir, file string) *syncItem {
+	filePath := strings.Join([]string{dir, file}, "/")
+	return deletionItem(file, filePath, filePath)
+}
+
+func (s *SyncPair) writeS3FileToPath(ctx context.Context, bucket *s3.Bucket, item *syncItem) (int64, error) {
+	if item.Symlink != "" || item.Dir {
+		return 0, writeLinkToPath(item)
+	}
+
+	if filepath.Dir(item.TargetPath) != "." {
+		err := os.MkdirAll(filepath.Dir(item.TargetPath), 0755)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	body, err := bucket.GetReader(item.SourcePath)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer body.Close()
 	perms := os.FileMode(0644)
 
-	err = ioutil.WriteFile(file, data, perms)
+	// Download to a temporary file renamed into place once complete, so
+	// an interrupted download never leaves a partial file.
+	f, err := ioutil.TempFile(filepath.Dir(item.TargetPath), ".gosync-")
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	hasher := md5.New()
+	n, err := io.Copy(io.MultiWriter(f, hasher), s.reader(ctx, item, body))
+	if err == nil {
+		err = s.verifyDownload(f.Name(), fmt.Sprintf("%x", hasher.Sum(nil)), item)
+	}
+	if err == nil {
+		err = f.Chmod(perms)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), item.TargetPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
 	}
 
-	return nil
+	return n, nil
 }
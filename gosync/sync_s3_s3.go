@@ -1,16 +1,14 @@
 package gosync
 
 import (
-	"mime"
-	"path/filepath"
+	"context"
 	"strings"
-	"sync"
 
 	log "github.com/cihub/seelog"
 	"github.com/mitchellh/goamz/s3"
 )
 
-func (s *SyncPair) syncS3ToS3() error {
+func (s *SyncPair) syncS3ToS3(ctx context.Context) error {
 	log.Infof("Syncing from S3 to S3.")
 
 	sourceS3Url := newS3Url(s.Source)
@@ -19,78 +17,123 @@ func (s *SyncPair) syncS3ToS3() error {
 		return err
 	}
 
-	targetS3Url := newS3Url(s.Target)
+	targetS3Url := newS3Url(s.target())
 	targetBucket, err := lookupBucket(targetS3Url.Bucket(), s.Auth, s.Region)
 	if err != nil {
 		return err
 	}
 
-	return s.concurrentSyncS3ToS3(sourceS3Url, targetS3Url, sourceBucket, targetBucket)
-}
-
-func (s *SyncPair) concurrentSyncS3ToS3(sourceS3Url, targetS3Url s3Url, sourceBucket, targetBucket *s3.Bucket) error {
-	doneChan := newDoneChan(s.Concurrent)
-	pool := newPool(s.Concurrent)
-	var wg sync.WaitGroup
-
-	sourceFiles, err := loadS3Files(sourceBucket, sourceS3Url.Path(), make(map[string]string), "")
+	items, err := s.plan(func() ([]*syncItem, error) {
+		return s.planS3ToS3(sourceS3Url, targetS3Url, sourceBucket, targetBucket)
+	})
 	if err != nil {
 		return err
 	}
 
-	targetFiles, err := loadS3Files(targetBucket, targetS3Url.Path(), make(map[string]string), "")
+	transfers, deletions := splitDeletions(items)
+	err = s.transfer(ctx, transfers, func(ctx context.Context, item *syncItem) (int64, error) {
+		return s.writeS3FileToS3(ctx, sourceBucket, targetBucket, item)
+	})
 	if err != nil {
 		return err
 	}
 
-	for file, _ := range sourceFiles {
-		// ensure the file has no leading slashes to it compares correctly
-		relativeTargetFile := strings.TrimLeft(strings.Join([]string{targetS3Url.Path(), file}, "/"), "/")
-
-		if targetFiles[relativeTargetFile] != sourceFiles[file] {
-			sourceKeyPath := file
-			targetKeyPath := strings.Join([]string{targetS3Url.Key(), sourceKeyPath}, "/")
-
-			// Get transfer reservation from pool
-			log.Tracef("Requesting reservation for '%s'.", file)
-			<-pool
-			log.Tracef("Retrieved reservation for '%s'.", file)
-
-			log.Infof("Starting sync: s3://%s/%s -> s3://%s/%s.", sourceBucket.Name, sourceKeyPath, targetBucket.Name, targetKeyPath)
-			wg.Add(1)
-			go func(doneChan chan error, sourceBucket, targetBucket *s3.Bucket, sourceKeyPath, targetKeyPath string) {
-				defer wg.Done()
-				writeS3FileToS3Routine(doneChan, sourceBucket, targetBucket, sourceKeyPath, targetKeyPath)
-				pool <- 1
-			}(doneChan, sourceBucket, targetBucket, sourceKeyPath, targetKeyPath)
+	return s.delete(ctx, deletions, func(items []*syncItem) error {
+		return deleteS3Keys(targetBucket, items)
+	})
+}
+
+func (s *SyncPair) planS3ToS3(sourceS3Url, targetS3Url s3Url, sourceBucket, targetBucket *s3.Bucket) ([]*syncItem, error) {
+	s.emit(Event{Type: ListStarted, Source: s.Source})
+	sourceKeys, err := loadS3Keys(sourceBucket, sourceS3Url.Prefix(), make(map[string]s3.Key), "")
+	if err != nil {
+		return nil, err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.Source, Files: len(sourceKeys)})
+
+	s.emit(Event{Type: ListStarted, Source: s.target()})
+	targetKeys, err := loadS3Keys(targetBucket, targetS3Url.Prefix(), make(map[string]s3.Key), "")
+	if err != nil {
+		return nil, err
+	}
+	s.emit(Event{Type: ListFinished, Source: s.target(), Files: len(targetKeys)})
+
+	items := []*syncItem{}
+
+	for name, key := range sourceKeys {
+		file, ok := relativeKey(sourceS3Url.Prefix(), name)
+		if !ok || s.excluded(file) {
+			continue
+		}
+
+		targetKeyPath := s3Key(targetS3Url.Path(), file)
+		if target, ok := targetKeys[targetKeyPath]; !ok || !sameS3Object(targetBucket, key, target) {
+			items = append(items, &syncItem{
+				Key:        file,
+				Source:     s3Location(sourceBucket, name),
+				Target:     s3Location(targetBucket, targetKeyPath),
+				SourcePath: name,
+				TargetPath: targetKeyPath,
+				Size:       key.Size,
+				Checksum:   s3Checksum(key),
+			})
+		}
+	}
+
+	if s.Delete {
+		for name := range targetKeys {
+			file, ok := relativeKey(targetS3Url.Prefix(), name)
+			if !ok || s.excluded(file) {
+				continue
+			}
+			if _, exists := sourceKeys[s3Key(sourceS3Url.Prefix(), file)]; !exists {
+				items = append(items, deletionItem(file, s3Location(targetBucket, name), name))
+			}
 		}
 	}
 
-	wg.Wait()
-	return nil
+	return items, nil
 }
 
-func writeS3FileToS3Routine(doneChan chan error, sourceBucket, targetBucket *s3.Bucket, sourceKeyPath, targetKeyPath string) {
-	err := writeS3FileToS3(sourceBucket, targetBucket, sourceKeyPath, targetKeyPath)
+// sameS3Object reports whether the target object is a copy of the source.
+// The copy of an object uploaded in parts has a different ETag, so it is
+// compared with the ETag of its source recorded when it was copied.
+func sameS3Object(targetBucket *s3.Bucket, source, target s3.Key) bool {
+	if source.ETag == target.ETag {
+		return true
+	}
+	if !strings.Contains(source.ETag, "-") || source.Size != target.Size {
+		return false
+	}
+
+	resp, err := targetBucket.Head(target.Key)
 	if err != nil {
-		doneChan <- err
+		return false
 	}
-	log.Infof("Sync completed successfully: s3://%s/%s -> s3://%s/%s.", sourceBucket.Name, sourceKeyPath, targetBucket.Name, targetKeyPath)
-	doneChan <- nil
+	resp.Body.Close()
+	return resp.Header.Get(sourceETagHeader) == s3Checksum(source)
 }
 
-func writeS3FileToS3(sourceBucket, targetBucket *s3.Bucket, sourceKeyPath, targetKeyPath string) error {
-	data, err := sourceBucket.Get(sourceKeyPath)
+func (s *SyncPair) writeS3FileToS3(ctx context.Context, sourceBucket, targetBucket *s3.Bucket, item *syncItem) (int64, error) {
+	resp, err := sourceBucket.GetResponse(item.SourcePath)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer resp.Body.Close()
 
-	contType := mime.TypeByExtension(filepath.Ext(sourceKeyPath))
 	Perms := s3.ACL("private")
 
-	if err := targetBucket.Put(targetKeyPath, data, contType, Perms); err != nil {
-		return err
+	// The object streams straight from the source to the target, so it
+	// only passes through the limiter once.
+	body := s.reader(ctx, item, resp.Body)
+	headers := objectHeaders(item.SourcePath, s.Headers)
+	copyChecksumHeaders(headers, resp.Header)
+	if strings.Contains(item.Checksum, "-") {
+		headers[sourceETagHeader] = []string{item.Checksum}
+	}
+	if err := targetBucket.PutReaderHeader(item.TargetPath, body, resp.ContentLength, headers, Perms); err != nil {
+		return 0, err
 	}
 
-	return nil
+	return resp.ContentLength, nil
 }
@@ -0,0 +1,253 @@
+package gosync
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+// A syncItem is a file planned to be transferred, or deleted from the
+// target when Delete is set. Source and Target describe the locations in
+// logs and events, SourcePath and TargetPath are the local paths or keys
+// the transfer reads and writes. A symlink copied as an object has the
+// path it links to in Symlink, and an empty directory has Dir set.
+type syncItem struct {
+	Key        string `json:"key"`
+	Source     string `json:"source"`
+	Target     string `json:"target"`
+	SourcePath string `json:"source_path"`
+	TargetPath string `json:"target_path"`
+	Size       int64  `json:"size"`
+	Checksum   string `json:"checksum"`
+	Delete     bool   `json:"delete,omitempty"`
+	Symlink    string `json:"symlink,omitempty"`
+	Dir        bool   `json:"dir,omitempty"`
+
+	progress int64
+}
+
+func (i *syncItem) event(t EventType) Event {
+	return Event{
+		Type:     t,
+		Key:      i.Key,
+		Source:   i.Source,
+		Target:   i.Target,
+		Size:     i.Size,
+		Checksum: i.Checksum,
+	}
+}
+
+// syncStats totals the transfers of a sync for its SyncFinished event.
+type syncStats struct {
+	mu        sync.Mutex
+	files     int
+	failed    int
+	deleted   int
+	conflicts int
+	bytes     int64
+
+	// verifyFailed counts failed verifications, including those
+	// succeeding when retried.
+	verifyFailed int
+}
+
+func (st *syncStats) add(bytes int64, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err != nil {
+		st.failed++
+		return
+	}
+	st.files++
+	st.bytes += bytes
+}
+
+// plan returns the items to transfer. When resuming these are the items
+// remaining in the journal, otherwise they are planned by planner and
+// recorded in the journal.
+func (s *SyncPair) plan(planner func() ([]*syncItem, error)) ([]*syncItem, error) {
+	if s.journal.resuming() {
+		items := s.journal.remaining()
+		log.Infof("Resuming sync with '%d' files remaining.", len(items))
+		return items, nil
+	}
+
+	items, err := planner()
+	if err != nil {
+		return nil, err
+	}
+	return items, s.journal.plan(items)
+}
+
+// splitDeletions separates the items to delete from those to transfer.
+func splitDeletions(items []*syncItem) (transfers, deletions []*syncItem) {
+	for _, item := range items {
+		if item.Delete {
+			deletions = append(deletions, item)
+		} else {
+			transfers = append(transfers, item)
+		}
+	}
+	return transfers, deletions
+}
+
+// A writer performs the transfer of an item, aborting it if ctx is done.
+type writer func(ctx context.Context, item *syncItem) (int64, error)
+
+// transfer concurrently writes each item. Once a transfer fails, or the
+// sync is stopped or ctx is done, no more are started and an error is
+// returned after those in flight complete.
+func (s *SyncPair) transfer(ctx context.Context, items []*syncItem, write writer) error {
+	for _, item := range items {
+		s.emit(item.event(TransferPlanned))
+	}
+
+	pool := s.newPool()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+
+	scheduled := 0
+	for _, item := range items {
+		// Get transfer reservation from pool
+		log.Tracef("Requesting reservation for '%s'.", item.Key)
+		if err := pool.acquire(ctx); err != nil {
+			break
+		}
+		log.Tracef("Retrieved reservation for '%s'.", item.Key)
+
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed || s.stopped() {
+			pool.release(0, nil)
+			break
+		}
+		scheduled++
+
+		log.Infof("Starting sync: %s -> %s.", item.Source, item.Target)
+		wg.Add(1)
+		go func(item *syncItem) {
+			defer wg.Done()
+			if err := s.transferItem(ctx, pool, item, write); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(item)
+	}
+
+	// Wait for all routines to finish
+	wg.Wait()
+
+	switch {
+	case firstErr != nil:
+		return firstErr
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case scheduled < len(items):
+		return ErrStopped
+	}
+	return nil
+}
+
+func (s *SyncPair) transferItem(ctx context.Context, pool *pool, item *syncItem, write writer) error {
+	start := time.Now()
+	s.emit(item.event(TransferStarted))
+
+	var bytes int64
+	err := pool.run(ctx, func() (int64, error) {
+		n, err := write(ctx, item)
+		if err != nil {
+			s.discardProgress(item)
+		}
+		if isVerifyFailure(err) {
+			s.verifyFailed(item, err)
+		}
+		bytes = n
+		return n, err
+	})
+	s.stats.add(bytes, err)
+	if err == nil {
+		if jerr := s.journal.complete(item); jerr != nil {
+			log.Warnf("Error recording '%s' in journal: %s", item.Key, jerr.Error())
+		}
+	}
+
+	e := item.event(TransferFinished)
+	e.Duration = time.Since(start)
+	if err != nil {
+		log.Errorf("Sync failed: %s -> %s: %s", item.Source, item.Target, err.Error())
+		e.Type = TransferFailed
+		e.Err = err
+	} else {
+		log.Infof("Sync completed successfully: %s -> %s.", item.Source, item.Target)
+	}
+	s.emit(e)
+
+	return err
+}
+
+// reader wraps the body of a transfer so that it is subject to the
+// bandwidth limit, reports its progress and fails once ctx is done.
+func (s *SyncPair) reader(ctx context.Context, item *syncItem, r io.Reader) io.Reader {
+	r = s.BandwidthLimiter.Reader(&contextReader{r: r, ctx: ctx})
+	if len(s.EventHandlers) == 0 {
+		return r
+	}
+	return &progressReader{r: r, s: s, item: item}
+}
+
+// addProgress reports n more bytes of item transferred.
+func (s *SyncPair) addProgress(item *syncItem, n int64) {
+	if len(s.EventHandlers) == 0 {
+		return
+	}
+	atomic.AddInt64(&item.progress, n)
+	e := item.event(TransferProgress)
+	e.Bytes = n
+	s.emit(e)
+}
+
+// discardProgress reports the progress of a failed attempt as undone.
+func (s *SyncPair) discardProgress(item *syncItem) {
+	if n := atomic.SwapInt64(&item.progress, 0); n != 0 {
+		e := item.event(TransferProgress)
+		e.Bytes = -n
+		s.emit(e)
+	}
+}
+
+type progressReader struct {
+	r    io.Reader
+	s    *SyncPair
+	item *syncItem
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.s.addProgress(pr.item, int64(n))
+	}
+	return n, err
+}
+
+// A contextReader fails with the error of its context once it is done,
+// aborting the request or copy reading from it.
+type contextReader struct {
+	r   io.Reader
+	ctx context.Context
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
@@ -0,0 +1,51 @@
+package gosync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mitchellh/goamz/aws"
+)
+
+func testItems(keys ...string) []*syncItem {
+	items := []*syncItem{}
+	for _, key := range keys {
+		items = append(items, &syncItem{Key: key, Source: key, Target: key})
+	}
+	return items
+}
+
+func TestTransferStop(t *testing.T) {
+	sp := NewSyncPair(aws.Auth{}, "", "", "")
+	written := 0
+	err := sp.transfer(context.Background(), testItems("a", "b", "c"), func(ctx context.Context, item *syncItem) (int64, error) {
+		written++
+		sp.Stop()
+		return 1, nil
+	})
+
+	if err != ErrStopped {
+		t.Fatalf("Expected sync to be stopped, got '%v'.", err)
+	}
+	if written != 1 || sp.stats.files != 1 {
+		t.Fatalf("Expected in flight transfer only to complete, %d written.", written)
+	}
+}
+
+func TestTransferCancel(t *testing.T) {
+	sp := NewSyncPair(aws.Auth{}, "", "", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	written := 0
+	err := sp.transfer(ctx, testItems("a", "b", "c"), func(ctx context.Context, item *syncItem) (int64, error) {
+		written++
+		cancel()
+		return 0, ctx.Err()
+	})
+
+	if err != context.Canceled {
+		t.Fatalf("Expected sync to be cancelled, got '%v'.", err)
+	}
+	if written != 1 || sp.stats.failed != 1 {
+		t.Fatalf("Expected one cancelled transfer, %d written.", written)
+	}
+}
@@ -0,0 +1,292 @@
+package gosync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/mitchellh/goamz/s3"
+)
+
+const (
+	defaultDebounce       = time.Second
+	defaultRescanInterval = 10 * time.Minute
+)
+
+// How often a watch checks whether it has been stopped.
+const watchStopInterval = 250 * time.Millisecond
+
+// Watch syncs a local directory to S3 and then keeps it in sync, uploading
+// files as they change until ctx is done or Stop is called. A file is
+// uploaded once it has not changed for Debounce, and when Delete is set
+// files removed from the directory are deleted from S3. The directory is
+// fully rescanned every RescanInterval, and whenever changes may have been
+// missed. Errors syncing changes are logged and the watch continues.
+//
+// When the source is in S3 and the target a local directory, S3 is polled
+// for changes every PollInterval instead.
+func (s *SyncPair) Watch(ctx context.Context) error {
+	if !s.validPair() || s.multipleSources() || validS3Url(s.Target) == validS3Url(s.Source) {
+		return errors.New("Watching requires a local directory and an S3 location.")
+	}
+	if s.Dedup {
+		return errors.New("Watching does not support deduplicated syncs.")
+	}
+	if s.PublishManifest || s.SigningKey != nil || s.PublicKey != nil {
+		return errors.New("Watching does not support manifests.")
+	}
+	if err := s.validFilters(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&s.stop, 0)
+
+	if validS3Url(s.Source) {
+		return s.poll(ctx)
+	}
+
+	s3url := newS3Url(s.target())
+	bucket, err := lookupBucket(s3url.Bucket(), s.Auth, s.Region)
+	if err != nil {
+		return err
+	}
+
+	// Watch before the initial sync so no change made during it is missed.
+	var events <-chan string
+	var errs <-chan error
+	w, err := newWatcher(s.Source)
+	if err != nil {
+		log.Warnf("Unable to watch '%s', relying on rescans: %s", s.Source, err.Error())
+	} else {
+		defer w.Close()
+		events, errs = w.Events, w.Errors
+	}
+
+	if err := s.run(ctx, s.sync); err != nil {
+		return err
+	}
+	s.Resume = false
+	log.Infof("Watching '%s' for changes.", s.Source)
+
+	var rescan <-chan time.Time
+	if s.RescanInterval > 0 {
+		ticker := time.NewTicker(s.RescanInterval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+	poll := time.NewTicker(watchStopInterval)
+	defer poll.Stop()
+
+	changes := newPendingChanges(s.Debounce)
+	settle := time.NewTimer(s.Debounce)
+	settle.Stop()
+
+	for {
+		err = nil
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-poll.C:
+			if s.stopped() {
+				return ErrStopped
+			}
+		case path := <-events:
+			if changes.add(path, time.Now()) {
+				settle.Reset(s.Debounce)
+			}
+		case werr := <-errs:
+			log.Warnf("Error watching '%s', rescanning: %s", s.Source, werr.Error())
+			err = s.run(ctx, s.sync)
+		case <-rescan:
+			log.Infof("Rescanning '%s'.", s.Source)
+			err = s.run(ctx, s.sync)
+		case <-settle.C:
+			ready, removed, next := changes.settle(time.Now())
+			if next > 0 {
+				settle.Reset(next)
+			}
+			err = s.syncChanges(ctx, s3url, bucket, ready, removed)
+		}
+
+		switch {
+		case err == nil:
+		case err == ErrStopped || ctx.Err() != nil:
+			return err
+		default:
+			log.Errorf("Error syncing changes to '%s': %s", s.Target, err.Error())
+		}
+	}
+}
+
+// syncChanges uploads the ready files which differ from their objects and,
+// when Delete is set, deletes the objects of removed paths.
+func (s *SyncPair) syncChanges(ctx context.Context, s3url s3Url, bucket *s3.Bucket, ready, removed []string) error {
+	items, err := s.planChanges(s3url, bucket, ready, removed)
+	if err != nil || len(items) == 0 {
+		return err
+	}
+
+	return s.run(ctx, func(ctx context.Context) error {
+		if err := s.journal.plan(items); err != nil {
+			return err
+		}
+		return s.transferToS3(ctx, bucket, items)
+	})
+}
+
+func (s *SyncPair) planChanges(s3url s3Url, bucket *s3.Bucket, ready, removed []string) ([]*syncItem, error) {
+	source := filepath.ToSlash(s.Source)
+	items := []*syncItem{}
+
+	for _, path := range ready {
+		file := relativePath(source, filepath.ToSlash(path))
+		if s.excluded(file) {
+			continue
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		sum, err := md5Sum(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		item, err := s.dirToS3Item(s3url, bucket, file, sum)
+		if err != nil {
+			return nil, err
+		}
+
+		// Files are often saved unchanged, so only upload those which
+		// differ from their object.
+		if resp, err := bucket.Head(item.TargetPath); err == nil {
+			resp.Body.Close()
+			if matchesETag(path, sum, strings.Trim(resp.Header.Get("ETag"), "\""), s.PartSize) {
+				log.Debugf("File '%s' is unchanged.", path)
+				continue
+			}
+		}
+		items = append(items, item)
+	}
+
+	if !s.Delete {
+		return items, nil
+	}
+
+	// A removed path may have been a directory, so delete every object
+	// below it whose file no longer exists.
+	for _, path := range removed {
+		file := relativePath(source, filepath.ToSlash(path))
+		prefix := strings.TrimLeft(strings.Join([]string{s3url.Key(), file}, "/"), "/")
+		keys, err := loadS3Keys(bucket, prefix, make(map[string]s3.Key), "")
+		if err != nil {
+			return nil, err
+		}
+
+		for key, _ := range keys {
+			if key != prefix && !strings.HasPrefix(key, prefix+"/") {
+				continue
+			}
+			rel, ok := relativeKey(s3url.Path(), key)
+			if ok && !s.excluded(rel) && !pathExists(strings.Join([]string{s.Source, rel}, "/")) {
+				items = append(items, deletionItem(rel, s3Location(bucket, key), key))
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// pendingChanges tracks the paths changed since they were last synced
+// until they settle. A path settles once no event has been seen for it for
+// the debounce period and its size and modification time are unchanged
+// since it was last observed, so files still being written are not
+// uploaded.
+type pendingChanges struct {
+	debounce time.Duration
+	paths    map[string]*pendingPath
+}
+
+type pendingPath struct {
+	event    time.Time
+	observed bool
+	size     int64
+	modTime  time.Time
+}
+
+func newPendingChanges(debounce time.Duration) *pendingChanges {
+	return &pendingChanges{debounce: debounce, paths: map[string]*pendingPath{}}
+}
+
+// add records an event for path, reporting whether no other paths were
+// pending.
+func (p *pendingChanges) add(path string, now time.Time) bool {
+	first := len(p.paths) == 0
+	if pp, ok := p.paths[path]; ok {
+		pp.event = now
+	} else {
+		p.paths[path] = &pendingPath{event: now}
+	}
+	return first
+}
+
+// settle returns the files which are ready to sync and the paths which
+// were removed. Directories are replaced by the files within them. The
+// time until the next path may settle is returned, or 0 if none are
+// pending.
+func (p *pendingChanges) settle(now time.Time) (ready, removed []string, next time.Duration) {
+	for path, pp := range p.paths {
+		if now.Sub(pp.event) < p.debounce {
+			continue
+		}
+
+		info, err := os.Lstat(path)
+		switch {
+		case os.IsNotExist(err):
+			delete(p.paths, path)
+			removed = append(removed, path)
+		case err != nil:
+			log.Warnf("Unable to stat '%s': %s", path, err.Error())
+			delete(p.paths, path)
+		case info.IsDir():
+			// A directory created, or moved here, with files already in it.
+			delete(p.paths, path)
+			filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					p.paths[file] = &pendingPath{event: now}
+				}
+				return nil
+			})
+		case !info.Mode().IsRegular():
+			delete(p.paths, path)
+		case pp.observed && pp.size == info.Size() && pp.modTime.Equal(info.ModTime()):
+			delete(p.paths, path)
+			ready = append(ready, path)
+		default:
+			pp.observed = true
+			pp.size = info.Size()
+			pp.modTime = info.ModTime()
+			pp.event = now
+		}
+	}
+
+	for _, pp := range p.paths {
+		wait := p.debounce - now.Sub(pp.event)
+		if wait <= 0 {
+			wait = time.Millisecond
+		}
+		if next == 0 || wait < next {
+			next = wait
+		}
+	}
+	return ready, removed, next
+}
@@ -0,0 +1,162 @@
+//go:build linux
+// +build linux
+
+package gosync
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVE_SELF | syscall.IN_ONLYDIR
+
+var errWatchOverflow = errors.New("Too many changes to watch, events were lost.")
+
+// A watcher reports the paths created, changed or removed within a
+// directory tree using inotify. Directories created in the tree are
+// watched as they appear. When changes are lost, because the kernel's
+// queue or Events overflowed, an error is sent on Errors.
+type watcher struct {
+	Events chan string
+	Errors chan error
+
+	root string
+	fd   int
+	f    *os.File
+	done chan struct{}
+
+	mu   sync.Mutex
+	dirs map[int32]string
+}
+
+func newWatcher(root string) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &watcher{
+		Events: make(chan string, 4096),
+		Errors: make(chan error, 1),
+		root:   filepath.Clean(root),
+		fd:     fd,
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		done:   make(chan struct{}),
+		dirs:   map[int32]string{},
+	}
+	if err := w.add(w.root); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+
+	go w.read()
+	return w, nil
+}
+
+// add watches dir and every directory below it.
+func (w *watcher) add(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Directories may be removed as they are walked.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			if err == syscall.ENOENT || err == syscall.ENOTDIR {
+				return nil
+			}
+			return err
+		}
+		w.mu.Lock()
+		w.dirs[int32(wd)] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *watcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			select {
+			case <-w.done:
+			default:
+				w.error(err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+int(raw.Len)]), "\x00")
+			w.handle(raw.Wd, raw.Mask, name)
+			offset = start + int(raw.Len)
+		}
+	}
+}
+
+func (w *watcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.error(errWatchOverflow)
+		return
+	}
+
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mu.Unlock()
+	if !ok || mask&syscall.IN_IGNORED != 0 {
+		return
+	}
+
+	// Directories below the root are reported by their parent.
+	if mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+		if dir == w.root {
+			w.error(errors.New("Watched directory was removed."))
+		}
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		if err := w.add(path); err != nil {
+			w.error(err)
+		}
+	}
+
+	select {
+	case w.Events <- path:
+	default:
+		w.error(errWatchOverflow)
+	}
+}
+
+func (w *watcher) error(err error) {
+	select {
+	case w.Errors <- err:
+	default:
+	}
+}
+
+func (w *watcher) Close() error {
+	close(w.done)
+	return w.f.Close()
+}
@@ -0,0 +1,54 @@
+package gosync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatalf("Error creating temp dir.")
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := newWatcher(dir)
+	if err != nil {
+		t.Fatalf("Error watching '%s': %s", dir, err)
+	}
+	defer w.Close()
+
+	expect := func(path string) {
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case p := <-w.Events:
+				if p == path {
+					return
+				}
+			case err := <-w.Errors:
+				t.Fatalf("Error watching: %s", err)
+			case <-timeout:
+				t.Fatalf("Timed out waiting for '%s'.", path)
+			}
+		}
+	}
+
+	// Directories created are watched too.
+	sub := filepath.Join(dir, "sub")
+	os.Mkdir(sub, 0755)
+	expect(sub)
+
+	file := filepath.Join(sub, "file")
+	ioutil.WriteFile(file, []byte("test"), 0644)
+	expect(file)
+
+	os.Remove(file)
+	expect(file)
+
+	os.Remove(sub)
+	expect(sub)
+}
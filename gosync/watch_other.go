@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package gosync
+
+import "errors"
+
+// Without inotify changes are only found by periodic rescans.
+type watcher struct {
+	Events chan string
+	Errors chan error
+}
+
+func newWatcher(root string) (*watcher, error) {
+	return nil, errors.New("Watching is not supported on this platform.")
+}
+
+func (w *watcher) Close() error {
+	return nil
+}
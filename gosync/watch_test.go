@@ -0,0 +1,106 @@
+package gosync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+)
+
+func TestPendingChangesSettle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatalf("Error creating temp dir.")
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "file")
+	nested := filepath.Join(dir, "nested")
+	removed := filepath.Join(dir, "removed")
+	ioutil.WriteFile(file, []byte("test"), 0644)
+	os.Mkdir(nested, 0755)
+	ioutil.WriteFile(filepath.Join(nested, "a"), []byte("a"), 0644)
+
+	start := time.Now()
+	p := newPendingChanges(time.Second)
+	if !p.add(file, start) || p.add(nested, start) || p.add(removed, start) {
+		t.Fatalf("Expected only the first path added to be reported.")
+	}
+
+	// Nothing settles within the debounce period.
+	ready, gone, next := p.settle(start.Add(500 * time.Millisecond))
+	if len(ready) != 0 || len(gone) != 0 || next != 500*time.Millisecond {
+		t.Fatalf("Expected nothing settled, got '%v' '%v' '%s'.", ready, gone, next)
+	}
+
+	// Files are observed before they are ready, directories are replaced
+	// by their files and removed paths are reported at once.
+	now := start.Add(time.Second)
+	ready, gone, next = p.settle(now)
+	if len(ready) != 0 || !reflect.DeepEqual(gone, []string{removed}) || next != time.Second {
+		t.Fatalf("Expected only removal settled, got '%v' '%v' '%s'.", ready, gone, next)
+	}
+
+	// A file still being written is not ready.
+	ioutil.WriteFile(file, []byte("testing"), 0644)
+	now = now.Add(time.Second)
+	ready, _, _ = p.settle(now)
+	if len(ready) != 0 {
+		t.Fatalf("Expected no files ready, got '%v'.", ready)
+	}
+
+	now = now.Add(time.Second)
+	ready, _, next = p.settle(now)
+	sort.Strings(ready)
+	expected := []string{file, filepath.Join(nested, "a")}
+	if !reflect.DeepEqual(ready, expected) || next != 0 {
+		t.Fatalf("Expected '%v' ready, got '%v' '%s'.", expected, ready, next)
+	}
+}
+
+func TestPollChangesRetried(t *testing.T) {
+	m, f, stop := testS3(t, "bucket")
+	defer stop()
+	target, _ := ioutil.TempDir("", "gosync")
+	defer os.RemoveAll(target)
+
+	sp := NewSyncPair(aws.Auth{}, "s3://bucket/data/", target, faultyRegion)
+	sp.Delete = true
+	s3url := newS3Url(sp.Source)
+	bucket, _ := lookupBucket(s3url.Bucket(), sp.Auth, sp.Region)
+
+	// A failed download is not recorded as seen, so the next poll
+	// retries it.
+	m.put("bucket", "data/a", "a")
+	f.inject(failOn("Get", 1, 403, "AccessDenied"))
+	seen, err := sp.pollChanges(context.Background(), s3url, bucket, map[string]s3.Key{})
+	if _, ok := seen["data/a"]; err == nil || ok {
+		t.Fatalf("Expected failed download not seen, got '%v' '%v'.", seen, err)
+	}
+	if seen, err = sp.pollChanges(context.Background(), s3url, bucket, seen); err != nil {
+		t.Fatalf("Error polling: %s", err)
+	}
+	checkLocalFiles(t, target, map[string]string{"a": "a"})
+
+	// As is a failed deletion, of a file replaced by a directory which
+	// can not be removed.
+	m.del("bucket", "data/a")
+	os.Remove(filepath.Join(target, "a"))
+	os.MkdirAll(filepath.Join(target, "a", "b"), 0755)
+	seen, err = sp.pollChanges(context.Background(), s3url, bucket, seen)
+	os.RemoveAll(filepath.Join(target, "a", "b"))
+	if _, ok := seen["data/a"]; err == nil || !ok {
+		t.Fatalf("Expected failed deletion still seen, got '%v' '%v'.", seen, err)
+	}
+	if _, err = sp.pollChanges(context.Background(), s3url, bucket, seen); err != nil {
+		t.Fatalf("Error polling: %s", err)
+	}
+	checkLocalFiles(t, target, map[string]string{})
+}
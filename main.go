@@ -1,8 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/md5"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/brettweavnet/gosync/gosync"
 	"github.com/brettweavnet/gosync/version"
@@ -15,76 +23,308 @@ import (
 func main() {
 	app := cli.NewApp()
 	app.Name = "gosync"
-	app.Usage = "gosync OPTIONS SOURCE TARGET"
+	app.Usage = "gosync OPTIONS SOURCE... TARGET"
 	app.Version = version.Version()
 	app.Flags = []cli.Flag{
-		cli.IntFlag{Name: "concurrent, c", Value: 20, Usage: "number of concurrent transfers"},
+		cli.IntFlag{Name: "concurrent, c", Value: 20, Usage: "number of concurrent transfers (maximum when adaptive)"},
+		cli.BoolFlag{Name: "adaptive", Usage: "adapt concurrent transfers to throughput and throttling"},
+		cli.IntFlag{Name: "min-concurrent", Value: 2, Usage: "minimum number of concurrent transfers when adaptive"},
 		cli.StringFlag{Name: "log-level, l", Value: "info", Usage: "log level"},
 		cli.StringFlag{Name: "aws-secret-access-key", Value: "", Usage: "AWS Secret Access Key"},
 		cli.StringFlag{Name: "aws-access-key-id", Value: "", Usage: "AWS Access Key Id"},
 		cli.StringFlag{Name: "aws-security-token", Value: "", Usage: "AWS Security Token"},
 		cli.StringFlag{Name: "aws-region", Value: "", Usage: "AWS Region"},
+		cli.StringFlag{Name: "output, o", Value: "text", Usage: "output format, text or json (NDJSON events)"},
+		cli.StringFlag{Name: "output-file", Value: "", Usage: "write json events to this file rather than stdout"},
+		cli.BoolFlag{Name: "progress", Usage: "report progress with throughput and ETA"},
+		cli.BoolFlag{Name: "resume", Usage: "resume an interrupted sync from its journal"},
+		cli.StringFlag{Name: "journal", Value: "", Usage: "journal file (default in the temp dir, named for source and target)"},
+		cli.StringFlag{Name: "multipart-threshold", Value: "64M", Usage: "upload files of at least this size in parts, 0 to disable"},
+		cli.StringFlag{Name: "part-size", Value: "16M", Usage: "size of parts in multipart uploads"},
+		cli.BoolFlag{Name: "delta", Usage: "upload only the changed parts of files uploaded in parts, copying the rest within S3"},
+		cli.BoolFlag{Name: "verify", Usage: "check each object uploaded with a HEAD request"},
+		cli.StringFlag{Name: "checksum-algorithm", Value: "md5", Usage: "compare files by md5, or by sha256 or crc32c stored in the metadata of objects"},
+		cli.BoolFlag{Name: "follow-symlinks", Usage: "sync the files of symlinked directories, which are skipped by default"},
+		cli.BoolFlag{Name: "copy-symlinks-as-objects", Usage: "upload symlinks as empty objects recording their target, and recreate them when downloading"},
+		cli.BoolFlag{Name: "dir-markers", Usage: "upload empty directories as empty objects named dir/"},
+		cli.BoolFlag{Name: "unpack", Usage: "sync the entries of a source tar or tar.gz archive"},
+		cli.BoolFlag{Name: "pack", Usage: "write the source to a target tar.gz archive, or tar if named .tar"},
+		cli.BoolFlag{Name: "delete", Usage: "delete files from the target which are not in the source"},
+		cli.BoolFlag{Name: "hard-link", Usage: "hard link rather than copy files between local directories"},
+		cli.BoolFlag{Name: "preserve", Usage: "preserve the mode, modification time and owner of files copied between local directories"},
+		cli.BoolFlag{Name: "dedup", Usage: "store each file content once in S3, recording the tree synced in a manifest"},
+		cli.StringFlag{Name: "manifest", Value: "", Usage: "name of the manifest of a deduplicated sync"},
+		cli.BoolFlag{Name: "publish-manifest", Usage: "write a manifest of the files synced into the S3 target"},
+		cli.StringFlag{Name: "sign-key", Value: "", Usage: "sign the manifest with this PEM encoded ed25519 private key"},
+		cli.StringFlag{Name: "verify-key", Value: "", Usage: "require a manifest signed by this PEM encoded ed25519 public key, refusing files not matching it"},
+		cli.BoolFlag{Name: "watch", Usage: "keep syncing a local directory to S3 as it changes"},
+		cli.DurationFlag{Name: "debounce", Value: time.Second, Usage: "when watching, sync files once unchanged for this long"},
+		cli.DurationFlag{Name: "rescan-interval", Value: 10 * time.Minute, Usage: "when watching, rescan the directory this often, 0 to disable"},
+		cli.DurationFlag{Name: "poll-interval", Value: time.Minute, Usage: "keep syncing from S3 to a local directory, polling S3 this often"},
+		cli.StringSliceFlag{Name: "include", Value: &cli.StringSlice{}, Usage: "only sync files matching this glob pattern (repeatable)"},
+		cli.StringSliceFlag{Name: "exclude", Value: &cli.StringSlice{}, Usage: "do not sync files matching this glob pattern (repeatable)"},
+		cli.StringSliceFlag{Name: "header", Value: &cli.StringSlice{}, Usage: "header set on objects uploaded e.g. 'Cache-Control: max-age=3600' (repeatable)"},
+		cli.StringFlag{Name: "bwlimit", Value: "", Usage: "bandwidth limit in bytes/sec (K/M/G suffixes) or timetable e.g. '08:00,512K 19:00,off'"},
 	}
 
+	app.Commands = []cli.Command{runCommand, bisyncCommand, snapshotCommand, restoreCommand, gcCommand, verifyCommand}
+
 	const concurrent = 20
 
 	app.Action = func(c *cli.Context) {
 		defer log.Flush()
-		setLogLevel(c.String("log-level"))
+
+		// JSON events or an object streamed to stdout must not be mixed
+		// with logs.
+		jsonStdout := c.String("output") == "json" && c.String("output-file") == ""
+		streamStdout := len(c.Args()) > 0 && c.Args()[len(c.Args())-1] == "-"
+		setLogLevel(c.String("log-level"), jsonStdout || streamStdout)
 
 		err := validateArgs(c)
 		exitOnError(err)
+		if jsonStdout && streamStdout {
+			exitOnError(fmt.Errorf("JSON events can not be written to stdout while streaming to it."))
+		}
+
+		args := c.Args()
+		sources, target := args[:len(args)-1], args[len(args)-1]
+		syncPair := newSyncPair(c, sources[0], target)
+		if len(sources) > 1 {
+			log.Infof("Setting sources to '%s'.", strings.Join(sources, "', '"))
+			syncPair.Sources = sources
+		}
+
+		syncPair.JournalPath = c.String("journal")
+		if syncPair.JournalPath == "" {
+			syncPair.JournalPath = journalPath(strings.Join(sources, "\n"), target)
+		}
+		syncPair.Resume = c.Bool("resume")
+		log.Debugf("Setting journal to '%s'.", syncPair.JournalPath)
 
-		key := c.String("aws-access-key-id")
-		secret := c.String("aws-secret-access-key")
-		token := c.String("aws-security-token")
-		region := c.String("aws-region")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		handleSignals(syncPair.Stop, cancel)
 
-		auth, err := aws.GetAuth(key, secret)
-		exitOnError(err)
-		if token != "" {
-			auth.Token = token
+		if c.Bool("watch") || c.IsSet("poll-interval") {
+			syncPair.Debounce = c.Duration("debounce")
+			syncPair.RescanInterval = c.Duration("rescan-interval")
+			syncPair.PollInterval = c.Duration("poll-interval")
+			if syncPair.PollInterval <= 0 {
+				exitOnError(fmt.Errorf("Poll interval must be greater than 0."))
+			}
+			err = syncPair.Watch(ctx)
+			if err == gosync.ErrStopped {
+				err = nil
+			}
+		} else {
+			err = syncPair.SyncWithContext(ctx)
 		}
+		exitOnError(err)
+
+		log.Infof("Syncing completed successfully.")
+	}
+	app.Run(os.Args)
+	exitOnError(closeOutput())
+}
+
+// newSyncPair returns a SyncPair from source to target configured by the
+// global options.
+func newSyncPair(c *cli.Context, source, target string) *gosync.SyncPair {
+	events, err := eventOutput(c.GlobalString("output"), c.GlobalString("output-file"))
+	exitOnError(err)
+
+	key := c.GlobalString("aws-access-key-id")
+	secret := c.GlobalString("aws-secret-access-key")
+	token := c.GlobalString("aws-security-token")
+	region := c.GlobalString("aws-region")
 
-		source := c.Args()[0]
-		log.Infof("Setting source to '%s'.", source)
+	auth, err := aws.GetAuth(key, secret)
+	exitOnError(err)
+	if token != "" {
+		auth.Token = token
+	}
+
+	log.Infof("Setting source to '%s'.", source)
+	log.Infof("Setting target to '%s'.", target)
 
-		target := c.Args()[1]
-		log.Infof("Setting target to '%s'.", target)
+	syncPair := gosync.NewSyncPair(auth, source, target, region)
 
-		syncPair := gosync.NewSyncPair(auth, source, target, region)
+	syncPair.Concurrent = c.GlobalInt("concurrent")
+	log.Infof("Setting concurrent transfers to '%d'.", syncPair.Concurrent)
 
-		syncPair.Concurrent = c.Int("concurrent")
-		log.Infof("Setting concurrent transfers to '%d'.", syncPair.Concurrent)
+	if c.GlobalBool("adaptive") {
+		syncPair.Adaptive = true
+		syncPair.MinConcurrent = c.GlobalInt("min-concurrent")
+		log.Infof("Adapting concurrent transfers between '%d' and '%d'.", syncPair.MinConcurrent, syncPair.Concurrent)
+	}
 
-		err = syncPair.Sync()
+	if bwlimit := c.GlobalString("bwlimit"); bwlimit != "" {
+		syncPair.BandwidthLimiter, err = gosync.NewBandwidthLimiter(bwlimit)
 		exitOnError(err)
+		log.Infof("Setting bandwidth limit to '%s'.", bwlimit)
+	}
 
-		log.Infof("Syncing completed successfully.")
+	syncPair.MultipartThreshold, err = gosync.ParseByteSize(c.GlobalString("multipart-threshold"))
+	exitOnError(err)
+	syncPair.PartSize, err = gosync.ParsePartSize(c.GlobalString("part-size"))
+	exitOnError(err)
+	syncPair.Delta = c.GlobalBool("delta")
+	syncPair.Verify = c.GlobalBool("verify")
+	syncPair.ChecksumAlgorithm = c.GlobalString("checksum-algorithm")
+
+	syncPair.Include = c.GlobalStringSlice("include")
+	syncPair.Exclude = c.GlobalStringSlice("exclude")
+	syncPair.Headers, err = parseHeaders(c.GlobalStringSlice("header"))
+	exitOnError(err)
+
+	syncPair.FollowSymlinks = c.GlobalBool("follow-symlinks")
+	syncPair.CopySymlinksAsObjects = c.GlobalBool("copy-symlinks-as-objects")
+	syncPair.DirMarkers = c.GlobalBool("dir-markers")
+	syncPair.Unpack = c.GlobalBool("unpack")
+	syncPair.Pack = c.GlobalBool("pack")
+	syncPair.HardLink = c.GlobalBool("hard-link")
+	syncPair.PreserveMetadata = c.GlobalBool("preserve")
+
+	syncPair.PublishManifest = c.GlobalBool("publish-manifest")
+	if path := c.GlobalString("sign-key"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		exitOnError(err)
+		syncPair.SigningKey, err = gosync.ParsePrivateKey(data)
+		exitOnError(err)
+		log.Infof("Signing manifest with key '%s'.", path)
 	}
-	app.Run(os.Args)
+	if path := c.GlobalString("verify-key"); path != "" {
+		data, err := ioutil.ReadFile(path)
+		exitOnError(err)
+		syncPair.PublicKey, err = gosync.ParsePublicKey(data)
+		exitOnError(err)
+		log.Infof("Requiring manifest signed by key '%s'.", path)
+	}
+
+	syncPair.Dedup = c.GlobalBool("dedup")
+	syncPair.Manifest = c.GlobalString("manifest")
+	if syncPair.Dedup {
+		log.Infof("Syncing with deduplicated store using manifest '%s'.", syncPair.Manifest)
+	}
+
+	syncPair.Delete = c.GlobalBool("delete")
+	if syncPair.Delete {
+		log.Infof("Deleting files from target which are not in source.")
+	}
+
+	if events != nil {
+		syncPair.EventHandlers = append(syncPair.EventHandlers, events)
+	}
+
+	if c.GlobalBool("progress") {
+		syncPair.EventHandlers = append(syncPair.EventHandlers, gosync.NewProgress(os.Stderr))
+	}
+
+	return syncPair
 }
 
 func validateArgs(c *cli.Context) error {
-	if len(c.Args()) != 2 {
+	if len(c.Args()) < 2 {
 		return fmt.Errorf("Source and target required.")
 	}
 	return nil
 }
 
+// handleSignals stops the sync on the first SIGINT or SIGTERM, letting
+// transfers in progress finish, and aborts them on the second.
+func handleSignals(stop func(), cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-signals
+		log.Warnf("Stopping, waiting for transfers in progress. Interrupt again to abort them.")
+		stop()
+
+		<-signals
+		log.Warnf("Aborting transfers in progress.")
+		cancel()
+	}()
+}
+
+func journalPath(source, target string) string {
+	name := fmt.Sprintf("gosync-%x.journal", md5.Sum([]byte(source+"\n"+target)))
+	return filepath.Join(os.TempDir(), name)
+}
+
+func eventOutput(output, path string) (gosync.EventHandler, error) {
+	switch output {
+	case "text":
+		return nil, nil
+	case "json":
+		if path != "" {
+			f, err := os.Create(path)
+			if err != nil {
+				return nil, err
+			}
+			outputFile = f
+			return gosync.NewJSONEvents(f), nil
+		}
+		return gosync.NewJSONEvents(os.Stdout), nil
+	}
+	return nil, fmt.Errorf("Unknown output format '%s'.", output)
+}
+
+// parseHeaders parses headers given as "Name: value".
+func parseHeaders(values []string) (map[string][]string, error) {
+	headers := map[string][]string{}
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Invalid header '%s'.", value)
+		}
+		name := strings.TrimSpace(parts[0])
+		headers[name] = append(headers[name], strings.TrimSpace(parts[1]))
+	}
+	return headers, nil
+}
+
+// outputFile is the --output-file events are written to, once created.
+var outputFile *os.File
+
+// closeOutput syncs and closes the outputFile, if any, so that an error
+// writing the events is reported rather than lost on exit.
+func closeOutput() error {
+	f := outputFile
+	if f == nil {
+		return nil
+	}
+	outputFile = nil
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
 func exitOnError(e error) {
 	if e != nil {
 		log.Errorf("Received error '%s'", e.Error())
+		if err := closeOutput(); err != nil {
+			log.Errorf("Error closing output file: %s", err.Error())
+		}
 		log.Flush()
 		os.Exit(1)
 	}
 }
 
-func setLogLevel(level string) {
+func setLogLevel(level string, stderr bool) {
+	var logger log.LoggerInterface
+	if stderr {
+		minLevel, _ := log.LogLevelFromString(level)
+		logger, _ = log.LoggerFromWriterWithMinLevel(os.Stderr, minLevel)
+	} else {
+		logConfig := fmt.Sprintf("<seelog minlevel='%s'>", level)
+		logger, _ = log.LoggerFromConfigAsBytes([]byte(logConfig))
+	}
+	log.ReplaceLogger(logger)
+
 	if level != "error" && level != "warn" {
 		log.Infof("Setting log level '%s'.", level)
 	}
-	logConfig := fmt.Sprintf("<seelog minlevel='%s'>", level)
-	logger, _ := log.LoggerFromConfigAsBytes([]byte(logConfig))
-	log.ReplaceLogger(logger)
 }
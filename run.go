@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/brettweavnet/gosync/gosync"
+
+	log "github.com/cihub/seelog"
+	"github.com/codegangsta/cli"
+)
+
+var runCommand = cli.Command{
+	Name:  "run",
+	Usage: "run the jobs defined in a config file, all of them or those named",
+	Description: "gosync [global options] run [--config FILE] [--parallel] [JOB...]\n\n" +
+		"   Jobs are defined in sections of an INI file, see the README for their options.",
+	Flags: []cli.Flag{
+		cli.StringFlag{Name: "config, f", Value: "gosync.ini", Usage: "config file defining jobs"},
+		cli.BoolFlag{Name: "parallel", Usage: "run jobs in parallel rather than one after another"},
+	},
+	Action: runJobs,
+}
+
+func runJobs(c *cli.Context) {
+	defer log.Flush()
+
+	jsonStdout := c.GlobalString("output") == "json" && c.GlobalString("output-file") == ""
+	setLogLevel(c.GlobalString("log-level"), jsonStdout)
+
+	events, err := eventOutput(c.GlobalString("output"), c.GlobalString("output-file"))
+	exitOnError(err)
+
+	jobs, err := gosync.LoadJobs(c.String("config"))
+	exitOnError(err)
+	jobs, err = selectJobs(jobs, c.Args())
+	exitOnError(err)
+
+	names := []string{}
+	for _, job := range jobs {
+		names = append(names, job.Name)
+	}
+	report := gosync.NewReport(names)
+
+	// Jobs share one progress line, which would be overwritten by each
+	// job's own when running in parallel.
+	progress := gosync.NewProgress(os.Stderr)
+	for _, job := range jobs {
+		job.EventHandlers = append(job.EventHandlers, report)
+		if events != nil {
+			job.EventHandlers = append(job.EventHandlers, events)
+		}
+		if c.GlobalBool("progress") {
+			job.EventHandlers = append(job.EventHandlers, progress)
+		}
+	}
+
+	// Once stopped no more jobs are started, and those running are stopped.
+	var stopped int32
+	stop := func() {
+		atomic.StoreInt32(&stopped, 1)
+		for _, job := range jobs {
+			job.Stop()
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(stop, cancel)
+
+	runJob := func(job *gosync.SyncPair) {
+		if atomic.LoadInt32(&stopped) == 1 {
+			return
+		}
+		log.Infof("Running job '%s': %s -> %s.", job.Name, job.Source, job.Target)
+		if err := job.SyncWithContext(ctx); err != nil {
+			log.Errorf("Job '%s' failed: %s", job.Name, err.Error())
+		}
+	}
+
+	if c.Bool("parallel") {
+		var wg sync.WaitGroup
+		for _, job := range jobs {
+			wg.Add(1)
+			go func(job *gosync.SyncPair) {
+				defer wg.Done()
+				runJob(job)
+			}(job)
+		}
+		wg.Wait()
+	} else {
+		for _, job := range jobs {
+			runJob(job)
+		}
+	}
+
+	log.Flush()
+	out := os.Stdout
+	if jsonStdout {
+		out = os.Stderr
+	}
+	report.WriteTo(out)
+
+	if failed := report.Failed(); failed > 0 {
+		exitOnError(fmt.Errorf("'%d' of '%d' jobs failed.", failed, len(jobs)))
+	}
+	log.Infof("All jobs completed successfully.")
+}
+
+// selectJobs returns the jobs named, in the order given, or all of them
+// when none are.
+func selectJobs(jobs []*gosync.SyncPair, names []string) ([]*gosync.SyncPair, error) {
+	if len(names) == 0 {
+		return jobs, nil
+	}
+
+	byName := map[string]*gosync.SyncPair{}
+	for _, job := range jobs {
+		byName[job.Name] = job
+	}
+
+	selected := []*gosync.SyncPair{}
+	for _, name := range names {
+		job, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown job '%s'.", name)
+		}
+		selected = append(selected, job)
+	}
+	return selected, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/brettweavnet/gosync/gosync"
+
+	log "github.com/cihub/seelog"
+	"github.com/codegangsta/cli"
+)
+
+var snapshotCommand = cli.Command{
+	Name:  "snapshot",
+	Usage: "copy a local directory to a new dated snapshot in S3",
+	Description: "gosync [global options] snapshot [--keep-daily N] [--keep-weekly N] [--keep-monthly N] DIR s3://bucket/prefix\n\n" +
+		"   Files unchanged since the previous snapshot are copied within S3 rather than uploaded.\n" +
+		"   With a retention policy, older snapshots it does not keep are deleted.",
+	Flags: []cli.Flag{
+		cli.IntFlag{Name: "keep-daily", Usage: "keep the newest snapshot of each of the last N days"},
+		cli.IntFlag{Name: "keep-weekly", Usage: "keep the newest snapshot of each of the last N weeks"},
+		cli.IntFlag{Name: "keep-monthly", Usage: "keep the newest snapshot of each of the last N months"},
+	},
+	Action: snapshot,
+}
+
+var restoreCommand = cli.Command{
+	Name:  "restore",
+	Usage: "list the snapshots in S3, or restore one to a local directory",
+	Description: "gosync [global options] restore s3://bucket/prefix [SNAPSHOT|latest DIR]\n\n" +
+		"   Without a snapshot, the snapshots are listed.",
+	Action: restore,
+}
+
+func snapshot(c *cli.Context) {
+	defer log.Flush()
+
+	jsonStdout := c.GlobalString("output") == "json" && c.GlobalString("output-file") == ""
+	setLogLevel(c.GlobalString("log-level"), jsonStdout)
+
+	if len(c.Args()) != 2 {
+		exitOnError(fmt.Errorf("Directory and S3 location required."))
+	}
+
+	syncPair := newSyncPair(c, c.Args()[0], c.Args()[1])
+	syncPair.Retention = gosync.Retention{
+		Daily:   c.Int("keep-daily"),
+		Weekly:  c.Int("keep-weekly"),
+		Monthly: c.Int("keep-monthly"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(syncPair.Stop, cancel)
+
+	name, err := syncPair.TakeSnapshot(ctx)
+	exitOnError(err)
+
+	log.Infof("Snapshot '%s' taken successfully.", name)
+}
+
+func restore(c *cli.Context) {
+	defer log.Flush()
+
+	jsonStdout := c.GlobalString("output") == "json" && c.GlobalString("output-file") == ""
+	setLogLevel(c.GlobalString("log-level"), jsonStdout)
+
+	switch len(c.Args()) {
+	case 1:
+		snapshots, err := newSyncPair(c, c.Args()[0], "").Snapshots()
+		exitOnError(err)
+
+		log.Flush()
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "SNAPSHOT\tFILES\tBYTES")
+		for _, s := range snapshots {
+			fmt.Fprintf(w, "%s\t%d\t%d\n", s.Name, s.Files, s.Size)
+		}
+		w.Flush()
+	case 3:
+		syncPair := newSyncPair(c, c.Args()[0], c.Args()[2])
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		handleSignals(syncPair.Stop, cancel)
+
+		err := syncPair.RestoreSnapshot(ctx, c.Args()[1])
+		exitOnError(err)
+
+		log.Infof("Restore completed successfully.")
+	default:
+		exitOnError(fmt.Errorf("S3 location, and to restore a snapshot its name and a directory, required."))
+	}
+}
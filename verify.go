@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	log "github.com/cihub/seelog"
+	"github.com/codegangsta/cli"
+)
+
+var verifyCommand = cli.Command{
+	Name:  "verify",
+	Usage: "report the files missing, extra or differing between two locations without syncing",
+	Description: "gosync [global options] verify [--deep] SOURCE TARGET\n\n" +
+		"   Exits with an error unless every file matches. Objects uploaded in parts whose ETag\n" +
+		"   can not be compared are reported unverified, unless --deep downloads and hashes them.",
+	Flags: []cli.Flag{
+		cli.BoolFlag{Name: "deep", Usage: "download and hash objects whose ETag is not their MD5"},
+	},
+	Action: verify,
+}
+
+func verify(c *cli.Context) {
+	defer log.Flush()
+
+	jsonStdout := c.GlobalString("output") == "json" && c.GlobalString("output-file") == ""
+	setLogLevel(c.GlobalString("log-level"), jsonStdout)
+
+	if len(c.Args()) != 2 {
+		exitOnError(fmt.Errorf("Source and target required."))
+	}
+
+	syncPair := newSyncPair(c, c.Args()[0], c.Args()[1])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleSignals(syncPair.Stop, cancel)
+
+	comparison, err := syncPair.Compare(ctx, c.Bool("deep"))
+	exitOnError(err)
+
+	// JSON events on stdout are not mixed with the table.
+	log.Flush()
+	out := os.Stdout
+	if jsonStdout {
+		out = os.Stderr
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	for _, d := range comparison.Differences {
+		fmt.Fprintf(w, "%s\t%s\n", d.Type, d.Key)
+	}
+	w.Flush()
+
+	if !comparison.Match() {
+		exitOnError(fmt.Errorf("'%d' files do not match.", len(comparison.Differences)))
+	}
+	log.Infof("All '%d' files match.", comparison.Matched)
+}